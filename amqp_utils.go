@@ -3,16 +3,32 @@ package artifacts
 import (
 	"fmt"
 	"log"
+	"time"
 
+	"github.com/deepcode-ai/artifacts/rmq"
 	"github.com/getsentry/sentry-go"
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-var ConsumerChannelActive = true
+// maxReconnectWait caps the wait between two attempts at restoring the
+// consumers after the connection closed.
+const maxReconnectWait = 30 * time.Second
 
-// SetupRMQConnection sets up the RabbitMQ connection and channels. It also spawns a goroutine that listens for any
-// "Close" events from the broker.
+// SetupRMQConnection sets up the RabbitMQ connection and channels, and declares a durable exchange. It also
+// spawns a goroutine that listens for any "Close" events from the broker.
 func SetupRMQConnection(retryFunc func() error, brokerUrl, exchangeName, exchangeType string) (*amqp.Connection, *amqp.Channel, error) {
+	return SetupRMQConnectionWithTopology(retryFunc, brokerUrl, &rmq.Topology{
+		Exchanges: []rmq.Exchange{{Name: exchangeName, Kind: exchangeType, Durable: true}},
+	})
+}
+
+// SetupRMQConnectionWithTopology sets up the RabbitMQ connection and channels, and declares the topology. It
+// also spawns a goroutine that listens for any "Close" events from the broker.
+func SetupRMQConnectionWithTopology(retryFunc func() error, brokerUrl string, topology *rmq.Topology) (*amqp.Connection, *amqp.Channel, error) {
+	if err := topology.Validate(); err != nil {
+		return nil, nil, err
+	}
+
 	// Establish connection with RabbitMQ
 	rmqConn, err := dialRMQ(brokerUrl)
 	if err != nil {
@@ -28,7 +44,7 @@ func SetupRMQConnection(retryFunc func() error, brokerUrl, exchangeName, exchang
 		return nil, nil, err
 	}
 
-	return rmqConn, rmqChannel, declareRealtimeExchange(rmqChannel, exchangeName, exchangeType)
+	return rmqConn, rmqChannel, topology.Declare(rmqChannel)
 }
 
 // createChannel opens channel with janus virtualhost connection.
@@ -37,24 +53,9 @@ func createChannel(rmqConn *amqp.Connection) (*amqp.Channel, error) {
 	return rmqChan, err
 }
 
-// Declare exchange `janus-realtime-notifications` to listen for realtime notification pushes from asgard
-func declareRealtimeExchange(rmqChan *amqp.Channel, exchangeName, exchangeType string) (err error) {
-	if err = rmqChan.ExchangeDeclare(
-		exchangeName, // name of the exchange
-		exchangeType, // type
-		true,         // durable
-		false,        // delete when complete
-		false,        // internal
-		false,        // noWait
-		nil,          // arguments
-	); err != nil {
-		return fmt.Errorf("Error declaring exchange: janus-realtime-notifications on vhost: janus. Error: %s", err)
-	}
-	return nil
-}
-
 // handleRabbitMQErrors looks out for any RabbitMQ errors/closure and re-establishes connection
-// and initializes the realtime consumer.
+// and initializes the realtime consumer, backing off between attempts. Use rmq.Supervisor to own the
+// connection state and be notified of its changes instead.
 func handleRabbitMQErrors(rmqConn *amqp.Connection, consumerInitFn func() error) {
 	rmqError := <-rmqConn.NotifyClose(make(chan *amqp.Error))
 	rmqCloseErr := fmt.Errorf("RabbitMQ connection closed")
@@ -67,13 +68,24 @@ func handleRabbitMQErrors(rmqConn *amqp.Connection, consumerInitFn func() error)
 	sentry.CaptureException(rmqCloseErr)
 
 	// Check if the error is a "ConnectionError" or a "ChannelError".
-	// Other error codes don't trigger retrial.
-	if !ConsumerChannelActive || rmqError != nil && isBrokerError(rmqError.Code) {
-		for {
-			if retryError := retryBrokerConnections(consumerInitFn); retryError == nil {
-				break
-			}
+	// Other error codes, and closures requested by the service, don't trigger retrial.
+	if rmqError == nil || !isBrokerError(rmqError.Code) {
+		return
+	}
+
+	retryTimeout := 0
+	for {
+		if retryError := retryBrokerConnections(consumerInitFn); retryError == nil {
+			return
+		}
+		// Wait for retrying in time intervals based on fibonacci series
+		var retryDuration time.Duration
+		retryTimeout, retryDuration = GetRetryTimeout(retryTimeout)
+		if retryDuration > maxReconnectWait {
+			retryDuration = maxReconnectWait
 		}
+		log.Printf("Retrying restoring RMQ consumers in %s", retryDuration)
+		time.Sleep(retryDuration)
 	}
 }
 
@@ -0,0 +1,260 @@
+// Package celery builds Celery task messages so that results published from Go
+// services are consumed natively by the Python Celery workers in Asgard.
+//
+// Both message protocols are supported. Protocol v1 carries everything in the
+// JSON body, which is what the hand-filled *CeleryTask types in the types
+// package mimic. Protocol v2 moves the task metadata into the AMQP headers and
+// sends the `[args, kwargs, embed]` tuple as the body.
+//
+// To publish an analysis result:
+//
+//	p := celery.NewPublisher(publisher.NewRabbitMQPublisher(ctx, opts), celery.ProtocolV2)
+//	id, err := p.Send(ctx, celery.NewTask("contrib.asgard.tasks.analysis_result", result))
+package celery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/publisher"
+	"github.com/google/uuid"
+)
+
+type Protocol int
+
+const (
+	ProtocolV1 Protocol = 1
+	ProtocolV2 Protocol = 2
+)
+
+const (
+	ContentType     = "application/json"
+	ContentEncoding = "utf-8"
+
+	// Celery publishes task messages as persistent by default.
+	deliveryModePersistent uint8 = 2
+
+	// Format of the eta and expires fields, as produced by Python's
+	// datetime.isoformat().
+	isoFormat = "2006-01-02T15:04:05.000000-07:00"
+)
+
+// Task is a Celery task invocation.
+type Task struct {
+	// Name is the registered name of the task, like
+	// "contrib.asgard.tasks.analysis_result".
+	Name string
+	// ID of the task. A random UUID is used when empty.
+	ID string
+	// Args are the positional arguments of the task.
+	Args []interface{}
+	// KWArgs are the keyword arguments of the task. Any value that marshals to
+	// a JSON object is accepted, like types.AnalysisResult.
+	KWArgs interface{}
+	// Retries is the number of times the task has been retried.
+	Retries int
+	// ETA is the earliest time the task should be executed at.
+	ETA *time.Time
+	// Expires is the time after which the task should be discarded.
+	Expires *time.Time
+	// RootID is the ID of the first task in the workflow. It defaults to ID.
+	RootID string
+	// ParentID is the ID of the task that triggered this one, if any.
+	ParentID string
+}
+
+// NewTask returns a task with the given name and keyword arguments.
+func NewTask(name string, kwargs interface{}) *Task {
+	return &Task{
+		Name:   name,
+		KWArgs: kwargs,
+	}
+}
+
+// Message is a Celery task message, ready to be published. It implements
+// publisher.AMQPPayload so that publisher.RabbitMQ sets the Celery headers
+// and properties.
+type Message struct {
+	ID      string
+	Headers map[string]interface{}
+	Body    []byte
+}
+
+func (m *Message) Bytes() ([]byte, error) {
+	return m.Body, nil
+}
+
+func (m *Message) AMQPProperties() publisher.AMQPProperties {
+	return publisher.AMQPProperties{
+		Headers:         m.Headers,
+		ContentType:     ContentType,
+		ContentEncoding: ContentEncoding,
+		CorrelationID:   m.ID,
+		DeliveryMode:    deliveryModePersistent,
+	}
+}
+
+// messageV1 is the body of a protocol v1 message.
+type messageV1 struct {
+	ID        string          `json:"id"`
+	Task      string          `json:"task"`
+	Args      []interface{}   `json:"args"`
+	KWArgs    json.RawMessage `json:"kwargs"`
+	Retries   int             `json:"retries"`
+	ETA       *string         `json:"eta"`
+	Expires   *string         `json:"expires"`
+	UTC       bool            `json:"utc"`
+	Callbacks interface{}     `json:"callbacks"`
+	Errbacks  interface{}     `json:"errbacks"`
+	Timelimit [2]interface{}  `json:"timelimit"`
+	Taskset   interface{}     `json:"taskset"`
+	Chord     interface{}     `json:"chord"`
+}
+
+// embedV2 is the third element of a protocol v2 body.
+type embedV2 struct {
+	Callbacks interface{} `json:"callbacks"`
+	Errbacks  interface{} `json:"errbacks"`
+	Chain     interface{} `json:"chain"`
+	Chord     interface{} `json:"chord"`
+}
+
+// Message builds the task message for the given protocol.
+func (t *Task) Message(protocol Protocol) (*Message, error) {
+	if t.Name == "" {
+		return nil, errors.New("celery task name is required")
+	}
+	id := t.ID
+	if id == "" {
+		id = uuid.NewString()
+	}
+	args := t.Args
+	if args == nil {
+		args = []interface{}{}
+	}
+	kwargs, err := marshalKWArgs(t.KWArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch protocol {
+	case ProtocolV1:
+		body, err := json.Marshal(messageV1{
+			ID:        id,
+			Task:      t.Name,
+			Args:      args,
+			KWArgs:    kwargs,
+			Retries:   t.Retries,
+			ETA:       formatTime(t.ETA),
+			Expires:   formatTime(t.Expires),
+			UTC:       true,
+			Timelimit: [2]interface{}{nil, nil},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &Message{ID: id, Body: body}, nil
+
+	case ProtocolV2:
+		body, err := json.Marshal([]interface{}{args, kwargs, embedV2{}})
+		if err != nil {
+			return nil, err
+		}
+		rootID := t.RootID
+		if rootID == "" {
+			rootID = id
+		}
+		return &Message{
+			ID:      id,
+			Headers: t.headersV2(id, rootID, string(kwargs)),
+			Body:    body,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported celery protocol: %d", protocol)
+	}
+}
+
+// headersV2 returns the AMQP headers of a protocol v2 message. Unset values
+// are sent as nil, the same way Celery does.
+func (t *Task) headersV2(id, rootID, kwargsRepr string) map[string]interface{} {
+	hostname, _ := os.Hostname()
+	headers := map[string]interface{}{
+		"lang":       "go",
+		"task":       t.Name,
+		"id":         id,
+		"shadow":     nil,
+		"eta":        nil,
+		"expires":    nil,
+		"group":      nil,
+		"retries":    t.Retries,
+		"timelimit":  []interface{}{nil, nil},
+		"root_id":    rootID,
+		"parent_id":  nil,
+		"argsrepr":   fmt.Sprintf("%v", t.Args),
+		"kwargsrepr": kwargsRepr,
+		"origin":     fmt.Sprintf("gen%d@%s", os.Getpid(), hostname),
+	}
+	if eta := formatTime(t.ETA); eta != nil {
+		headers["eta"] = *eta
+	}
+	if expires := formatTime(t.Expires); expires != nil {
+		headers["expires"] = *expires
+	}
+	if t.ParentID != "" {
+		headers["parent_id"] = t.ParentID
+	}
+	return headers
+}
+
+func marshalKWArgs(kwargs interface{}) (json.RawMessage, error) {
+	if kwargs == nil {
+		return json.RawMessage("{}"), nil
+	}
+	b, err := json.Marshal(kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling celery kwargs: %w", err)
+	}
+	if len(b) == 0 || b[0] != '{' {
+		return nil, fmt.Errorf("celery kwargs must marshal to a JSON object, got: %s", b)
+	}
+	return b, nil
+}
+
+func formatTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := t.UTC().Format(isoFormat)
+	return &s
+}
+
+// Publisher sends Celery tasks through a publisher.Publisher, usually a
+// publisher.RabbitMQ bound to the Celery exchange and routing key.
+type Publisher struct {
+	publisher publisher.Publisher
+	protocol  Protocol
+}
+
+func NewPublisher(p publisher.Publisher, protocol Protocol) *Publisher {
+	return &Publisher{
+		publisher: p,
+		protocol:  protocol,
+	}
+}
+
+// Send builds the task message and publishes it. It returns the task ID.
+func (p *Publisher) Send(ctx context.Context, task *Task) (string, error) {
+	message, err := task.Message(p.protocol)
+	if err != nil {
+		return "", err
+	}
+	if err := p.publisher.Publish(ctx, message); err != nil {
+		return "", err
+	}
+	return message.ID, nil
+}
@@ -0,0 +1,154 @@
+package celery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/publisher"
+	"github.com/deepcode-ai/artifacts/types"
+)
+
+type MockPublisher struct {
+	err     error
+	payload publisher.Payload
+}
+
+func (m *MockPublisher) Publish(_ context.Context, payload publisher.Payload) error {
+	m.payload = payload
+	return m.err
+}
+
+var testResult = types.AnalysisResult{
+	RunID:    "run-id",
+	CheckSeq: "1",
+	Status:   types.Status{Code: 2000},
+}
+
+func TestTask_MessageV1(t *testing.T) {
+	eta := time.Date(2023, 11, 1, 10, 30, 0, 0, time.UTC)
+	task := &Task{
+		Name:    "contrib.asgard.tasks.analysis_result",
+		ID:      "task-id",
+		KWArgs:  testResult,
+		Retries: 1,
+		ETA:     &eta,
+	}
+
+	message, err := task.Message(ProtocolV1)
+	if err != nil {
+		t.Fatalf("Task.Message() error = %v", err)
+	}
+	if message.Headers != nil {
+		t.Errorf("Task.Message() v1 headers = %v, want nil", message.Headers)
+	}
+
+	// The v1 body must stay readable as the legacy *CeleryTask types.
+	var legacy types.AnalysisResultCeleryTask
+	if err := json.Unmarshal(message.Body, &legacy); err != nil {
+		t.Fatalf("v1 body is not a valid AnalysisResultCeleryTask: %v", err)
+	}
+	want := types.AnalysisResultCeleryTask{
+		ID:      "task-id",
+		Task:    "contrib.asgard.tasks.analysis_result",
+		KWArgs:  testResult,
+		Retries: 1,
+	}
+	if !reflect.DeepEqual(legacy, want) {
+		t.Errorf("Task.Message() v1 body = %+v, want %+v", legacy, want)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(message.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["eta"] != "2023-11-01T10:30:00.000000+00:00" {
+		t.Errorf("Task.Message() v1 eta = %v", body["eta"])
+	}
+}
+
+func TestTask_MessageV2(t *testing.T) {
+	task := NewTask("contrib.asgard.tasks.analysis_result", testResult)
+
+	message, err := task.Message(ProtocolV2)
+	if err != nil {
+		t.Fatalf("Task.Message() error = %v", err)
+	}
+	if message.ID == "" {
+		t.Fatal("Task.Message() did not generate a task ID")
+	}
+
+	headers := message.Headers
+	if headers["task"] != task.Name {
+		t.Errorf("header task = %v, want %v", headers["task"], task.Name)
+	}
+	if headers["id"] != message.ID || headers["root_id"] != message.ID {
+		t.Errorf("header id = %v, root_id = %v, want %v", headers["id"], headers["root_id"], message.ID)
+	}
+	if headers["retries"] != 0 {
+		t.Errorf("header retries = %v, want 0", headers["retries"])
+	}
+	if headers["eta"] != nil || headers["parent_id"] != nil {
+		t.Errorf("header eta = %v, parent_id = %v, want nil", headers["eta"], headers["parent_id"])
+	}
+
+	var body []json.RawMessage
+	if err := json.Unmarshal(message.Body, &body); err != nil || len(body) != 3 {
+		t.Fatalf("v2 body is not an [args, kwargs, embed] tuple: %s", message.Body)
+	}
+	if string(body[0]) != "[]" {
+		t.Errorf("v2 args = %s, want []", body[0])
+	}
+	var kwargs types.AnalysisResult
+	if err := json.Unmarshal(body[1], &kwargs); err != nil || !reflect.DeepEqual(kwargs, testResult) {
+		t.Errorf("v2 kwargs = %s, want %+v", body[1], testResult)
+	}
+
+	props := message.AMQPProperties()
+	if props.CorrelationID != message.ID || props.ContentType != ContentType || props.ContentEncoding != ContentEncoding {
+		t.Errorf("Message.AMQPProperties() = %+v", props)
+	}
+}
+
+func TestTask_MessageErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		task     *Task
+		protocol Protocol
+	}{
+		{name: "missing name", task: &Task{}, protocol: ProtocolV2},
+		{name: "kwargs not an object", task: NewTask("task", []string{"a"}), protocol: ProtocolV2},
+		{name: "unknown protocol", task: NewTask("task", nil), protocol: Protocol(3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.task.Message(tt.protocol); err == nil {
+				t.Error("Task.Message() expected error")
+			}
+		})
+	}
+}
+
+func TestPublisher_Send(t *testing.T) {
+	mock := &MockPublisher{}
+	p := NewPublisher(mock, ProtocolV2)
+
+	id, err := p.Send(context.Background(), &Task{Name: "task", ID: "task-id"})
+	if err != nil {
+		t.Fatalf("Publisher.Send() error = %v", err)
+	}
+	if id != "task-id" {
+		t.Errorf("Publisher.Send() id = %v, want task-id", id)
+	}
+	if _, ok := mock.payload.(publisher.AMQPPayload); !ok {
+		t.Errorf("Publisher.Send() published %T, want a publisher.AMQPPayload", mock.payload)
+	}
+
+	mock.err = errors.New("test-error")
+	if _, err := p.Send(context.Background(), &Task{Name: "task"}); err == nil {
+		t.Error("Publisher.Send() expected error")
+	}
+}
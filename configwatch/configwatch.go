@@ -0,0 +1,199 @@
+// Package configwatch reloads a config file when it changes, without
+// restarting the service:
+//
+//	w, err := configwatch.New(&configwatch.Opts[*rmq.Topology]{
+//		Path:  "/etc/janus/topology.yaml",
+//		Parse: parseTopology,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	w.Subscribe(func(t *rmq.Topology) {
+//		...
+//	})
+//	go w.Run(ctx)
+//
+// The directory of the file is watched rather than the file itself, so that
+// updates made by renaming a new file over it, like editors and Kubernetes
+// ConfigMap symlink swaps do, are picked up too.
+package configwatch
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/getsentry/sentry-go"
+)
+
+// DefaultDebounce is how long the watcher waits for the events to settle
+// before reloading.
+const DefaultDebounce = 500 * time.Millisecond
+
+type Opts[T any] struct {
+	// Path of the config file.
+	Path string
+	// Parse parses the content of the config file.
+	Parse func(data []byte) (T, error)
+	// Debounce is how long to wait for the events to settle before
+	// reloading, so that a file written in several steps is reloaded once.
+	// Defaults to DefaultDebounce.
+	Debounce time.Duration
+	// OnError is called when the config cannot be reloaded. The previous
+	// config is kept. Defaults to logging the error and sending it to
+	// sentry.
+	OnError func(error)
+}
+
+// ReloadError is passed to OnError when the changed config cannot be read or
+// parsed.
+type ReloadError struct {
+	Path string
+	Err  error
+}
+
+func (e *ReloadError) Error() string {
+	return fmt.Sprintf("error reloading config %s: %v", e.Path, e.Err)
+}
+
+func (e *ReloadError) Unwrap() error {
+	return e.Err
+}
+
+// Watcher holds the current config and passes every new one to its
+// subscribers.
+type Watcher[T any] struct {
+	opts Opts[T]
+
+	mu          sync.Mutex
+	current     T
+	sum         [sha256.Size]byte
+	subscribers []func(T)
+}
+
+// New reads and parses the config, failing if it cannot.
+func New[T any](opts *Opts[T]) (*Watcher[T], error) {
+	w := &Watcher[T]{opts: *opts}
+	if w.opts.Debounce == 0 {
+		w.opts.Debounce = DefaultDebounce
+	}
+	if w.opts.OnError == nil {
+		w.opts.OnError = func(err error) {
+			log.Println(err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	data, err := os.ReadFile(w.opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %s: %w", w.opts.Path, err)
+	}
+	if w.current, err = w.opts.Parse(data); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %w", w.opts.Path, err)
+	}
+	w.sum = sha256.Sum256(data)
+	return w, nil
+}
+
+// Current returns the current config.
+func (w *Watcher[T]) Current() T {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Subscribe registers fn to be called with every new config. The
+// subscribers are called one after the other, from the goroutine running
+// Run.
+func (w *Watcher[T]) Subscribe(fn func(T)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers = append(w.subscribers, fn)
+}
+
+// Run watches the config until ctx is done.
+func (w *Watcher[T]) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(w.opts.Path)); err != nil {
+		return fmt.Errorf("error watching config %s: %w", w.opts.Path, err)
+	}
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			// Any change in the directory may be a symlink swap, so every
+			// event is considered, and the content tells whether the
+			// config changed.
+			timer.Reset(w.opts.Debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Println("Config watcher error:", err)
+		case <-timer.C:
+			w.reload()
+		}
+	}
+}
+
+// reload reads the config and passes it to the subscribers if it changed.
+func (w *Watcher[T]) reload() {
+	data, err := os.ReadFile(w.opts.Path)
+	if err != nil {
+		// The file is missing for a moment while it is being replaced, the
+		// event creating it triggers another reload.
+		if !os.IsNotExist(err) {
+			w.opts.OnError(&ReloadError{Path: w.opts.Path, Err: err})
+		}
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	w.mu.Lock()
+	unchanged := sum == w.sum
+	w.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	config, err := w.opts.Parse(data)
+	if err != nil {
+		w.opts.OnError(&ReloadError{Path: w.opts.Path, Err: err})
+		return
+	}
+
+	w.mu.Lock()
+	w.current, w.sum = config, sum
+	subscribers := append([]func(T){}, w.subscribers...)
+	w.mu.Unlock()
+
+	log.Println("Reloaded config:", w.opts.Path)
+	for _, fn := range subscribers {
+		fn(config)
+	}
+}
@@ -0,0 +1,151 @@
+package configwatch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Value string
+}
+
+func parse(data []byte) (testConfig, error) {
+	value := strings.TrimSpace(string(data))
+	if value == "invalid" {
+		return testConfig{}, errors.New("invalid config")
+	}
+	return testConfig{Value: value}, nil
+}
+
+// startWatcher runs a watcher of path and returns the channels receiving the
+// new configs and the reload errors.
+func startWatcher(t *testing.T, path string) (*Watcher[testConfig], <-chan testConfig, <-chan error) {
+	configs := make(chan testConfig, 10)
+	errs := make(chan error, 10)
+	w, err := New(&Opts[testConfig]{
+		Path:     path,
+		Parse:    parse,
+		Debounce: 50 * time.Millisecond,
+		OnError:  func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	w.Subscribe(func(c testConfig) { configs <- c })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watcher.Run() error = %v", err)
+		}
+	})
+	// Let Run start watching.
+	time.Sleep(50 * time.Millisecond)
+	return w, configs, errs
+}
+
+func waitConfig(t *testing.T, configs <-chan testConfig, want string) {
+	t.Helper()
+	select {
+	case c := <-configs:
+		if c.Value != want {
+			t.Errorf("got config %q, want %q", c.Value, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for config %q", want)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcher_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	writeFile(t, path, "first")
+	w, configs, errs := startWatcher(t, path)
+	if got := w.Current().Value; got != "first" {
+		t.Fatalf("Watcher.Current() = %q, want %q", got, "first")
+	}
+
+	// Keeps watching after a reload, and debounces writes in a row.
+	writeFile(t, path, "second")
+	waitConfig(t, configs, "second")
+	for _, content := range []string{"a", "b", "third"} {
+		writeFile(t, path, content)
+	}
+	waitConfig(t, configs, "third")
+	select {
+	case c := <-configs:
+		t.Errorf("got config %q, want the writes debounced", c.Value)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// An invalid config is reported and the previous one is kept.
+	writeFile(t, path, "invalid")
+	select {
+	case err := <-errs:
+		var reloadErr *ReloadError
+		if !errors.As(err, &reloadErr) || reloadErr.Path != path {
+			t.Errorf("got error %v, want a *ReloadError", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the reload error")
+	}
+	if got := w.Current().Value; got != "third" {
+		t.Errorf("Watcher.Current() = %q, want %q", got, "third")
+	}
+}
+
+func TestWatcher_Rename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	writeFile(t, path, "first")
+	_, configs, _ := startWatcher(t, path)
+
+	tmp := filepath.Join(dir, "config.tmp")
+	writeFile(t, tmp, "second")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, configs, "second")
+}
+
+// TestWatcher_SymlinkSwap updates the config the way the kubelet updates a
+// mounted ConfigMap: config -> ..data/config, with ..data a symlink swapped
+// to a new directory.
+func TestWatcher_SymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	writeVersion := func(version, content string) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, version, "config"), content)
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeVersion("..v1", "first")
+	path := filepath.Join(dir, "config")
+	if err := os.Symlink(filepath.Join("..data", "config"), path); err != nil {
+		t.Fatal(err)
+	}
+	_, configs, _ := startWatcher(t, path)
+
+	writeVersion("..v2", "second")
+	waitConfig(t, configs, "second")
+}
@@ -1,77 +1,449 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/deepcode-ai/artifacts/rmq"
 	"github.com/getsentry/sentry-go"
-	"github.com/spf13/viper"
-	"github.com/streadway/amqp"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-// Single function for all the consumer related operations
-func Consume(rmqConn *amqp.Connection, queueName, routingKey string, block chan error, processMessage func(amqp.Delivery) error) {
-	rmqChannel, err := rmqConn.Channel()
-	if err != nil {
+const (
+	DefaultDrainTimeout = 30 * time.Second
+)
+
+// ErrDrainTimeout is returned when the in-flight deliveries could not be
+// processed within DrainTimeout on shutdown.
+var ErrDrainTimeout = errors.New("timed out draining in-flight deliveries")
+
+// ErrNotSetUp is returned by Run when Setup has not succeeded beforehand.
+var ErrNotSetUp = errors.New("consumer is not set up")
+
+// errDeliveriesClosed is returned by run when the broker closes the
+// deliveries channel, i.e. when the channel or the connection is gone.
+var errDeliveriesClosed = errors.New("deliveries channel closed")
+
+// amqpChannel is the subset of *amqp.Channel used while processing
+// deliveries.
+type amqpChannel interface {
+	Cancel(consumer string, noWait bool) error
+	Close() error
+}
+
+// ConsumerOptions describe the queue to consume from, how it is bound and how
+// its deliveries are processed. The mapstructure tags make them loadable with
+// viper, see the viperconsumer package.
+type ConsumerOptions struct {
+	// Exchange the queue is bound to. When empty, the queue is not bound and
+	// only receives the messages published to it through the default
+	// exchange.
+	Exchange string `mapstructure:"exchange"`
+	// Queue is the name of the queue to consume from.
+	Queue string `mapstructure:"queue"`
+	// RoutingKeys the queue is bound to the exchange with.
+	RoutingKeys []string `mapstructure:"routing_keys"`
+	// QueueArgs are the arguments the queue is declared with, like
+	// "x-queue-type".
+	QueueArgs amqp.Table `mapstructure:"queue_args"`
+	// Transient queues do not survive broker restarts. Queues are durable
+	// unless set.
+	Transient bool `mapstructure:"transient"`
+	// AutoDelete queues are deleted once their last consumer is cancelled.
+	AutoDelete bool `mapstructure:"auto_delete"`
+	// Exclusive queues are only accessible by the connection that declares
+	// them and are deleted when it closes.
+	Exclusive bool `mapstructure:"exclusive"`
+	// ExclusiveConsumer makes this consumer the only one allowed on the
+	// queue.
+	ExclusiveConsumer bool `mapstructure:"exclusive_consumer"`
+	// ConsumerTag identifies the consumer on the channel. A unique tag
+	// derived from the queue name is used when empty.
+	ConsumerTag string `mapstructure:"consumer_tag"`
+
+	// MaxAttempts is the number of times a delivery is processed before it is
+	// parked. Zero disables delayed retries: retryable deliveries are
+	// requeued straight away. See declareRetryTopology.
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// RetryDelay is the delay before the first retry. It doubles with every
+	// further attempt. Defaults to DefaultRetryDelay. Every delay has its own
+	// retry queue, see RetryQueueName.
+	RetryDelay time.Duration `mapstructure:"retry_delay"`
+	// MaxRetryDelay caps the delay between two attempts. Defaults to
+	// DefaultMaxRetryDelay.
+	MaxRetryDelay time.Duration `mapstructure:"max_retry_delay"`
+
+	// Prefetch is the number of unacknowledged deliveries the broker sends
+	// to the consumer. Zero leaves it unlimited.
+	Prefetch int `mapstructure:"prefetch"`
+	// Workers is the number of deliveries processed concurrently. Defaults
+	// to 1.
+	Workers int `mapstructure:"workers"`
+	// OrderingKey, when set, makes deliveries sharing the same key be
+	// processed one at a time, in the order they were received, while
+	// deliveries with different keys are processed in parallel. See RunIDKey.
+	OrderingKey func(amqp.Delivery) string `mapstructure:"-"`
+
+	// DrainTimeout is how long in-flight deliveries are given to complete on
+	// shutdown. Defaults to DefaultDrainTimeout.
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+
+	// ReconnectDelay is the delay before the first reconnection attempt. It
+	// doubles with every failed attempt. Defaults to DefaultReconnectDelay.
+	ReconnectDelay time.Duration `mapstructure:"reconnect_delay"`
+	// MaxReconnectDelay caps the delay between two reconnection attempts.
+	// Defaults to DefaultMaxReconnectDelay.
+	MaxReconnectDelay time.Duration `mapstructure:"max_reconnect_delay"`
+	// OnEvent is called on every lifecycle event of the consumer. It is
+	// called synchronously and must not block.
+	OnEvent func(Event) `mapstructure:"-"`
+}
+
+type Consumer struct {
+	conn connection
+	opts ConsumerOptions
+
+	// session is the channel set up by Setup and consumed by Run.
+	session *session
+
+	mu     sync.Mutex
+	status Status
+}
+
+// session is a channel the consumer is registered on, along with its
+// deliveries and close notifications.
+type session struct {
+	channel  channel
+	messages <-chan amqp.Delivery
+	closed   <-chan *amqp.Error
+}
+
+const (
+	StageChannel       = "channel"
+	StageQos           = "qos"
+	StageRetryTopology = "retry_topology"
+	StageQueueDeclare  = "queue_declare"
+	StageQueueBind     = "queue_bind"
+	StageConsume       = "consume"
+)
+
+// SetupError is returned when setting up the consumer fails. Stage is the
+// step that failed, one of the Stage constants.
+type SetupError struct {
+	Stage string
+	Err   error
+}
+
+func (e *SetupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// NewConsumer returns a consumer on the connection, which can be shared with
+// other consumers and publishers.
+func NewConsumer(rmqConn *rmq.Conn, opts *ConsumerOptions) *Consumer {
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = DefaultRetryDelay
+	}
+	if opts.MaxRetryDelay == 0 {
+		opts.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.DrainTimeout == 0 {
+		opts.DrainTimeout = DefaultDrainTimeout
+	}
+	if opts.ConsumerTag == "" {
+		opts.ConsumerTag = newConsumerTag(opts.Queue)
+	}
+	if opts.ReconnectDelay == 0 {
+		opts.ReconnectDelay = DefaultReconnectDelay
+	}
+	if opts.MaxReconnectDelay == 0 {
+		opts.MaxReconnectDelay = DefaultMaxReconnectDelay
+	}
+
+	return &Consumer{
+		conn:   rmqConnection{rmqConn},
+		opts:   *opts,
+		status: Status{Queue: opts.Queue, Since: time.Now()},
+	}
+}
+
+// Consume declares and binds the queue, along with its retry topology when
+// MaxAttempts is set, and processes the deliveries until block receives. The
+// in-flight deliveries are then drained, see Run.
+// Deliveries are acknowledged manually once processMessage returns: they are
+// acked on success and otherwise requeued or rejected depending on the
+// error, see ActionFor.
+func (c *Consumer) Consume(block chan error, processMessage func(amqp.Delivery) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-block:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if _, err := c.ConsumeContext(ctx, processMessage); err != nil {
+		log.Println(err)
 		sentry.CaptureException(err)
-		block <- fmt.Errorf("error opening channel: %s", err)
 	}
+}
 
-	defer rmqChannel.Close()
+// ConsumeContext sets the consumer up and runs it until ctx is done, see
+// Setup and Run.
+func (c *Consumer) ConsumeContext(ctx context.Context, processMessage func(amqp.Delivery) error) (int, error) {
+	if err := c.Setup(); err != nil {
+		return 0, err
+	}
+	return c.Run(ctx, processMessage)
+}
 
-	// Declare analysis run queue
-	queueDeclare, err := rmqChannel.QueueDeclare(
-		queueName, // Queue name
-		true,      // Durable
-		false,     // Delete when used
-		false,     // Exclusive
-		false,     // No wait
-		nil,       // Arguments
-	)
+// Setup opens a channel, declares and binds the queue, along with its retry
+// topology when MaxAttempts is set, and registers the consumer. Deliveries
+// are only processed once Run is called. On failure, the channel is closed
+// and a *SetupError is returned.
+func (c *Consumer) Setup() error {
+	s, err := c.setup()
 	if err != nil {
-		sentry.CaptureException(err)
-		block <- fmt.Errorf("error declaring queue: %s %s", queueName, err)
+		return err
+	}
+	c.session = s
+	return nil
+}
+
+// Run processes the deliveries of the consumer set up by Setup until ctx is
+// done. It returns ErrNotSetUp if Setup has not succeeded.
+//
+// Once consuming, the consumer recovers by itself from the closure of its
+// channel or of its connection: it reopens the channel and redeclares the
+// topology, backing off between attempts, until ctx is done or the
+// connection is closed for good.
+//
+// On cancellation, the consumer is cancelled so that the broker stops sending
+// deliveries, and the deliveries already received are processed for up to
+// DrainTimeout. The channel is then closed; deliveries that were not settled
+// by then are redelivered by the broker. It returns the number of deliveries
+// processed after cancellation, along with ErrDrainTimeout if the drain did
+// not complete in time.
+func (c *Consumer) Run(ctx context.Context, processMessage func(amqp.Delivery) error) (int, error) {
+	s := c.session
+	if s == nil {
+		return 0, ErrNotSetUp
 	}
+	c.session = nil
 
-	// Bind analysis run queue to atlas-jobs exchange
-	err = rmqChannel.QueueBind(
-		queueName,                           // Queue name
-		routingKey,                          // Routing key
-		viper.GetString("app.rmq.exchange"), // Exchange name
-		false,                               // No wait
-		nil,                                 // Arguments
-	)
+	for {
+		log.Printf("Consumers initialized for queue: %s with %d workers", c.opts.Queue, c.opts.Workers)
+		c.emit(Event{Type: EventConsuming})
+
+		drained, err := c.run(ctx, s.channel, c.opts.ConsumerTag, s.messages, processMessage)
+		if !errors.Is(err, errDeliveriesClosed) {
+			c.emit(Event{Type: EventStopped, Err: err})
+			return drained, err
+		}
+
+		c.emit(c.closedEvent(s.closed))
+		if s, err = c.reconnect(ctx); err != nil {
+			c.emit(Event{Type: EventStopped, Err: err})
+			return 0, err
+		}
+	}
+}
+
+// setup opens a channel, declares the topology and registers the consumer.
+func (c *Consumer) setup() (*session, error) {
+	queueName := c.opts.Queue
+
+	rmqChannel, err := c.conn.Channel()
 	if err != nil {
-		sentry.CaptureException(err)
-		block <- fmt.Errorf("error binding queue: %s %s", queueName, err)
+		return nil, &SetupError{Stage: StageChannel, Err: fmt.Errorf("error opening channel: %w", err)}
+	}
+	closed := rmqChannel.NotifyClose(make(chan *amqp.Error, 1))
+
+	fail := func(stage string, err error) (*session, error) {
+		rmqChannel.Close()
+		return nil, &SetupError{Stage: stage, Err: err}
+	}
+
+	if c.opts.Prefetch > 0 {
+		if err = rmqChannel.Qos(c.opts.Prefetch, 0, false); err != nil {
+			return fail(StageQos, fmt.Errorf("error setting prefetch count for queue: %s %w", queueName, err))
+		}
+	}
+
+	queueArgs := amqp.Table{}
+	for k, v := range c.opts.QueueArgs {
+		queueArgs[k] = v
+	}
+	if c.retryEnabled() {
+		retryArgs, err := declareRetryTopology(rmqChannel, &c.opts)
+		if err != nil {
+			return fail(StageRetryTopology, fmt.Errorf("error declaring retry topology for queue: %s %w", queueName, err))
+		}
+		for k, v := range retryArgs {
+			queueArgs[k] = v
+		}
+	}
+
+	queue := rmq.Queue{
+		Name:       queueName,
+		Durable:    !c.opts.Transient,
+		AutoDelete: c.opts.AutoDelete,
+		Exclusive:  c.opts.Exclusive,
+		Args:       queueArgs,
+	}
+	queueDeclare, err := queue.Declare(rmqChannel)
+	if err != nil {
+		return fail(StageQueueDeclare, err)
+	}
+
+	if c.opts.Exchange != "" {
+		for _, routingKey := range c.opts.RoutingKeys {
+			binding := rmq.Binding{
+				Queue:      queueDeclare.Name,
+				Exchange:   c.opts.Exchange,
+				RoutingKey: routingKey,
+			}
+			if err := binding.Declare(rmqChannel); err != nil {
+				return fail(StageQueueBind, err)
+			}
+		}
 	}
 
-	// Listen for messages to consume from analysis-run queue
 	messages, err := rmqChannel.Consume(
-		queueDeclare.Name, // Queue name
-		"",                // Consumer
-		true,              // Auto ackowledge
-		false,             // Exclusive
-		false,             // No local
-		false,             // No wait
-		nil,               // Arguments
+		queueDeclare.Name,        // Queue name
+		c.opts.ConsumerTag,       // Consumer
+		false,                    // Auto ackowledge
+		c.opts.ExclusiveConsumer, // Exclusive
+		false,                    // No local
+		false,                    // No wait
+		nil,                      // Arguments
 	)
 	if err != nil {
-		sentry.CaptureException(err)
-		block <- fmt.Errorf("error registering consumer for queue: %s %s", queueName, err)
+		return fail(StageConsume, fmt.Errorf("error registering consumer for queue: %s %w", queueName, err))
 	}
 
+	return &session{channel: rmqChannel, messages: messages, closed: closed}, nil
+}
+
+// run processes the deliveries until ctx is done and then drains the
+// consumer.
+func (c *Consumer) run(ctx context.Context, rmqChannel amqpChannel, consumerTag string, messages <-chan amqp.Delivery, processMessage func(amqp.Delivery) error) (int, error) {
+	var (
+		draining int32
+		drained  int64
+		done     = make(chan struct{})
+	)
 	go func() {
-		for message := range messages {
-			if err := processMessage(message); err != nil {
-				log.Println(err)
-				sentry.CaptureException(err)
-				continue
+		defer close(done)
+		c.process(c.conn, messages, func(message amqp.Delivery) error {
+			err := processMessage(message)
+			if atomic.LoadInt32(&draining) == 1 {
+				atomic.AddInt64(&drained, 1)
 			}
-		}
+			return err
+		})
 	}()
 
-	log.Printf("Consumers initialized for queue: %s", queueName)
+	select {
+	case <-done:
+		// The broker closed the deliveries channel: the channel or the
+		// connection is gone.
+		rmqChannel.Close()
+		return 0, fmt.Errorf("%w for queue: %s", errDeliveriesClosed, c.opts.Queue)
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	log.Printf("Draining consumer for queue: %s", c.opts.Queue)
+
+	// Stop the broker from sending new deliveries. The deliveries channel is
+	// closed once the ones already sent have been received.
+	if err := rmqChannel.Cancel(consumerTag, false); err != nil {
+		log.Printf("error cancelling consumer for queue: %s %s", c.opts.Queue, err)
+	}
+
+	var err error
+	timer := time.NewTimer(c.opts.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		err = ErrDrainTimeout
+	}
+
+	if closeErr := rmqChannel.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("error closing channel for queue: %s %s", c.opts.Queue, closeErr)
+	}
+
+	count := int(atomic.LoadInt64(&drained))
+	log.Printf("Drained %d deliveries from queue: %s", count, c.opts.Queue)
+	return count, err
+}
 
-	<-block
+func newConsumerTag(queueName string) string {
+	return fmt.Sprintf("%s-%s", queueName, uuid.NewString())
+}
+
+func (c *Consumer) retryEnabled() bool {
+	return c.opts.MaxAttempts > 0
+}
+
+// settle acknowledges, retries or rejects the delivery depending on the error
+// returned while processing it. With delayed retries enabled, a retryable
+// delivery is moved to the retry queue of its attempt, or parked once it has
+// used up MaxAttempts. If the retry cannot be scheduled, the delivery is
+// requeued.
+func (c *Consumer) settle(publisher amqpPublisher, message amqp.Delivery, processErr error) error {
+	if !c.retryEnabled() || ActionFor(processErr) != Requeue {
+		return settle(message, processErr)
+	}
+
+	attempt := Attempts(message, c.opts.Queue) + 1
+	if attempt >= c.opts.MaxAttempts {
+		log.Printf("Parking delivery %d from queue %s after %d attempts", message.DeliveryTag, c.opts.Queue, attempt)
+		return settle(message, Poison(processErr))
+	}
+
+	if err := scheduleRetry(publisher, message, &c.opts, attempt); err != nil {
+		// Fall back to an immediate requeue rather than losing the delivery.
+		log.Println(err)
+		sentry.CaptureException(err)
+		return settle(message, processErr)
+	}
+	return settle(message, nil)
+}
+
+// settle acknowledges, requeues or rejects the delivery depending on the
+// error returned while processing it.
+func settle(message amqp.Delivery, processErr error) error {
+	action := ActionFor(processErr)
+
+	var err error
+	switch action {
+	case Ack:
+		err = message.Ack(false)
+	case Requeue:
+		err = message.Nack(false, true)
+	default:
+		err = message.Reject(false)
+	}
+	if err != nil {
+		return fmt.Errorf("error settling delivery %d (%s): %s", message.DeliveryTag, action, err)
+	}
+	return nil
 }
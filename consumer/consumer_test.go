@@ -0,0 +1,283 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MockAcknowledger records how a delivery was settled.
+type MockAcknowledger struct {
+	err     error
+	action  string
+	requeue bool
+}
+
+func (a *MockAcknowledger) Ack(_ uint64, _ bool) error {
+	a.action = "ack"
+	return a.err
+}
+
+func (a *MockAcknowledger) Nack(_ uint64, _, requeue bool) error {
+	a.action = "nack"
+	a.requeue = requeue
+	return a.err
+}
+
+func (a *MockAcknowledger) Reject(_ uint64, requeue bool) error {
+	a.action = "reject"
+	a.requeue = requeue
+	return a.err
+}
+
+func TestActionFor(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Action
+	}{
+		{name: "success", err: nil, want: Ack},
+		{name: "plain error", err: errors.New("test-error"), want: DefaultErrorAction},
+		{name: "retryable", err: Retryable(errors.New("test-error")), want: Requeue},
+		{name: "poison", err: Poison(errors.New("test-error")), want: Reject},
+		{name: "wrapped retryable", err: fmt.Errorf("processing: %w", Retryable(errors.New("test-error"))), want: Requeue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ActionFor(tt.err); got != tt.want {
+				t.Errorf("ActionFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name        string
+		processErr  error
+		ackErr      error
+		wantAction  string
+		wantRequeue bool
+		wantErr     bool
+	}{
+		{name: "ack on success", wantAction: "ack"},
+		{name: "requeue retryable errors", processErr: Retryable(errors.New("test-error")), wantAction: "nack", wantRequeue: true},
+		{name: "reject poison messages", processErr: Poison(errors.New("test-error")), wantAction: "reject"},
+		{name: "reject plain errors", processErr: errors.New("test-error"), wantAction: "reject"},
+		{name: "ack error", ackErr: errors.New("channel closed"), wantAction: "ack", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acknowledger := &MockAcknowledger{err: tt.ackErr}
+			message := amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1}
+
+			if err := settle(message, tt.processErr); (err != nil) != tt.wantErr {
+				t.Fatalf("settle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if acknowledger.action != tt.wantAction || acknowledger.requeue != tt.wantRequeue {
+				t.Errorf("settle() = %s (requeue %v), want %s (requeue %v)",
+					acknowledger.action, acknowledger.requeue, tt.wantAction, tt.wantRequeue)
+			}
+		})
+	}
+}
+
+// MockDeliveryChannel stands in for the channel deliveries are consumed from.
+// Like the broker, cancelling the consumer closes the deliveries channel once
+// the deliveries already sent have been received.
+type MockDeliveryChannel struct {
+	MockChannel
+	messages  chan amqp.Delivery
+	cancelled string
+	closed    bool
+	onCancel  chan struct{}
+}
+
+func (c *MockDeliveryChannel) Cancel(consumer string, _ bool) error {
+	c.cancelled = consumer
+	close(c.messages)
+	if c.onCancel != nil {
+		close(c.onCancel)
+	}
+	return nil
+}
+
+func (c *MockDeliveryChannel) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestConsumer_Run(t *testing.T) {
+	tests := []struct {
+		name         string
+		drainTimeout time.Duration
+		release      bool
+		wantDrained  int
+		wantErr      error
+	}{
+		{name: "drains in-flight and buffered deliveries", drainTimeout: time.Second, release: true, wantDrained: 3},
+		{name: "drain timeout", drainTimeout: 10 * time.Millisecond, wantErr: ErrDrainTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acknowledger := &MockBatchAcknowledger{}
+			ch := &MockDeliveryChannel{messages: make(chan amqp.Delivery, 3), onCancel: make(chan struct{})}
+			for i := 0; i < 3; i++ {
+				ch.messages <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: uint64(i)}
+			}
+
+			started := make(chan struct{}, 3)
+			release := make(chan struct{})
+			defer close(release)
+			processMessage := func(amqp.Delivery) error {
+				started <- struct{}{}
+				<-release
+				return nil
+			}
+
+			c := NewConsumer(nil, &ConsumerOptions{Queue: "analysis-run", DrainTimeout: tt.drainTimeout})
+			ctx, cancel := context.WithCancel(context.Background())
+			type result struct {
+				drained int
+				err     error
+			}
+			results := make(chan result)
+			go func() {
+				drained, err := c.run(ctx, ch, "ctag", ch.messages, processMessage)
+				results <- result{drained, err}
+			}()
+
+			<-started
+			cancel()
+			<-ch.onCancel
+			if tt.release {
+				for i := 0; i < 3; i++ {
+					release <- struct{}{}
+				}
+			}
+
+			r := <-results
+			if !errors.Is(r.err, tt.wantErr) {
+				t.Fatalf("Consumer.run() error = %v, want %v", r.err, tt.wantErr)
+			}
+			if r.drained != tt.wantDrained {
+				t.Errorf("Consumer.run() drained = %d, want %d", r.drained, tt.wantDrained)
+			}
+			if ch.cancelled != "ctag" || !ch.closed {
+				t.Errorf("Consumer.run() cancelled = %q, closed = %v, want consumer cancelled and channel closed", ch.cancelled, ch.closed)
+			}
+		})
+	}
+}
+
+func TestConsumer_RunChannelClosed(t *testing.T) {
+	ch := &MockDeliveryChannel{messages: make(chan amqp.Delivery)}
+	close(ch.messages)
+
+	c := NewConsumer(nil, &ConsumerOptions{Queue: "analysis-run"})
+	if _, err := c.run(context.Background(), ch, "ctag", ch.messages, func(amqp.Delivery) error { return nil }); err == nil {
+		t.Error("Consumer.run() expected error when the deliveries channel is closed")
+	}
+	if !ch.closed {
+		t.Error("Consumer.run() did not close the channel")
+	}
+}
+
+// FailingChannel is a channel whose call for a single setup stage fails.
+// Queue declarations and bindings only fail for the consumed queue, not for
+// the retry topology.
+type FailingChannel struct {
+	*MockConsumeChannel
+	stage string
+	queue string
+}
+
+func (c *FailingChannel) fail(stage string) error {
+	if c.stage == stage {
+		return fmt.Errorf("test-error at %s", stage)
+	}
+	return nil
+}
+
+func (c *FailingChannel) Qos(_, _ int, _ bool) error {
+	return c.fail(StageQos)
+}
+
+func (c *FailingChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if err := c.fail(StageRetryTopology); err != nil {
+		return err
+	}
+	return c.MockConsumeChannel.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+}
+
+func (c *FailingChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if err := c.fail(StageQueueDeclare); err != nil && name == c.queue {
+		return amqp.Queue{}, err
+	}
+	return c.MockConsumeChannel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func (c *FailingChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	if err := c.fail(StageQueueBind); err != nil && name == c.queue {
+		return err
+	}
+	return c.MockConsumeChannel.QueueBind(name, key, exchange, noWait, args)
+}
+
+func (c *FailingChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if err := c.fail(StageConsume); err != nil {
+		return nil, err
+	}
+	return c.MockConsumeChannel.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+}
+
+func TestConsumer_Setup(t *testing.T) {
+	stages := []string{StageChannel, StageQos, StageRetryTopology, StageQueueDeclare, StageQueueBind, StageConsume, ""}
+	for _, stage := range stages {
+		name := stage
+		if name == "" {
+			name = "success"
+		}
+		t.Run(name, func(t *testing.T) {
+			ch := &FailingChannel{MockConsumeChannel: newMockConsumeChannel(), stage: stage, queue: "analysis-run"}
+			conn := &MockConnection{channels: []channel{ch}}
+			if stage == StageChannel {
+				conn.close()
+			}
+			c := NewConsumer(nil, &ConsumerOptions{
+				Exchange:    "janus",
+				Queue:       "analysis-run",
+				RoutingKeys: []string{"analysis-run"},
+				MaxAttempts: 3,
+				Prefetch:    10,
+			})
+			c.conn = conn
+
+			err := c.Setup()
+			if stage == "" {
+				if err != nil {
+					t.Fatalf("Consumer.Setup() error = %v", err)
+				}
+				if ch.closed {
+					t.Error("Consumer.Setup() closed the channel")
+				}
+				return
+			}
+
+			var setupErr *SetupError
+			if !errors.As(err, &setupErr) || setupErr.Stage != stage {
+				t.Fatalf("Consumer.Setup() error = %v, want *SetupError at stage %s", err, stage)
+			}
+			if stage != StageChannel && !ch.closed {
+				t.Error("Consumer.Setup() did not close the channel after failing")
+			}
+			if _, err := c.Run(context.Background(), func(amqp.Delivery) error { return nil }); !errors.Is(err, ErrNotSetUp) {
+				t.Errorf("Consumer.Run() error = %v, want %v", err, ErrNotSetUp)
+			}
+		})
+	}
+}
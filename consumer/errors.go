@@ -0,0 +1,79 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Action is what the consumer does with a delivery once processMessage has
+// returned.
+type Action int
+
+const (
+	// Ack acknowledges the delivery, removing it from the queue.
+	Ack Action = iota
+	// Requeue negatively acknowledges the delivery and puts it back on the
+	// queue so that it is delivered again.
+	Requeue
+	// Reject rejects the delivery without requeueing it. The broker drops it,
+	// or dead-letters it if the queue has a dead-letter exchange.
+	Reject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case Requeue:
+		return "requeue"
+	case Reject:
+		return "reject"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// DefaultErrorAction is the action taken when processMessage returns an error
+// that is not an *ActionError. Rejecting is the safe default: requeueing a
+// message that can never be processed would redeliver it forever.
+const DefaultErrorAction = Reject
+
+// ActionError is returned by processMessage to choose what happens to a
+// delivery that could not be processed.
+type ActionError struct {
+	Action Action
+	Err    error
+}
+
+func (e *ActionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ActionError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable marks err as transient: the delivery is requeued and processed
+// again.
+func Retryable(err error) error {
+	return &ActionError{Action: Requeue, Err: err}
+}
+
+// Poison marks the delivery as one that can never be processed, like a
+// message with a malformed body. The delivery is rejected.
+func Poison(err error) error {
+	return &ActionError{Action: Reject, Err: err}
+}
+
+// ActionFor returns the action to take for a delivery whose processing
+// returned err.
+func ActionFor(err error) Action {
+	if err == nil {
+		return Ack
+	}
+	var actionErr *ActionError
+	if errors.As(err, &actionErr) {
+		return actionErr.Action
+	}
+	return DefaultErrorAction
+}
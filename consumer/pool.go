@@ -0,0 +1,124 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/deepcode-ai/artifacts/trace/carriers"
+	"github.com/getsentry/sentry-go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// process hands the deliveries over to the worker pool and returns once the
+// deliveries channel is closed and every worker is done.
+func (c *Consumer) process(publisher amqpPublisher, messages <-chan amqp.Delivery, processMessage func(amqp.Delivery) error) {
+	var wg sync.WaitGroup
+	wg.Add(c.opts.Workers)
+
+	// Without an ordering key, the workers pull from the deliveries channel
+	// directly.
+	if c.opts.OrderingKey == nil {
+		for i := 0; i < c.opts.Workers; i++ {
+			go func() {
+				defer wg.Done()
+				for message := range messages {
+					c.handle(publisher, message, processMessage)
+				}
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	// With an ordering key, every key is pinned to a worker so that its
+	// deliveries are processed in order.
+	shards := make([]chan amqp.Delivery, c.opts.Workers)
+	for i := range shards {
+		shards[i] = make(chan amqp.Delivery)
+		go func(shard <-chan amqp.Delivery) {
+			defer wg.Done()
+			for message := range shard {
+				c.handle(publisher, message, processMessage)
+			}
+		}(shards[i])
+	}
+
+	for message := range messages {
+		shards[shardFor(c.opts.OrderingKey(message), len(shards))] <- message
+	}
+	for _, shard := range shards {
+		close(shard)
+	}
+	wg.Wait()
+}
+
+// handle processes a single delivery and settles it. The delivery is processed
+// in a consumer span, child of the span of the publisher if any, whose context
+// processMessage gets with Context.
+func (c *Consumer) handle(publisher amqpPublisher, message amqp.Delivery, processMessage func(amqp.Delivery) error) {
+	ctx, span := trace.Start(Context(message), "process "+c.opts.Queue, trace.SpanKindConsumer)
+	span.SetAttribute("messaging.system", "rabbitmq")
+	span.SetAttribute("messaging.source", c.opts.Queue)
+	span.SetAttribute("messaging.routing_key", message.RoutingKey)
+
+	err := processMessage(withSpanContext(ctx, message))
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		log.Println(err)
+		sentry.CaptureException(err)
+	} else {
+		c.delivered()
+	}
+	if err := c.settle(publisher, message, err); err != nil {
+		log.Println(err)
+		sentry.CaptureException(err)
+	}
+}
+
+// Context returns a context carrying the trace context propagated in the
+// headers of the delivery, for handlers to pass on to the publishers and to
+// dslog.
+func Context(message amqp.Delivery) context.Context {
+	return trace.Extract(context.Background(), carriers.AMQP(message.Headers))
+}
+
+// withSpanContext returns the delivery with the span context of ctx in a copy
+// of its headers.
+func withSpanContext(ctx context.Context, message amqp.Delivery) amqp.Delivery {
+	headers := make(amqp.Table, len(message.Headers)+1)
+	for k, v := range message.Headers {
+		headers[k] = v
+	}
+	trace.Inject(ctx, carriers.AMQP(headers))
+	message.Headers = headers
+	return message
+}
+
+func shardFor(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// RunIDKey is an OrderingKey that keys deliveries by the `run_id` field of
+// their JSON body, shared by types.AnalysisRun, types.AutofixRun and the
+// other run types. Deliveries whose body cannot be decoded share the empty
+// key.
+func RunIDKey(message amqp.Delivery) string {
+	body, err := Body(message)
+	if err != nil {
+		return ""
+	}
+	var run struct {
+		RunID string `json:"run_id"`
+	}
+	if err := json.Unmarshal(body, &run); err != nil {
+		return ""
+	}
+	return run.RunID
+}
@@ -0,0 +1,161 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/deepcode-ai/artifacts/trace/carriers"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MockBatchAcknowledger counts the deliveries settled through it.
+type MockBatchAcknowledger struct {
+	acked int32
+}
+
+func (a *MockBatchAcknowledger) Ack(_ uint64, _ bool) error {
+	atomic.AddInt32(&a.acked, 1)
+	return nil
+}
+
+func (*MockBatchAcknowledger) Nack(_ uint64, _, _ bool) error { return nil }
+
+func (*MockBatchAcknowledger) Reject(_ uint64, _ bool) error { return nil }
+
+func runDeliveries(acknowledger amqp.Acknowledger, count int, runIDs ...string) <-chan amqp.Delivery {
+	messages := make(chan amqp.Delivery, count)
+	for i := 0; i < count; i++ {
+		messages <- amqp.Delivery{
+			Acknowledger: acknowledger,
+			DeliveryTag:  uint64(i),
+			Body:         []byte(fmt.Sprintf(`{"run_id": %q}`, runIDs[i%len(runIDs)])),
+		}
+	}
+	close(messages)
+	return messages
+}
+
+func TestConsumer_ProcessConcurrently(t *testing.T) {
+	acknowledger := &MockBatchAcknowledger{}
+	c := NewConsumer(nil, &ConsumerOptions{Queue: "analysis-run", Workers: 4})
+
+	var running, maxRunning int32
+	c.process(&MockChannel{}, runDeliveries(acknowledger, 20, "a"), func(amqp.Delivery) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			prev := atomic.LoadInt32(&maxRunning)
+			if n <= prev || atomic.CompareAndSwapInt32(&maxRunning, prev, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	})
+
+	if acknowledger.acked != 20 {
+		t.Errorf("Consumer.process() acked %d deliveries, want 20", acknowledger.acked)
+	}
+	if maxRunning < 2 || maxRunning > 4 {
+		t.Errorf("Consumer.process() ran %d deliveries concurrently, want between 2 and 4", maxRunning)
+	}
+}
+
+func TestConsumer_ProcessOrderedByKey(t *testing.T) {
+	acknowledger := &MockBatchAcknowledger{}
+	c := NewConsumer(nil, &ConsumerOptions{Queue: "analysis-run", Workers: 3, OrderingKey: RunIDKey})
+
+	var (
+		mu       sync.Mutex
+		seen     = map[string][]uint64{}
+		inFlight = map[string]bool{}
+	)
+	c.process(&MockChannel{}, runDeliveries(acknowledger, 30, "a", "b", "c", "d"), func(message amqp.Delivery) error {
+		key := RunIDKey(message)
+		mu.Lock()
+		if inFlight[key] {
+			t.Errorf("deliveries of run %q processed concurrently", key)
+		}
+		inFlight[key] = true
+		seen[key] = append(seen[key], message.DeliveryTag)
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		inFlight[key] = false
+		mu.Unlock()
+		return nil
+	})
+
+	if acknowledger.acked != 30 {
+		t.Errorf("Consumer.process() acked %d deliveries, want 30", acknowledger.acked)
+	}
+	for key, tags := range seen {
+		for i := 1; i < len(tags); i++ {
+			if tags[i] < tags[i-1] {
+				t.Errorf("deliveries of run %q processed out of order: %v", key, tags)
+				break
+			}
+		}
+	}
+}
+
+func TestRunIDKey(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "analysis run", body: `{"run_id": "run-1", "run_serial": "1"}`, want: "run-1"},
+		{name: "invalid body", body: `not json`, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RunIDKey(amqp.Delivery{Body: []byte(tt.body)}); got != tt.want {
+				t.Errorf("RunIDKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsumer_HandleTraceContext(t *testing.T) {
+	exporter := &trace.InMemoryExporter{}
+	trace.SetDefault(trace.NewTracer(exporter))
+	defer trace.SetDefault(trace.NewTracer(nil))
+
+	publishCtx, publish := trace.Start(context.Background(), "publish", trace.SpanKindProducer)
+	headers := amqp.Table{"task": "analysis"}
+	trace.Inject(publishCtx, carriers.AMQP(headers))
+
+	acknowledger := &MockBatchAcknowledger{}
+	message := amqp.Delivery{Acknowledger: acknowledger, Headers: headers, Body: []byte(`{}`)}
+	c := NewConsumer(nil, &ConsumerOptions{Queue: "analysis-run"})
+
+	var got trace.SpanContext
+	errProcess := errors.New("process error")
+	c.handle(&MockChannel{}, message, func(message amqp.Delivery) error {
+		got = trace.SpanContextFromContext(Context(message))
+		return errProcess
+	})
+
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Kind != trace.SpanKindConsumer || spans[0].Err != errProcess {
+		t.Fatalf("exported spans %+v, want a failed consumer span", spans)
+	}
+	if spans[0].SpanContext.TraceID != publish.SpanContext().TraceID || spans[0].Parent.SpanID != publish.SpanContext().SpanID {
+		t.Errorf("consumer span %+v is not a child of the publisher span %+v", spans[0], publish.SpanContext())
+	}
+	if got.SpanID != spans[0].SpanContext.SpanID {
+		t.Errorf("Context() = %+v, want the consumer span %+v", got, spans[0].SpanContext)
+	}
+	if sc := trace.SpanContextFromContext(Context(message)); sc.SpanID != publish.SpanContext().SpanID || len(headers) != 2 {
+		t.Errorf("Consumer.handle() modified the delivery headers: %v", headers)
+	}
+}
@@ -0,0 +1,158 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/rmq"
+	"github.com/getsentry/sentry-go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DefaultReconnectDelay    = 1 * time.Second
+	DefaultMaxReconnectDelay = 30 * time.Second
+)
+
+// connection is the subset of *rmq.Conn used by the consumer. Retries are
+// published through it.
+type connection interface {
+	amqpPublisher
+	Channel() (channel, error)
+	IsConnected() bool
+}
+
+// channel is the subset of *amqp.Channel used by the consumer.
+type channel interface {
+	amqpChannel
+	rmq.Declarer
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+}
+
+// rmqConnection adapts *rmq.Conn to connection.
+type rmqConnection struct {
+	*rmq.Conn
+}
+
+func (c rmqConnection) Channel() (channel, error) {
+	rmqChannel, err := c.Conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return rmqChannel, nil
+}
+
+type EventType int
+
+const (
+	// EventConsuming is emitted once the consumer is registered, at startup
+	// and after every reconnection.
+	EventConsuming EventType = iota
+	// EventChannelClosed is emitted when the channel is closed while the
+	// connection is still open.
+	EventChannelClosed
+	// EventConnectionClosed is emitted when the connection is closed.
+	EventConnectionClosed
+	// EventReconnecting is emitted before every reconnection attempt.
+	EventReconnecting
+	// EventReconnectFailed is emitted when a reconnection attempt fails.
+	EventReconnectFailed
+	// EventStopped is emitted when the consumer stops for good.
+	EventStopped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConsuming:
+		return "consuming"
+	case EventChannelClosed:
+		return "channel_closed"
+	case EventConnectionClosed:
+		return "connection_closed"
+	case EventReconnecting:
+		return "reconnecting"
+	case EventReconnectFailed:
+		return "reconnect_failed"
+	case EventStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is a lifecycle event of a consumer.
+type Event struct {
+	Type  EventType
+	Queue string
+	// Attempt is the reconnection attempt, for EventReconnecting and
+	// EventReconnectFailed.
+	Attempt int
+	// Err is the reason of the event, if any.
+	Err error
+}
+
+func (c *Consumer) emit(event Event) {
+	c.track(event)
+	if c.opts.OnEvent == nil {
+		return
+	}
+	event.Queue = c.opts.Queue
+	c.opts.OnEvent(event)
+}
+
+// closedEvent returns the event describing why the deliveries stopped.
+func (c *Consumer) closedEvent(closed <-chan *amqp.Error) Event {
+	event := Event{Type: EventChannelClosed, Err: errDeliveriesClosed}
+	select {
+	case reason, ok := <-closed:
+		if ok && reason != nil {
+			event.Err = reason
+		}
+	default:
+	}
+	if !c.conn.IsConnected() {
+		event.Type = EventConnectionClosed
+	}
+
+	log.Printf("Consumer for queue: %s stopped receiving deliveries (%s): %v", c.opts.Queue, event.Type, event.Err)
+	sentry.CaptureException(event.Err)
+	return event
+}
+
+// reconnect sets the consumer up again, backing off between attempts, until
+// it succeeds, ctx is done or the connection is closed for good. The
+// connection itself is reestablished by rmq.Conn.
+func (c *Consumer) reconnect(ctx context.Context) (*session, error) {
+	delay := c.opts.ReconnectDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		c.emit(Event{Type: EventReconnecting, Attempt: attempt})
+		log.Printf("Reconnecting consumer for queue: %s, attempt %d", c.opts.Queue, attempt)
+
+		s, err := c.setup()
+		if err == nil {
+			return s, nil
+		}
+		if errors.Is(err, rmq.ErrClosed) {
+			return nil, fmt.Errorf("error reconnecting consumer for queue: %s %w", c.opts.Queue, err)
+		}
+
+		c.emit(Event{Type: EventReconnectFailed, Attempt: attempt, Err: err})
+		log.Printf("Failed to reconnect consumer for queue: %s, retrying in %s: %v", c.opts.Queue, delay, err)
+
+		if delay *= 2; delay > c.opts.MaxReconnectDelay {
+			delay = c.opts.MaxReconnectDelay
+		}
+	}
+}
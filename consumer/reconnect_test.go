@@ -0,0 +1,264 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/rmq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MockConsumeChannel is a channel the consumer can be set up on.
+type MockConsumeChannel struct {
+	MockDeliveryChannel
+	notify chan *amqp.Error
+	depth  int
+}
+
+func newMockConsumeChannel() *MockConsumeChannel {
+	return &MockConsumeChannel{MockDeliveryChannel: MockDeliveryChannel{messages: make(chan amqp.Delivery, 1)}}
+}
+
+func (c *MockConsumeChannel) Qos(_, _ int, _ bool) error {
+	return nil
+}
+
+func (c *MockConsumeChannel) Consume(_, _ string, _, _, _, _ bool, _ amqp.Table) (<-chan amqp.Delivery, error) {
+	return c.messages, c.err
+}
+
+func (c *MockConsumeChannel) QueueDeclarePassive(name string, _, _, _, _ bool, _ amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name, Messages: c.depth}, c.err
+}
+
+func (c *MockConsumeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.notify = receiver
+	return receiver
+}
+
+// closeByBroker closes the channel the way the broker does.
+func (c *MockConsumeChannel) closeByBroker(reason *amqp.Error) {
+	c.notify <- reason
+	close(c.notify)
+	close(c.messages)
+}
+
+// MockConnection hands out its channels in order. While down, it fails
+// to open channels for downFor calls and is then back up.
+type MockConnection struct {
+	mu       sync.Mutex
+	channels []channel
+	down     bool
+	downFor  int
+	shutdown bool
+}
+
+func (c *MockConnection) Channel() (channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return nil, rmq.ErrClosed
+	}
+	if c.down {
+		if c.downFor--; c.downFor <= 0 {
+			c.down = false
+		}
+		return nil, rmq.ErrNotConnected
+	}
+	if len(c.channels) == 0 {
+		return nil, errors.New("no channel left")
+	}
+	ch := c.channels[0]
+	c.channels = c.channels[1:]
+	return ch, nil
+}
+
+func (c *MockConnection) Publish(_ context.Context, _, _ string, _ amqp.Publishing) error {
+	return nil
+}
+
+func (c *MockConnection) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.down && !c.shutdown
+}
+
+// lose takes the connection down for the next downFor channels.
+func (c *MockConnection) lose(downFor int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = true
+	c.downFor = downFor
+}
+
+// close closes the connection for good.
+func (c *MockConnection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shutdown = true
+}
+
+// eventRecorder records the types of the events emitted by a consumer and
+// signals every event on a channel.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []EventType
+	ch     chan Event
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{ch: make(chan Event, 32)}
+}
+
+func (r *eventRecorder) record(event Event) {
+	r.mu.Lock()
+	r.events = append(r.events, event.Type)
+	r.mu.Unlock()
+	r.ch <- event
+}
+
+func (r *eventRecorder) waitFor(t *testing.T, eventType EventType) Event {
+	t.Helper()
+	for {
+		select {
+		case event := <-r.ch:
+			if event.Type == eventType {
+				return event
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s event", eventType)
+		}
+	}
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]EventType(nil), r.events...)
+}
+
+func newTestConsumer(conn connection, recorder *eventRecorder) *Consumer {
+	c := NewConsumer(nil, &ConsumerOptions{
+		Queue:             "analysis-run",
+		ReconnectDelay:    time.Millisecond,
+		MaxReconnectDelay: 4 * time.Millisecond,
+		OnEvent:           recorder.record,
+	})
+	c.conn = conn
+	return c
+}
+
+func TestConsumer_ReconnectsAfterChannelClosed(t *testing.T) {
+	first, second := newMockConsumeChannel(), newMockConsumeChannel()
+	conn := &MockConnection{channels: []channel{first, second}}
+	recorder := newEventRecorder()
+	c := newTestConsumer(conn, recorder)
+
+	processed := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ConsumeContext(ctx, func(amqp.Delivery) error {
+			processed <- struct{}{}
+			return nil
+		})
+		done <- err
+	}()
+
+	recorder.waitFor(t, EventConsuming)
+	reason := &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED"}
+	first.closeByBroker(reason)
+	if event := recorder.waitFor(t, EventChannelClosed); event.Err != reason {
+		t.Errorf("channel closed event error = %v, want %v", event.Err, reason)
+	}
+	recorder.waitFor(t, EventConsuming)
+
+	second.messages <- amqp.Delivery{Acknowledger: &MockAcknowledger{}}
+	select {
+	case <-processed:
+	case <-time.After(time.Second):
+		t.Fatal("delivery on the new channel was not processed")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Consumer.ConsumeContext() error = %v", err)
+	}
+	want := []EventType{EventConsuming, EventChannelClosed, EventReconnecting, EventConsuming, EventStopped}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Consumer.ConsumeContext() events = %v, want %v", got, want)
+	}
+	if second.cancelled != c.opts.ConsumerTag {
+		t.Errorf("Consumer.ConsumeContext() cancelled %q on the new channel, want %q", second.cancelled, c.opts.ConsumerTag)
+	}
+}
+
+func TestConsumer_ReconnectsAfterConnectionClosed(t *testing.T) {
+	first, second := newMockConsumeChannel(), newMockConsumeChannel()
+	conn := &MockConnection{channels: []channel{first, second}}
+	recorder := newEventRecorder()
+	c := newTestConsumer(conn, recorder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ConsumeContext(ctx, func(amqp.Delivery) error { return nil })
+		done <- err
+	}()
+
+	recorder.waitFor(t, EventConsuming)
+	conn.lose(1)
+	first.closeByBroker(amqp.ErrClosed)
+	recorder.waitFor(t, EventConnectionClosed)
+	if event := recorder.waitFor(t, EventReconnectFailed); event.Attempt != 1 || !errors.Is(event.Err, rmq.ErrNotConnected) {
+		t.Errorf("reconnect failed event = %+v, want attempt 1 failing with %v", event, rmq.ErrNotConnected)
+	}
+	recorder.waitFor(t, EventConsuming)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Consumer.ConsumeContext() error = %v", err)
+	}
+}
+
+func TestConsumer_StopsWhenConnectionClosed(t *testing.T) {
+	first := newMockConsumeChannel()
+	conn := &MockConnection{channels: []channel{first}}
+	recorder := newEventRecorder()
+	c := newTestConsumer(conn, recorder)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ConsumeContext(context.Background(), func(amqp.Delivery) error { return nil })
+		done <- err
+	}()
+
+	recorder.waitFor(t, EventConsuming)
+	conn.close()
+	first.closeByBroker(amqp.ErrClosed)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, rmq.ErrClosed) {
+			t.Errorf("Consumer.ConsumeContext() error = %v, want %v", err, rmq.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Consumer.ConsumeContext() did not stop")
+	}
+	recorder.waitFor(t, EventStopped)
+}
+
+func TestConsumer_SetupErrorNotRetried(t *testing.T) {
+	conn := &MockConnection{}
+	c := newTestConsumer(conn, newEventRecorder())
+
+	if _, err := c.ConsumeContext(context.Background(), func(amqp.Delivery) error { return nil }); err == nil {
+		t.Error("Consumer.ConsumeContext() expected error when the channel cannot be opened")
+	}
+}
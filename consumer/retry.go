@@ -0,0 +1,185 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/rmq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DefaultRetryDelay    = 5 * time.Second
+	DefaultMaxRetryDelay = 10 * time.Minute
+	RetryPublishTimeout  = 30 * time.Second // How long to wait for the broker to confirm a retry
+)
+
+// amqpPublisher publishes a message and waits for the broker to confirm it,
+// like *rmq.Conn. Retries are scheduled through it.
+type amqpPublisher interface {
+	Publish(ctx context.Context, exchange, key string, message amqp.Publishing) error
+}
+
+// RetryQueueName returns the name of the queue holding the deliveries of queue
+// waiting delay before their next attempt, e.g. `analysis-run.retry.5000ms`.
+//
+// The delay is part of the name because it is the x-message-ttl of the queue,
+// and RabbitMQ refuses to redeclare an existing queue with different
+// arguments. Changing RetryDelay, MaxRetryDelay or MaxAttempts thus declares
+// new retry queues next to the old ones instead of failing the setup. The old
+// ones still move their deliveries back to the queue and can be deleted once
+// empty.
+func RetryQueueName(queue string, delay time.Duration) string {
+	return queue + ".retry." + strconv.FormatInt(delay.Milliseconds(), 10) + "ms"
+}
+
+// DeadLetterExchangeName returns the name of the dead-letter exchange of queue.
+func DeadLetterExchangeName(queue string) string {
+	return queue + ".dlx"
+}
+
+// ParkingQueueName returns the name of the queue where the deliveries of queue
+// that could not be processed are parked for inspection.
+func ParkingQueueName(queue string) string {
+	return queue + ".parked"
+}
+
+// RetryDelay returns how long a delivery waits before the given retry attempt.
+func RetryDelay(opts *ConsumerOptions, attempt int) time.Duration {
+	delay := opts.RetryDelay
+	for i := 1; i < attempt && delay < opts.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > opts.MaxRetryDelay {
+		delay = opts.MaxRetryDelay
+	}
+	return delay
+}
+
+// declareRetryTopology declares the topology used for delayed retries, keyed
+// off the name of the consumed queue:
+//
+//   - one `<queue>.retry.<delay>ms` queue per retry delay, whose messages
+//     expire after the delay and are then dead-lettered back to the queue
+//     through the default exchange, see RetryQueueName;
+//   - a `<queue>.dlx` dead-letter exchange and a `<queue>.parked` queue bound
+//     to it, where rejected deliveries end up.
+//
+// It returns the arguments the consumed queue must be declared with to
+// dead-letter rejected deliveries to `<queue>.dlx`. A queue that already
+// exists without them has to be deleted first: RabbitMQ refuses to redeclare
+// a queue with different arguments.
+func declareRetryTopology(rmqChannel rmq.Declarer, opts *ConsumerOptions) (amqp.Table, error) {
+	if err := retryTopology(opts).Declare(rmqChannel); err != nil {
+		return nil, err
+	}
+
+	queue := opts.Queue
+	return amqp.Table{
+		"x-dead-letter-exchange":    DeadLetterExchangeName(queue),
+		"x-dead-letter-routing-key": queue,
+	}, nil
+}
+
+// retryTopology returns the topology declared by declareRetryTopology.
+func retryTopology(opts *ConsumerOptions) *rmq.Topology {
+	queue := opts.Queue
+	dlx := DeadLetterExchangeName(queue)
+	parked := ParkingQueueName(queue)
+
+	topology := &rmq.Topology{
+		Exchanges: []rmq.Exchange{{Name: dlx, Kind: "direct", Durable: true}},
+		Queues:    []rmq.Queue{{Name: parked, Durable: true}},
+		Bindings:  []rmq.Binding{{Queue: parked, Exchange: dlx, RoutingKey: queue}},
+	}
+	// Once the delay is capped by MaxRetryDelay, the last attempts share a
+	// retry queue.
+	declared := map[string]bool{}
+	for attempt := 1; attempt < opts.MaxAttempts; attempt++ {
+		delay := RetryDelay(opts, attempt)
+		name := RetryQueueName(queue, delay)
+		if declared[name] {
+			continue
+		}
+		declared[name] = true
+		topology.Queues = append(topology.Queues, rmq.Queue{
+			Name:    name,
+			Durable: true,
+			Args: amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue,
+			},
+		})
+	}
+	return topology
+}
+
+// Attempts returns how many times the delivery has already gone through the
+// retry queues of queue, as recorded by the broker in the `x-death` header.
+func Attempts(message amqp.Delivery, queue string) int {
+	deaths, ok := message.Headers["x-death"].([]interface{})
+	if !ok {
+		return 0
+	}
+
+	prefix := queue + ".retry."
+	var attempts int
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if !ok {
+			continue
+		}
+		if q, _ := death["queue"].(string); !strings.HasPrefix(q, prefix) {
+			continue
+		}
+		if reason, _ := death["reason"].(string); reason != "expired" {
+			continue
+		}
+		switch count := death["count"].(type) {
+		case int64:
+			attempts += int(count)
+		case int32:
+			attempts += int(count)
+		case int:
+			attempts += count
+		}
+	}
+	return attempts
+}
+
+// scheduleRetry publishes a copy of the delivery to the retry queue of the
+// attempt and waits for the broker to confirm it, so that the delivery is
+// only acknowledged once its copy is safe. The broker moves the copy back to
+// queue once the delay has passed.
+func scheduleRetry(publisher amqpPublisher, message amqp.Delivery, opts *ConsumerOptions, attempt int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RetryPublishTimeout)
+	defer cancel()
+
+	retryQueue := RetryQueueName(opts.Queue, RetryDelay(opts, attempt))
+	err := publisher.Publish(ctx,
+		"",         // Default exchange
+		retryQueue, // Routing key
+		amqp.Publishing{
+			Headers:         message.Headers,
+			ContentType:     message.ContentType,
+			ContentEncoding: message.ContentEncoding,
+			DeliveryMode:    amqp.Persistent,
+			Priority:        message.Priority,
+			CorrelationId:   message.CorrelationId,
+			ReplyTo:         message.ReplyTo,
+			MessageId:       message.MessageId,
+			Timestamp:       message.Timestamp,
+			Type:            message.Type,
+			AppId:           message.AppId,
+			Body:            message.Body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error scheduling retry %d of delivery %d on queue: %s %s", attempt, message.DeliveryTag, retryQueue, err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type MockChannel struct {
+	err       error
+	published []string
+	queues    map[string]amqp.Table
+	bindings  []string
+	exchanges []string
+}
+
+func (c *MockChannel) Publish(_ context.Context, _, key string, _ amqp.Publishing) error {
+	c.published = append(c.published, key)
+	return c.err
+}
+
+func (c *MockChannel) ExchangeDeclare(name, _ string, _, _, _, _ bool, _ amqp.Table) error {
+	c.exchanges = append(c.exchanges, name)
+	return c.err
+}
+
+// QueueDeclare fails like RabbitMQ does when the queue already exists with
+// different arguments.
+func (c *MockChannel) QueueDeclare(name string, _, _, _, _ bool, args amqp.Table) (amqp.Queue, error) {
+	if c.queues == nil {
+		c.queues = map[string]amqp.Table{}
+	}
+	if existing, ok := c.queues[name]; ok && !reflect.DeepEqual(existing, args) {
+		return amqp.Queue{}, fmt.Errorf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)
+	}
+	c.queues[name] = args
+	return amqp.Queue{Name: name}, c.err
+}
+
+func (c *MockChannel) QueueBind(name, key, exchange string, _ bool, _ amqp.Table) error {
+	c.bindings = append(c.bindings, exchange+"/"+key+"->"+name)
+	return c.err
+}
+
+func retryOptions(maxAttempts int) *ConsumerOptions {
+	return &ConsumerOptions{
+		Queue:         "analysis-run",
+		MaxAttempts:   maxAttempts,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 5 * time.Second,
+	}
+}
+
+func deathHeaders(queue, reason string, count int64) amqp.Table {
+	return amqp.Table{
+		"x-death": []interface{}{
+			amqp.Table{"queue": queue, "reason": reason, "count": count},
+		},
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	opts := retryOptions(5)
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := RetryDelay(opts, i+1); got != w {
+			t.Errorf("RetryDelay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestDeclareRetryTopology(t *testing.T) {
+	ch := &MockChannel{}
+	args, err := declareRetryTopology(ch, retryOptions(3))
+	if err != nil {
+		t.Fatalf("declareRetryTopology() error = %v", err)
+	}
+
+	if args["x-dead-letter-exchange"] != "analysis-run.dlx" {
+		t.Errorf("queue x-dead-letter-exchange = %v, want analysis-run.dlx", args["x-dead-letter-exchange"])
+	}
+	if len(ch.exchanges) != 1 || ch.exchanges[0] != "analysis-run.dlx" {
+		t.Errorf("declared exchanges = %v", ch.exchanges)
+	}
+	if len(ch.bindings) != 1 || ch.bindings[0] != "analysis-run.dlx/analysis-run->analysis-run.parked" {
+		t.Errorf("declared bindings = %v", ch.bindings)
+	}
+	for name, ttl := range map[string]int64{"analysis-run.retry.1000ms": 1000, "analysis-run.retry.2000ms": 2000} {
+		retryArgs, ok := ch.queues[name]
+		if !ok {
+			t.Fatalf("retry queue %s not declared", name)
+		}
+		if retryArgs["x-message-ttl"] != ttl || retryArgs["x-dead-letter-routing-key"] != "analysis-run" {
+			t.Errorf("retry queue %s args = %v", name, retryArgs)
+		}
+	}
+	// The consumed queue is declared by the consumer, not with the topology.
+	if len(ch.queues) != 3 {
+		t.Errorf("declared queues = %v, want the parking queue and 2 retry queues", ch.queues)
+	}
+
+	if _, err := declareRetryTopology(&MockChannel{err: errors.New("test-error")}, retryOptions(3)); err == nil {
+		t.Error("declareRetryTopology() expected error")
+	}
+}
+
+func TestDeclareRetryTopology_ConfigChange(t *testing.T) {
+	// The queues declared by a previous configuration are still there.
+	ch := &MockChannel{}
+	if _, err := declareRetryTopology(ch, retryOptions(3)); err != nil {
+		t.Fatalf("declareRetryTopology() error = %v", err)
+	}
+
+	changed := []*ConsumerOptions{
+		{Queue: "analysis-run", MaxAttempts: 3, RetryDelay: 3 * time.Second, MaxRetryDelay: 5 * time.Second},
+		{Queue: "analysis-run", MaxAttempts: 6, RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second},
+		{Queue: "analysis-run", MaxAttempts: 6, RetryDelay: time.Second, MaxRetryDelay: 3 * time.Second},
+	}
+	for _, opts := range changed {
+		if _, err := declareRetryTopology(ch, opts); err != nil {
+			t.Errorf("declareRetryTopology() after changing the retry options to %+v error = %v", opts, err)
+		}
+	}
+
+	// Attempts whose delay is capped share a retry queue.
+	ch = &MockChannel{}
+	if _, err := declareRetryTopology(ch, retryOptions(6)); err != nil {
+		t.Fatalf("declareRetryTopology() error = %v", err)
+	}
+	if len(ch.queues) != 5 {
+		t.Errorf("declared queues = %v, want the parking queue and 4 retry queues", ch.queues)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	message := amqp.Delivery{Headers: amqp.Table{
+		"x-death": []interface{}{
+			amqp.Table{"queue": "analysis-run.retry.2000ms", "reason": "expired", "count": int64(1)},
+			amqp.Table{"queue": "analysis-run.retry.1000ms", "reason": "expired", "count": int64(1)},
+			amqp.Table{"queue": "analysis-run", "reason": "rejected", "count": int64(1)},
+			amqp.Table{"queue": "autofix-run.retry.1000ms", "reason": "expired", "count": int64(1)},
+		},
+	}}
+	if got := Attempts(message, "analysis-run"); got != 2 {
+		t.Errorf("Attempts() = %d, want 2", got)
+	}
+	if got := Attempts(amqp.Delivery{}, "analysis-run"); got != 0 {
+		t.Errorf("Attempts() without x-death = %d, want 0", got)
+	}
+}
+
+func TestConsumer_SettleWithRetries(t *testing.T) {
+	retryable := Retryable(errors.New("test-error"))
+	tests := []struct {
+		name          string
+		headers       amqp.Table
+		processErr    error
+		publishErr    error
+		wantPublished string
+		wantAction    string
+		wantRequeue   bool
+	}{
+		{name: "ack on success", wantAction: "ack"},
+		{name: "first retry", processErr: retryable, wantPublished: "analysis-run.retry.1000ms", wantAction: "ack"},
+		{
+			name:          "second retry",
+			headers:       deathHeaders("analysis-run.retry.1000ms", "expired", 1),
+			processErr:    retryable,
+			wantPublished: "analysis-run.retry.2000ms",
+			wantAction:    "ack",
+		},
+		{
+			name: "parked after max attempts",
+			headers: amqp.Table{"x-death": []interface{}{
+				amqp.Table{"queue": "analysis-run.retry.2000ms", "reason": "expired", "count": int64(1)},
+				amqp.Table{"queue": "analysis-run.retry.1000ms", "reason": "expired", "count": int64(1)},
+			}},
+			processErr: retryable,
+			wantAction: "reject",
+		},
+		{name: "poison is parked straight away", processErr: Poison(errors.New("test-error")), wantAction: "reject"},
+		{name: "requeued when the retry is not confirmed", processErr: retryable, publishErr: errors.New("test-error"), wantPublished: "analysis-run.retry.1000ms", wantAction: "nack", wantRequeue: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConsumer(nil, retryOptions(3))
+			ch := &MockChannel{err: tt.publishErr}
+			acknowledger := &MockAcknowledger{}
+			message := amqp.Delivery{Acknowledger: acknowledger, Headers: tt.headers}
+
+			if err := c.settle(ch, message, tt.processErr); err != nil {
+				t.Fatalf("Consumer.settle() error = %v", err)
+			}
+			var published string
+			if len(ch.published) > 0 {
+				published = ch.published[0]
+			}
+			if published != tt.wantPublished {
+				t.Errorf("Consumer.settle() published to %q, want %q", published, tt.wantPublished)
+			}
+			if acknowledger.action != tt.wantAction || acknowledger.requeue != tt.wantRequeue {
+				t.Errorf("Consumer.settle() = %s (requeue %v), want %s (requeue %v)",
+					acknowledger.action, acknowledger.requeue, tt.wantAction, tt.wantRequeue)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/deepcode-ai/artifacts/publisher"
+	"github.com/klauspost/compress/zstd"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TaskHeader is the header carrying the task name of Celery protocol v2
+// messages.
+const TaskHeader = "task"
+
+// RouteError is returned when no handler is registered for a delivery.
+type RouteError struct {
+	Key string
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("no handler registered for %q", e.Key)
+}
+
+// DecodeError is returned when the body of a delivery cannot be decoded into
+// the type expected by its handler.
+type DecodeError struct {
+	Key  string
+	Type string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("error decoding delivery for %q into %s: %v", e.Key, e.Type, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Router dispatches deliveries to the handler registered for their key: the
+// `task` header when set, the routing key otherwise. Its Process method is
+// meant to be passed as processMessage.
+//
+// A delivery with a `task` header is a Celery protocol v2 message, whose
+// body is the `[args, kwargs, embed]` tuple: handlers registered with
+// Register receive its kwargs, like the ones built by celery.Task.Message.
+//
+//	router := consumer.NewRouter()
+//	consumer.Register(router, "analysis-run", func(run types.AnalysisRun, _ amqp.Delivery) error {
+//		...
+//	})
+//	consumer.Register(router, "cancel-check", handleCancelCheck)
+//	go consumer.NewConsumer(rmqConn, opts).Consume(block, router.Process)
+//
+// Deliveries with no handler or whose body cannot be decoded are rejected as
+// poison, with a *RouteError or a *DecodeError.
+type Router struct {
+	// Strict makes decoding fail on fields unknown to the handler's type.
+	Strict bool
+
+	mu       sync.RWMutex
+	handlers map[string]func(amqp.Delivery) error
+}
+
+func NewRouter() *Router {
+	return &Router{
+		handlers: map[string]func(amqp.Delivery) error{},
+	}
+}
+
+// Handle registers a handler receiving the raw delivery for the key.
+func (r *Router) Handle(key string, handler func(amqp.Delivery) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[key] = handler
+}
+
+// Register registers a handler for the key which receives the body of the
+// delivery decoded into T, along with the delivery itself.
+func Register[T any](r *Router, key string, handler func(T, amqp.Delivery) error) {
+	typeName := reflect.TypeOf((*T)(nil)).Elem().String()
+	r.Handle(key, func(message amqp.Delivery) error {
+		var v T
+		if err := r.decode(message, &v); err != nil {
+			return Poison(&DecodeError{Key: key, Type: typeName, Err: err})
+		}
+		return handler(v, message)
+	})
+}
+
+// Process dispatches the delivery to its handler.
+func (r *Router) Process(message amqp.Delivery) error {
+	key := RouteKey(message)
+
+	r.mu.RLock()
+	handler, ok := r.handlers[key]
+	r.mu.RUnlock()
+	if !ok {
+		return Poison(&RouteError{Key: key})
+	}
+	return handler(message)
+}
+
+// RouteKey returns the key a delivery is routed with: its `task` header when
+// set, its routing key otherwise.
+func RouteKey(message amqp.Delivery) string {
+	if task, ok := celeryTask(message); ok {
+		return task
+	}
+	return message.RoutingKey
+}
+
+// celeryTask returns the `task` header of Celery protocol v2 messages.
+func celeryTask(message amqp.Delivery) (string, bool) {
+	task, ok := message.Headers[TaskHeader].(string)
+	return task, ok && task != ""
+}
+
+func (r *Router) decode(message amqp.Delivery, v interface{}) error {
+	body, err := Body(message)
+	if err != nil {
+		return err
+	}
+	if _, ok := celeryTask(message); ok {
+		if body, err = celeryKWArgs(body); err != nil {
+			return err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if r.Strict {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
+}
+
+// celeryKWArgs returns the kwargs of a Celery protocol v2 body.
+func celeryKWArgs(body []byte) ([]byte, error) {
+	var tuple []json.RawMessage
+	if err := json.Unmarshal(body, &tuple); err != nil || len(tuple) != 3 {
+		return nil, fmt.Errorf("celery protocol v2 body is not an [args, kwargs, embed] tuple: %.64s", body)
+	}
+	return tuple[1], nil
+}
+
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// Body returns the body of the delivery, decompressed if the publisher
+// flagged it as compressed with the compression header.
+func Body(message amqp.Delivery) ([]byte, error) {
+	compression, _ := message.Headers[publisher.RabbitMQCompressionHeader].(string)
+	switch compression {
+	case "":
+		return message.Body, nil
+	case publisher.RabbitMQCompressionZstd:
+		body, err := zstdDecoder.DecodeAll(message.Body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing body: %w", err)
+		}
+		return body, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
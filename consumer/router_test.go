@@ -0,0 +1,185 @@
+package consumer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/deepcode-ai/artifacts/celery"
+	"github.com/deepcode-ai/artifacts/publisher"
+	"github.com/deepcode-ai/artifacts/types"
+	"github.com/klauspost/compress/zstd"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func compress(t *testing.T, body string) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll([]byte(body), nil)
+}
+
+func TestRouter_Process(t *testing.T) {
+	var (
+		gotRun    types.AnalysisRun
+		gotCancel types.CancelCheckRun
+		gotRaw    string
+	)
+	router := NewRouter()
+	Register(router, "analysis-run", func(run types.AnalysisRun, _ amqp.Delivery) error {
+		gotRun = run
+		return nil
+	})
+	Register(router, "contrib.asgard.tasks.cancel_check", func(run types.CancelCheckRun, _ amqp.Delivery) error {
+		gotCancel = run
+		return nil
+	})
+	router.Handle("beacon-run", func(message amqp.Delivery) error {
+		gotRaw = string(message.Body)
+		return nil
+	})
+
+	tests := []struct {
+		name       string
+		message    amqp.Delivery
+		wantErr    interface{}
+		wantAction Action
+		check      func(t *testing.T)
+	}{
+		{
+			name:    "routing key",
+			message: amqp.Delivery{RoutingKey: "analysis-run", Body: []byte(`{"run_id": "run-1"}`)},
+			check: func(t *testing.T) {
+				if gotRun.RunID != "run-1" {
+					t.Errorf("decoded run id = %q, want run-1", gotRun.RunID)
+				}
+			},
+		},
+		{
+			name: "compressed body",
+			message: amqp.Delivery{
+				RoutingKey: "analysis-run",
+				Headers:    amqp.Table{publisher.RabbitMQCompressionHeader: publisher.RabbitMQCompressionZstd},
+				Body:       compress(t, `{"run_id": "run-2"}`),
+			},
+			check: func(t *testing.T) {
+				if gotRun.RunID != "run-2" {
+					t.Errorf("decoded run id = %q, want run-2", gotRun.RunID)
+				}
+			},
+		},
+		{
+			name: "task header takes precedence",
+			message: amqp.Delivery{
+				RoutingKey: "analysis-run",
+				Headers:    amqp.Table{TaskHeader: "contrib.asgard.tasks.cancel_check"},
+				Body:       []byte(`[[], {"run_id": "run-3", "analysis_meta": {"check_seq": "1"}}, {}]`),
+			},
+			check: func(t *testing.T) {
+				if gotCancel.RunID != "run-3" || gotCancel.AnalysisMeta.CheckSeq != "1" {
+					t.Errorf("decoded cancel check run = %+v", gotCancel)
+				}
+			},
+		},
+		{
+			name:    "raw handler",
+			message: amqp.Delivery{RoutingKey: "beacon-run", Body: []byte(`raw`)},
+			check: func(t *testing.T) {
+				if gotRaw != "raw" {
+					t.Errorf("raw body = %q, want raw", gotRaw)
+				}
+			},
+		},
+		{
+			name:       "unknown key",
+			message:    amqp.Delivery{RoutingKey: "unknown"},
+			wantErr:    new(*RouteError),
+			wantAction: Reject,
+		},
+		{
+			name:       "malformed body",
+			message:    amqp.Delivery{RoutingKey: "analysis-run", Body: []byte(`{"run_id": 1}`)},
+			wantErr:    new(*DecodeError),
+			wantAction: Reject,
+		},
+		{
+			name: "task header without celery body",
+			message: amqp.Delivery{
+				Headers: amqp.Table{TaskHeader: "contrib.asgard.tasks.cancel_check"},
+				Body:    []byte(`{"run_id": "run-3"}`),
+			},
+			wantErr:    new(*DecodeError),
+			wantAction: Reject,
+		},
+		{
+			name: "unsupported compression",
+			message: amqp.Delivery{
+				RoutingKey: "analysis-run",
+				Headers:    amqp.Table{publisher.RabbitMQCompressionHeader: "application/gzip"},
+				Body:       []byte(`{}`),
+			},
+			wantErr:    new(*DecodeError),
+			wantAction: Reject,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := router.Process(tt.message)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Router.Process() error = %v", err)
+				}
+				tt.check(t)
+				return
+			}
+			if !errors.As(err, tt.wantErr) {
+				t.Fatalf("Router.Process() error = %v, want %T", err, tt.wantErr)
+			}
+			if got := ActionFor(err); got != tt.wantAction {
+				t.Errorf("ActionFor(Router.Process()) = %v, want %v", got, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestRouter_Strict(t *testing.T) {
+	router := NewRouter()
+	router.Strict = true
+	Register(router, "patcher-run", func(types.PatcherRun, amqp.Delivery) error { return nil })
+
+	err := router.Process(amqp.Delivery{RoutingKey: "patcher-run", Body: []byte(`{"run_id": "run-1", "unknown": true}`)})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("Router.Process() error = %v, want *DecodeError", err)
+	}
+	if decodeErr.Type != "types.PatcherRun" {
+		t.Errorf("DecodeError.Type = %q, want types.PatcherRun", decodeErr.Type)
+	}
+}
+
+func TestRouter_CeleryV2(t *testing.T) {
+	var got types.CancelCheckRun
+	router := NewRouter()
+	router.Strict = true
+	Register(router, "contrib.asgard.tasks.cancel_check", func(run types.CancelCheckRun, _ amqp.Delivery) error {
+		got = run
+		return nil
+	})
+
+	want := types.CancelCheckRun{RunID: "run-1"}
+	want.AnalysisMeta.CheckSeq = "2"
+	message, err := celery.NewTask("contrib.asgard.tasks.cancel_check", want).Message(celery.ProtocolV2)
+	if err != nil {
+		t.Fatalf("Task.Message() error = %v", err)
+	}
+
+	if err := router.Process(amqp.Delivery{Headers: amqp.Table(message.Headers), Body: message.Body}); err != nil {
+		t.Fatalf("Router.Process() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,79 @@
+package consumer
+
+import (
+	"fmt"
+	"time"
+)
+
+// Status is a snapshot of the state of a consumer, for health checks.
+type Status struct {
+	Queue string
+	// Consuming reports whether the consumer is registered and receiving
+	// deliveries.
+	Consuming bool
+	// Since is when Consuming last changed.
+	Since time.Time
+	// LastDelivery is when a delivery was last processed successfully. It is
+	// zero until then.
+	LastDelivery time.Time
+	// LastError is the error the consumer last stopped consuming with.
+	LastError error
+}
+
+// Status returns the current status of the consumer.
+func (c *Consumer) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// QueueDepth returns how many deliveries are ready in the queue, waiting to
+// be delivered. It does not count the ones delivered and not yet settled.
+func (c *Consumer) QueueDepth() (int, error) {
+	rmqChannel, err := c.conn.Channel()
+	if err != nil {
+		return 0, fmt.Errorf("error opening channel: %w", err)
+	}
+	defer rmqChannel.Close()
+
+	queue, err := rmqChannel.QueueDeclarePassive(
+		c.opts.Queue,      // Queue name
+		!c.opts.Transient, // Durable
+		c.opts.AutoDelete, // Delete when used
+		c.opts.Exclusive,  // Exclusive
+		false,             // No wait
+		nil,               // Arguments
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error inspecting queue: %s %w", c.opts.Queue, err)
+	}
+	return queue.Messages, nil
+}
+
+// track updates the status on the lifecycle events of the consumer.
+func (c *Consumer) track(event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	consuming := c.status.Consuming
+	switch event.Type {
+	case EventConsuming:
+		consuming = true
+	case EventChannelClosed, EventConnectionClosed, EventStopped:
+		consuming = false
+		if event.Err != nil {
+			c.status.LastError = event.Err
+		}
+	}
+	if consuming != c.status.Consuming {
+		c.status.Consuming = consuming
+		c.status.Since = time.Now()
+	}
+}
+
+// delivered records that a delivery was processed successfully.
+func (c *Consumer) delivered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.LastDelivery = time.Now()
+}
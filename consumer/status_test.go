@@ -0,0 +1,68 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/deepcode-ai/artifacts/rmq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestConsumer_Status(t *testing.T) {
+	ch := newMockConsumeChannel()
+	conn := &MockConnection{channels: []channel{ch}}
+	recorder := newEventRecorder()
+	c := newTestConsumer(conn, recorder)
+
+	if status := c.Status(); status.Consuming || !status.LastDelivery.IsZero() || status.Queue != "analysis-run" {
+		t.Errorf("Consumer.Status() = %+v before consuming", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	processed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.ConsumeContext(ctx, func(amqp.Delivery) error {
+			defer close(processed)
+			return nil
+		})
+	}()
+
+	recorder.waitFor(t, EventConsuming)
+	if !c.Status().Consuming {
+		t.Error("Consumer.Status() is not consuming once registered")
+	}
+	ch.messages <- amqp.Delivery{Acknowledger: &MockAcknowledger{}}
+	<-processed
+
+	cancel()
+	<-done
+	status := c.Status()
+	if status.Consuming {
+		t.Error("Consumer.Status() is still consuming once stopped")
+	}
+	if status.LastDelivery.IsZero() {
+		t.Error("Consumer.Status() did not record the last delivery")
+	}
+}
+
+func TestConsumer_QueueDepth(t *testing.T) {
+	ch := newMockConsumeChannel()
+	ch.depth = 42
+	c := newTestConsumer(&MockConnection{channels: []channel{ch}}, newEventRecorder())
+
+	depth, err := c.QueueDepth()
+	if err != nil || depth != 42 {
+		t.Errorf("Consumer.QueueDepth() = %d, %v, want 42", depth, err)
+	}
+	if !ch.closed {
+		t.Error("Consumer.QueueDepth() did not close its channel")
+	}
+
+	c = newTestConsumer(&MockConnection{shutdown: true}, newEventRecorder())
+	if _, err := c.QueueDepth(); !errors.Is(err, rmq.ErrClosed) {
+		t.Errorf("Consumer.QueueDepth() error = %v, want %v", err, rmq.ErrClosed)
+	}
+}
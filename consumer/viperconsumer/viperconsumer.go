@@ -0,0 +1,53 @@
+// Package viperconsumer builds consumers from viper configuration, for the
+// services that keep their RabbitMQ settings under the `app.rmq` key.
+package viperconsumer
+
+import (
+	"fmt"
+
+	"github.com/deepcode-ai/artifacts/consumer"
+	"github.com/deepcode-ai/artifacts/rmq"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/spf13/viper"
+)
+
+// ExchangeKey is the key of the exchange the queues are bound to.
+const ExchangeKey = "app.rmq.exchange"
+
+// Options reads the consumer options stored under the key, like:
+//
+//	consumers:
+//	  analysis:
+//	    exchange: atlas-jobs
+//	    queue: analysis-run
+//	    routing_keys: [analysis-run]
+//	    max_attempts: 5
+//	    retry_delay: 10s
+//	    workers: 4
+//
+// The exchange defaults to the one at ExchangeKey.
+func Options(v *viper.Viper, key string) (*consumer.ConsumerOptions, error) {
+	opts := &consumer.ConsumerOptions{}
+	if err := v.UnmarshalKey(key, opts); err != nil {
+		return nil, fmt.Errorf("error reading consumer options from %s: %w", key, err)
+	}
+	if opts.Exchange == "" {
+		opts.Exchange = v.GetString(ExchangeKey)
+	}
+	if opts.Queue == "" {
+		return nil, fmt.Errorf("error reading consumer options from %s: queue is required", key)
+	}
+	return opts, nil
+}
+
+// Consume consumes from a durable queue bound with the routing key to the
+// exchange configured at ExchangeKey in the global viper instance, and
+// processes the deliveries until block receives. It is what consumer.Consume
+// used to be.
+func Consume(rmqConn *rmq.Conn, queueName, routingKey string, block chan error, processMessage func(amqp.Delivery) error) {
+	consumer.NewConsumer(rmqConn, &consumer.ConsumerOptions{
+		Exchange:    viper.GetString(ExchangeKey),
+		Queue:       queueName,
+		RoutingKeys: []string{routingKey},
+	}).Consume(block, processMessage)
+}
@@ -0,0 +1,70 @@
+package viperconsumer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const testConfig = `
+app:
+  rmq:
+    exchange: atlas-jobs
+consumers:
+  analysis:
+    queue: analysis-run
+    routing_keys: [analysis-run, ide-run]
+    queue_args:
+      x-queue-type: quorum
+    max_attempts: 5
+    retry_delay: 10s
+    workers: 4
+  cancel:
+    exchange: atlas-control
+    queue: cancel-check
+    routing_keys: [cancel-check]
+    exclusive: true
+    transient: true
+  invalid:
+    transient: true
+`
+
+func TestOptions(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(testConfig)); err != nil {
+		t.Fatal(err)
+	}
+
+	analysis, err := Options(v, "consumers.analysis")
+	if err != nil {
+		t.Fatalf("Options() error = %v", err)
+	}
+	if analysis.Exchange != "atlas-jobs" || analysis.Queue != "analysis-run" || analysis.Transient {
+		t.Errorf("Options() = %+v", analysis)
+	}
+	if !reflect.DeepEqual(analysis.RoutingKeys, []string{"analysis-run", "ide-run"}) {
+		t.Errorf("Options() routing keys = %v", analysis.RoutingKeys)
+	}
+	if analysis.QueueArgs["x-queue-type"] != "quorum" {
+		t.Errorf("Options() queue args = %v", analysis.QueueArgs)
+	}
+	if analysis.MaxAttempts != 5 || analysis.RetryDelay != 10*time.Second || analysis.Workers != 4 {
+		t.Errorf("Options() max attempts = %d, retry delay = %v, workers = %d", analysis.MaxAttempts, analysis.RetryDelay, analysis.Workers)
+	}
+
+	cancel, err := Options(v, "consumers.cancel")
+	if err != nil {
+		t.Fatalf("Options() error = %v", err)
+	}
+	if cancel.Exchange != "atlas-control" || !cancel.Exclusive || !cancel.Transient {
+		t.Errorf("Options() = %+v", cancel)
+	}
+
+	if _, err := Options(v, "consumers.invalid"); err == nil {
+		t.Error("Options() expected error without a queue")
+	}
+}
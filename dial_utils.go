@@ -1,35 +1,15 @@
 package artifacts
 
 import (
-	"log"
-	"time"
+	"context"
 
-	"github.com/streadway/amqp"
+	"github.com/deepcode-ai/artifacts/rmq"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-var maxRetryCount = 12
-
-// dialRMQ creates a connection with RabbiMQ and stores the amqp connection
-// object for usage by other functions
-func dialRMQ(brokerUrl string) (rmqConn *amqp.Connection, err error) {
-	retryTimeout := 1
-	retryCount := 0
-	var retryDuration time.Duration
-
-	for {
-		if rmqConn, err = amqp.Dial(brokerUrl); err == nil {
-			log.Println("Successfully reconnected to RabbitMQ")
-			return rmqConn, nil
-		}
-
-		log.Printf("Failed to connect to RMQ, Error: %v", err)
-		if retryCount > maxRetryCount {
-			return nil, err
-		}
-		// Wait for retrying in time intervals based on fibonacci series
-		retryTimeout, retryDuration = GetRetryTimeout(retryTimeout)
-		log.Printf("Retrying connection in %d seconds", retryTimeout)
-		time.Sleep(retryDuration)
-		retryCount++
-	}
+// dialRMQ creates a connection with RabbitMQ with the default dial options,
+// backing off with jitter between attempts. Use rmq.Dial to dial with a
+// context or other options.
+func dialRMQ(brokerUrl string) (*amqp.Connection, error) {
+	return rmq.Dial(context.Background(), brokerUrl, rmq.DefaultDialOptions())
 }
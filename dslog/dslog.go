@@ -4,7 +4,8 @@
 // {
 //  "timestamp":1516134303,
 //  "level":"ERROR",
-//  "trace_id":"regbhg93h8g93u4fh9u34hfgerg45",
+//  "trace_id":"4bf92f3577b34da6a3ce929d0e0e4736",
+//  "span_id":"00f067aa0ba902b7",
 //  "message":{},
 //  "env": {
 //    "host":"10.54.123.123",
@@ -28,6 +29,9 @@
 // To log a message:
 // 	dslog.Debug("hello world", slog.String("name", "deepcode-ai"), slog.Int("age", 1))
 //
+// trace_id and span_id are set when the context passed to the *Ctx functions
+// carries a span context, see package trace.
+//
 // The additional fields are optional and will be added to the context field.
 
 package dslog
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 
+	"github.com/deepcode-ai/artifacts/trace"
 	"golang.org/x/exp/slog"
 )
 
@@ -52,6 +53,12 @@ func (h *DSHandler) Handle(ctx context.Context, record slog.Record) error {
 	}
 
 	message := converter(h.attrs, &record)
+	// The trace context carried by ctx, if any, ties the record to the spans
+	// of the trace.
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		message["trace_id"] = sc.TraceID.String()
+		message["span_id"] = sc.SpanID.String()
+	}
 
 	b, err := json.Marshal(message)
 	if err != nil {
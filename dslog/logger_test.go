@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/deepcode-ai/artifacts/trace"
 	"golang.org/x/exp/slog"
 )
 
@@ -66,3 +67,37 @@ func TestLog(t *testing.T) {
 		t.Error("expected env")
 	}
 }
+
+func TestLog_TraceContext(t *testing.T) {
+	var b bytes.Buffer
+	Configure(Option{Writer: &b, Level: LevelDebug})
+
+	_, span := trace.NewTracer(nil).Start(context.Background(), "process", trace.SpanKindConsumer)
+	ctx := trace.ContextWithSpanContext(context.Background(), span.SpanContext())
+	InfoCtx(ctx, "processing")
+	Info("no trace")
+
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2", len(lines))
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(lines[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["trace_id"] != span.SpanContext().TraceID.String() {
+		t.Errorf("trace_id = %v, want %v", got["trace_id"], span.SpanContext().TraceID)
+	}
+	if got["span_id"] != span.SpanContext().SpanID.String() {
+		t.Errorf("span_id = %v, want %v", got["span_id"], span.SpanContext().SpanID)
+	}
+
+	got = nil
+	if err := json.Unmarshal(lines[1], &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["trace_id"]; ok {
+		t.Errorf("logged trace_id %v without a span context", got["trace_id"])
+	}
+}
@@ -0,0 +1,220 @@
+// Package events tracks the stages of the analysis pipeline, for measuring
+// its performance:
+//
+//	tracker := events.NewTracker(events.LogSink{}, fileSink)
+//	tracker.Track(ctx, events.Event{
+//		RunType:       "analysis",
+//		RunID:         run.RunID,
+//		CheckSequence: check.CheckSeq,
+//		Stage:         "analysis_started",
+//	})
+//
+// Each event records how long the run spent since its previous event, so that
+// stage durations do not have to be computed from the timestamps.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Event is a stage reached by an analysis run.
+type Event struct {
+	RunType       string
+	RunID         string
+	RunSerial     string
+	CheckSequence string
+	Repository    string
+	Shortcode     string
+	CommitSHA     string
+	IsFullRun     bool
+	Stage         string
+	// Timestamp is when the stage was reached. Track sets it when zero.
+	Timestamp time.Time
+	// PreviousStage and Duration are the previous stage of the run and the
+	// time spent since it, set by Track. They are empty for the first event
+	// of a run.
+	PreviousStage string
+	Duration      time.Duration
+}
+
+// eventJSON is the JSON encoding of an Event, with times in milliseconds.
+type eventJSON struct {
+	RunType       string `json:"run_type"`
+	RunID         string `json:"run_id"`
+	RunSerial     string `json:"run_serial,omitempty"`
+	CheckSequence string `json:"check_sequence,omitempty"`
+	Repository    string `json:"repository,omitempty"`
+	Shortcode     string `json:"shortcode,omitempty"`
+	CommitSHA     string `json:"commit_sha,omitempty"`
+	IsFullRun     bool   `json:"is_full_run"`
+	Stage         string `json:"stage"`
+	Timestamp     int64  `json:"timestamp_ms"`
+	PreviousStage string `json:"previous_stage,omitempty"`
+	Duration      int64  `json:"duration_ms"`
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(eventJSON{
+		RunType:       e.RunType,
+		RunID:         e.RunID,
+		RunSerial:     e.RunSerial,
+		CheckSequence: e.CheckSequence,
+		Repository:    e.Repository,
+		Shortcode:     e.Shortcode,
+		CommitSHA:     e.CommitSHA,
+		IsFullRun:     e.IsFullRun,
+		Stage:         e.Stage,
+		Timestamp:     e.Timestamp.UnixMilli(),
+		PreviousStage: e.PreviousStage,
+		Duration:      e.Duration.Milliseconds(),
+	})
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var v eventJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = Event{
+		RunType:       v.RunType,
+		RunID:         v.RunID,
+		RunSerial:     v.RunSerial,
+		CheckSequence: v.CheckSequence,
+		Repository:    v.Repository,
+		Shortcode:     v.Shortcode,
+		CommitSHA:     v.CommitSHA,
+		IsFullRun:     v.IsFullRun,
+		Stage:         v.Stage,
+		Timestamp:     time.UnixMilli(v.Timestamp),
+		PreviousStage: v.PreviousStage,
+		Duration:      time.Duration(v.Duration) * time.Millisecond,
+	}
+	return nil
+}
+
+// Bytes returns the event encoded to JSON, making it a publisher.Payload.
+func (e Event) Bytes() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Sink is where the tracked events are written.
+type Sink interface {
+	Write(ctx context.Context, event Event) error
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(ctx context.Context, event Event) error
+
+func (f SinkFunc) Write(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+// DefaultRunTTL is how long a Tracker remembers the last stage of a run
+// without new events.
+const DefaultRunTTL = 24 * time.Hour
+
+// runKey identifies the run an event belongs to, for stage durations. The
+// checks of a run progress independently, so each has its own stages.
+type runKey struct {
+	runType, runID, checkSequence string
+}
+
+type lastStage struct {
+	stage     string
+	timestamp time.Time
+	// tracked is when the stage was tracked, for expiring it.
+	tracked time.Time
+}
+
+// Tracker computes the stage durations of the events and writes them to its
+// sinks.
+type Tracker struct {
+	// RunTTL is how long the last stage of a run is remembered without new
+	// events, so that the runs that are never finished, like the ones that
+	// crashed, do not pile up. The next event of an expired run has no
+	// previous stage. Defaults to DefaultRunTTL. It must be set before the
+	// first event is tracked.
+	RunTTL time.Duration
+
+	sinks []Sink
+	now   func() time.Time
+
+	mu    sync.Mutex
+	runs  map[runKey]lastStage
+	swept time.Time
+}
+
+func NewTracker(sinks ...Sink) *Tracker {
+	return &Tracker{
+		RunTTL: DefaultRunTTL,
+		sinks:  sinks,
+		now:    time.Now,
+		runs:   map[runKey]lastStage{},
+	}
+}
+
+// Track timestamps the event if needed, sets its duration since the previous
+// event of the run and writes it to every sink. It returns the errors of the
+// sinks, joined.
+func (t *Tracker) Track(ctx context.Context, event Event) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = t.now()
+	}
+
+	key := runKey{event.RunType, event.RunID, event.CheckSequence}
+	now := t.now()
+	t.mu.Lock()
+	t.expire(now)
+	if last, ok := t.runs[key]; ok && now.Sub(last.tracked) < t.RunTTL {
+		event.PreviousStage = last.stage
+		event.Duration = event.Timestamp.Sub(last.timestamp)
+	}
+	t.runs[key] = lastStage{stage: event.Stage, timestamp: event.Timestamp, tracked: now}
+	t.mu.Unlock()
+
+	var errs []error
+	for _, sink := range t.sinks {
+		if err := sink.Write(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expire forgets the runs without events for RunTTL. The runs are swept at
+// most every tenth of RunTTL, Track checks the expiry of the run it looks up
+// in between.
+func (t *Tracker) expire(now time.Time) {
+	if now.Sub(t.swept) < t.RunTTL/10 {
+		return
+	}
+	t.swept = now
+	for key, last := range t.runs {
+		if now.Sub(last.tracked) >= t.RunTTL {
+			delete(t.runs, key)
+		}
+	}
+}
+
+// Len returns the number of runs whose last stage is remembered.
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.runs)
+}
+
+// Finish forgets the stages of the run, once its last event was tracked.
+// An empty checkSequence forgets every check of the run.
+func (t *Tracker) Finish(runType, runID, checkSequence string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.runs {
+		if key.runType == runType && key.runID == runID && (checkSequence == "" || key.checkSequence == checkSequence) {
+			delete(t.runs, key)
+		}
+	}
+}
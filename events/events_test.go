@@ -0,0 +1,221 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/publisher"
+)
+
+type MockSink struct {
+	mu     sync.Mutex
+	events []Event
+	err    error
+}
+
+func (s *MockSink) Write(_ context.Context, e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return s.err
+}
+
+type MockPublisher struct {
+	payloads []publisher.Payload
+}
+
+func (p *MockPublisher) Publish(_ context.Context, payload publisher.Payload) error {
+	p.payloads = append(p.payloads, payload)
+	return nil
+}
+
+func TestTracker_Track(t *testing.T) {
+	sink := &MockSink{}
+	tracker := NewTracker(sink)
+	start := time.Date(2023, 11, 1, 10, 0, 0, 0, time.UTC)
+	now := start
+	tracker.now = func() time.Time { return now }
+
+	track := func(checkSequence, stage string, after time.Duration) {
+		now = now.Add(after)
+		if err := tracker.Track(context.Background(), Event{RunType: "analysis", RunID: "run-1", CheckSequence: checkSequence, Stage: stage}); err != nil {
+			t.Fatalf("Tracker.Track() error = %v", err)
+		}
+	}
+	track("1", "received", 0)
+	track("1", "job_created", 1500*time.Millisecond)
+	track("2", "received", 10*time.Millisecond)
+	track("1", "completed", 3*time.Second)
+
+	type stage struct {
+		CheckSequence, Stage, PreviousStage string
+		Duration                            time.Duration
+	}
+	want := []stage{
+		{"1", "received", "", 0},
+		{"1", "job_created", "received", 1500 * time.Millisecond},
+		{"2", "received", "", 0},
+		{"1", "completed", "job_created", 3010 * time.Millisecond},
+	}
+	var got []stage
+	for _, e := range sink.events {
+		got = append(got, stage{e.CheckSequence, e.Stage, e.PreviousStage, e.Duration})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tracked %+v, want %+v", got, want)
+	}
+	if !sink.events[0].Timestamp.Equal(start) {
+		t.Errorf("Event.Timestamp = %v, want %v", sink.events[0].Timestamp, start)
+	}
+
+	// Finishing a run starts its stages over.
+	tracker.Finish("analysis", "run-1", "")
+	track("1", "received", time.Second)
+	if last := sink.events[len(sink.events)-1]; last.PreviousStage != "" || last.Duration != 0 {
+		t.Errorf("tracked %+v after Finish, want no previous stage", last)
+	}
+}
+
+func TestTracker_RunTTL(t *testing.T) {
+	sink := &MockSink{}
+	tracker := NewTracker(sink)
+	tracker.RunTTL = time.Hour
+	now := time.Date(2023, 11, 1, 10, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	track := func(runID, stage string) Event {
+		if err := tracker.Track(context.Background(), Event{RunType: "analysis", RunID: runID, Stage: stage}); err != nil {
+			t.Fatalf("Tracker.Track() error = %v", err)
+		}
+		return sink.events[len(sink.events)-1]
+	}
+	// The runs are never finished.
+	for i := 0; i < 100; i++ {
+		track(fmt.Sprintf("run-%d", i), "received")
+	}
+	if got := tracker.Len(); got != 100 {
+		t.Fatalf("Tracker.Len() = %d, want 100", got)
+	}
+
+	now = now.Add(30 * time.Minute)
+	if e := track("run-0", "completed"); e.PreviousStage != "received" {
+		t.Errorf("tracked %+v, want the previous stage of a run within the TTL", e)
+	}
+
+	now = now.Add(45 * time.Minute)
+	if e := track("run-1", "completed"); e.PreviousStage != "" || e.Duration != 0 {
+		t.Errorf("tracked %+v, want no previous stage for an expired run", e)
+	}
+	// run-0 and run-1 were tracked within the TTL, the others expired.
+	if got := tracker.Len(); got != 2 {
+		t.Errorf("Tracker.Len() = %d, want 2", got)
+	}
+}
+
+func TestTracker_SinkErrors(t *testing.T) {
+	errSink := errors.New("sink error")
+	failing, ok := &MockSink{err: errSink}, &MockSink{}
+	tracker := NewTracker(failing, ok)
+
+	err := tracker.Track(context.Background(), Event{RunID: "run-1", Stage: "received"})
+	if !errors.Is(err, errSink) {
+		t.Errorf("Tracker.Track() error = %v, want %v", err, errSink)
+	}
+	if len(ok.events) != 1 {
+		t.Error("Tracker.Track() did not write to every sink")
+	}
+}
+
+func TestEvent_JSON(t *testing.T) {
+	event := Event{
+		RunType:       "analysis",
+		RunID:         "run-1",
+		Repository:    "deepcode-ai/asgard, fork",
+		Shortcode:     "python",
+		IsFullRun:     true,
+		Stage:         "completed",
+		Timestamp:     time.UnixMilli(1698832800123),
+		PreviousStage: "received",
+		Duration:      1500 * time.Millisecond,
+	}
+	data, err := event.Bytes()
+	if err != nil {
+		t.Fatalf("Event.Bytes() error = %v", err)
+	}
+
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	if fields["timestamp_ms"] != float64(1698832800123) || fields["duration_ms"] != float64(1500) || fields["repository"] != event.Repository {
+		t.Errorf("Event.Bytes() = %s", data)
+	}
+
+	var decoded Event
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("error decoding event: %v", err)
+	}
+	if !decoded.Timestamp.Equal(event.Timestamp) {
+		t.Errorf("decoded timestamp %v, want %v", decoded.Timestamp, event.Timestamp)
+	}
+	decoded.Timestamp = event.Timestamp
+	if !reflect.DeepEqual(decoded, event) {
+		t.Errorf("decoded %+v, want %+v", decoded, event)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("NewFileSink() error = %v", err)
+	}
+	tracker := NewTracker(sink)
+	for _, stage := range []string{"received", "completed"} {
+		if err := tracker.Track(context.Background(), Event{RunID: "run-1", Stage: stage}); err != nil {
+			t.Fatalf("Tracker.Track() error = %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("FileSink.Close() error = %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var stages []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("error decoding line %q: %v", scanner.Text(), err)
+		}
+		stages = append(stages, e.Stage)
+	}
+	if want := []string{"received", "completed"}; !reflect.DeepEqual(stages, want) {
+		t.Errorf("file has stages %q, want %q", stages, want)
+	}
+}
+
+func TestPublisherSink(t *testing.T) {
+	p := &MockPublisher{}
+	tracker := NewTracker(PublisherSink{Publisher: p}, LogSink{})
+	if err := tracker.Track(context.Background(), Event{RunID: "run-1", Stage: "received"}); err != nil {
+		t.Fatalf("Tracker.Track() error = %v", err)
+	}
+	if len(p.payloads) != 1 {
+		t.Fatalf("published %d payloads, want 1", len(p.payloads))
+	}
+	if e, ok := p.payloads[0].(Event); !ok || e.Stage != "received" {
+		t.Errorf("published %+v", p.payloads[0])
+	}
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/deepcode-ai/artifacts/dslog"
+	"github.com/deepcode-ai/artifacts/publisher"
+	"golang.org/x/exp/slog"
+)
+
+// LogSink writes the events with dslog, at the info level.
+type LogSink struct{}
+
+func (LogSink) Write(ctx context.Context, e Event) error {
+	dslog.InfoCtx(ctx, "analysis event",
+		slog.String("event", "analysis"),
+		slog.String("run_type", e.RunType),
+		slog.String("run_id", e.RunID),
+		slog.String("run_serial", e.RunSerial),
+		slog.String("check_sequence", e.CheckSequence),
+		slog.String("repository", e.Repository),
+		slog.String("shortcode", e.Shortcode),
+		slog.String("commit_sha", e.CommitSHA),
+		slog.Bool("is_full_run", e.IsFullRun),
+		slog.String("stage", e.Stage),
+		slog.Int64("timestamp_ms", e.Timestamp.UnixMilli()),
+		slog.String("previous_stage", e.PreviousStage),
+		slog.Int64("duration_ms", e.Duration.Milliseconds()),
+	)
+	return nil
+}
+
+// FileSink appends the events to a file, as JSON lines.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens the file at path for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening events file: %w", err)
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(_ context.Context, e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing event: %w", err)
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// PublisherSink publishes the events, encoded to JSON.
+type PublisherSink struct {
+	Publisher publisher.Publisher
+}
+
+func (s PublisherSink) Write(ctx context.Context, e Event) error {
+	if err := s.Publisher.Publish(ctx, e); err != nil {
+		return fmt.Errorf("error publishing event: %w", err)
+	}
+	return nil
+}
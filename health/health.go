@@ -0,0 +1,265 @@
+// Package health serves the liveness and readiness of broker-backed services
+// over HTTP, for Kubernetes probes:
+//
+//	mux.Handle("/healthz/", health.NewHandler(&health.HandlerOpts{
+//		Connection:     health.Supervisor(supervisor),
+//		Consumers:      []health.Consumer{c},
+//		MaxDeliveryAge: 10 * time.Minute,
+//		MaxQueueDepth:  1000,
+//	}))
+//
+// exposes /healthz/live and /healthz/ready. Both answer 200 when the check
+// passes and 503 otherwise, with a JSON Report as body.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/consumer"
+	"github.com/deepcode-ai/artifacts/rmq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// ConnectionState is the state of the broker connection.
+type ConnectionState struct {
+	Connected bool   `json:"connected"`
+	State     string `json:"state"`
+	// Since is when the connection entered State, when known.
+	Since      *time.Time `json:"since,omitempty"`
+	Reconnects int        `json:"reconnects"`
+	LastError  string     `json:"last_error,omitempty"`
+	// Stopped reports whether the connection is closed for good and will
+	// not be reestablished.
+	Stopped bool `json:"-"`
+}
+
+// ConnectionProbe returns the current state of the broker connection.
+type ConnectionProbe func() ConnectionState
+
+// Supervisor probes the connection of an *rmq.Supervisor.
+func Supervisor(s *rmq.Supervisor) ConnectionProbe {
+	return func() ConnectionState {
+		status := s.Status()
+		state := ConnectionState{
+			Connected:  s.Healthy(),
+			State:      status.State.String(),
+			Reconnects: status.Reconnects,
+			Stopped:    status.State == rmq.StateStopped,
+		}
+		if !status.Since.IsZero() {
+			since := status.Since
+			state.Since = &since
+		}
+		if status.LastError != nil {
+			state.LastError = status.LastError.Error()
+		}
+		return state
+	}
+}
+
+// Conn probes an *rmq.Conn.
+func Conn(c *rmq.Conn) ConnectionProbe {
+	return func() ConnectionState {
+		state := ConnectionState{Connected: c.IsConnected(), State: "disconnected"}
+		select {
+		case <-c.Done():
+			state.State = "closed"
+			state.Stopped = true
+			if err := c.Err(); err != nil {
+				state.LastError = err.Error()
+			}
+		default:
+			if state.Connected {
+				state.State = "connected"
+			}
+		}
+		return state
+	}
+}
+
+// AMQP probes a raw *amqp.Connection, which is never reestablished once
+// closed.
+func AMQP(c *amqp.Connection) ConnectionProbe {
+	return func() ConnectionState {
+		if c.IsClosed() {
+			return ConnectionState{State: "closed", Stopped: true}
+		}
+		return ConnectionState{Connected: true, State: "connected"}
+	}
+}
+
+// Consumer is the subset of *consumer.Consumer used by the handler.
+type Consumer interface {
+	Status() consumer.Status
+	QueueDepth() (int, error)
+}
+
+// ConsumerState is the state of a consumer.
+type ConsumerState struct {
+	Queue        string     `json:"queue"`
+	Consuming    bool       `json:"consuming"`
+	Since        time.Time  `json:"since"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	// QueueDepth is the number of ready deliveries in the queue. It is nil
+	// when the queue could not be inspected.
+	QueueDepth *int   `json:"queue_depth,omitempty"`
+	DepthError string `json:"queue_depth_error,omitempty"`
+	// Backlogged reports whether QueueDepth is over MaxQueueDepth.
+	Backlogged bool `json:"backlogged"`
+	// Stuck reports whether deliveries are waiting while none was processed
+	// for longer than MaxDeliveryAge.
+	Stuck bool `json:"stuck"`
+}
+
+// Report is the body of the responses.
+type Report struct {
+	Status     string           `json:"status"`
+	Connection *ConnectionState `json:"connection,omitempty"`
+	Consumers  []ConsumerState  `json:"consumers,omitempty"`
+}
+
+type HandlerOpts struct {
+	// Connection probes the broker connection. Nil skips the connection
+	// checks.
+	Connection ConnectionProbe
+	Consumers  []Consumer
+
+	// MaxDeliveryAge is how long a consumer may go without processing a
+	// delivery while its queue is not empty before it is considered stuck,
+	// failing liveness. Zero disables the check.
+	MaxDeliveryAge time.Duration
+	// MaxQueueDepth is the queue depth over which a consumer is considered
+	// backlogged, failing readiness. Zero disables the check.
+	MaxQueueDepth int
+}
+
+// Handler serves the liveness and readiness of a service.
+type Handler struct {
+	opts HandlerOpts
+	now  func() time.Time
+}
+
+func NewHandler(opts *HandlerOpts) *Handler {
+	return &Handler{opts: *opts, now: time.Now}
+}
+
+// ServeHTTP serves liveness on paths ending with /live and readiness on
+// paths ending with /ready.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		report Report
+		ok     bool
+	)
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case strings.HasSuffix(path, "/live") || path == "live":
+		report, ok = h.Live()
+	case strings.HasSuffix(path, "/ready") || path == "ready":
+		report, ok = h.Ready()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Live reports whether the service is alive: its connection was not closed
+// for good and none of its consumers is stuck. A connection being
+// reestablished does not fail liveness, restarting would not help.
+func (h *Handler) Live() (Report, bool) {
+	report := h.report()
+	ok := true
+	if report.Connection != nil && report.Connection.Stopped {
+		ok = false
+	}
+	for _, c := range report.Consumers {
+		if c.Stuck {
+			ok = false
+		}
+	}
+	return report.withStatus(ok), ok
+}
+
+// Ready reports whether the service is ready to take work: connected, with
+// every consumer consuming and none backlogged.
+func (h *Handler) Ready() (Report, bool) {
+	report := h.report()
+	ok := true
+	if report.Connection != nil && !report.Connection.Connected {
+		ok = false
+	}
+	for _, c := range report.Consumers {
+		if !c.Consuming || c.Backlogged {
+			ok = false
+		}
+	}
+	return report.withStatus(ok), ok
+}
+
+func (h *Handler) report() Report {
+	var report Report
+	if h.opts.Connection != nil {
+		state := h.opts.Connection()
+		report.Connection = &state
+	}
+	for _, c := range h.opts.Consumers {
+		report.Consumers = append(report.Consumers, h.consumerState(c))
+	}
+	return report
+}
+
+func (h *Handler) consumerState(c Consumer) ConsumerState {
+	status := c.Status()
+	state := ConsumerState{
+		Queue:     status.Queue,
+		Consuming: status.Consuming,
+		Since:     status.Since,
+	}
+	if !status.LastDelivery.IsZero() {
+		lastDelivery := status.LastDelivery
+		state.LastDelivery = &lastDelivery
+	}
+	if status.LastError != nil {
+		state.LastError = status.LastError.Error()
+	}
+
+	depth, err := c.QueueDepth()
+	if err != nil {
+		state.DepthError = err.Error()
+		return state
+	}
+	state.QueueDepth = &depth
+	state.Backlogged = h.opts.MaxQueueDepth > 0 && depth > h.opts.MaxQueueDepth
+
+	if h.opts.MaxDeliveryAge > 0 && status.Consuming && depth > 0 {
+		// Until the first delivery, measure from when consuming started.
+		last := status.LastDelivery
+		if last.Before(status.Since) {
+			last = status.Since
+		}
+		state.Stuck = h.now().Sub(last) > h.opts.MaxDeliveryAge
+	}
+	return state
+}
+
+func (r Report) withStatus(ok bool) Report {
+	r.Status = StatusUnavailable
+	if ok {
+		r.Status = StatusOK
+	}
+	return r
+}
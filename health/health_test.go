@@ -0,0 +1,183 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/consumer"
+)
+
+type MockConsumer struct {
+	status   consumer.Status
+	depth    int
+	depthErr error
+}
+
+func (c *MockConsumer) Status() consumer.Status {
+	return c.status
+}
+
+func (c *MockConsumer) QueueDepth() (int, error) {
+	return c.depth, c.depthErr
+}
+
+func connection(connected, stopped bool) ConnectionProbe {
+	return func() ConnectionState {
+		return ConnectionState{Connected: connected, Stopped: stopped}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	now := time.Now()
+	consuming := consumer.Status{Queue: "analysis-run", Consuming: true, Since: now.Add(-time.Hour)}
+
+	tests := []struct {
+		name       string
+		opts       HandlerOpts
+		path       string
+		wantStatus int
+	}{
+		{
+			name:       "live while reconnecting",
+			opts:       HandlerOpts{Connection: connection(false, false)},
+			path:       "/healthz/live",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "not live once stopped",
+			opts:       HandlerOpts{Connection: connection(false, true)},
+			path:       "/healthz/live",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "not live when stuck",
+			opts: HandlerOpts{
+				Connection:     connection(true, false),
+				Consumers:      []Consumer{&MockConsumer{status: consuming, depth: 3}},
+				MaxDeliveryAge: 10 * time.Minute,
+			},
+			path:       "/healthz/live",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "live when idle on an empty queue",
+			opts: HandlerOpts{
+				Connection:     connection(true, false),
+				Consumers:      []Consumer{&MockConsumer{status: consuming}},
+				MaxDeliveryAge: 10 * time.Minute,
+			},
+			path:       "/healthz/live",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "ready",
+			opts: HandlerOpts{
+				Connection:    connection(true, false),
+				Consumers:     []Consumer{&MockConsumer{status: consuming, depth: 3}},
+				MaxQueueDepth: 10,
+			},
+			path:       "/healthz/ready/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "not ready while disconnected",
+			opts:       HandlerOpts{Connection: connection(false, false)},
+			path:       "/healthz/ready",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "not ready when not consuming",
+			opts: HandlerOpts{
+				Connection: connection(true, false),
+				Consumers:  []Consumer{&MockConsumer{status: consumer.Status{Queue: "analysis-run"}}},
+			},
+			path:       "/healthz/ready",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "not ready when backlogged",
+			opts: HandlerOpts{
+				Connection:    connection(true, false),
+				Consumers:     []Consumer{&MockConsumer{status: consuming, depth: 11}},
+				MaxQueueDepth: 10,
+			},
+			path:       "/healthz/ready",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "ready when the queue cannot be inspected",
+			opts: HandlerOpts{
+				Connection:    connection(true, false),
+				Consumers:     []Consumer{&MockConsumer{status: consuming, depthErr: errors.New("channel closed")}},
+				MaxQueueDepth: 10,
+			},
+			path:       "/healthz/ready",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unknown path",
+			opts:       HandlerOpts{},
+			path:       "/healthz/other",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&tt.opts)
+			h.now = func() time.Time { return now }
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestHandler_Report(t *testing.T) {
+	now := time.Now()
+	lastDelivery := now.Add(-time.Minute)
+	h := NewHandler(&HandlerOpts{
+		Connection: func() ConnectionState {
+			return ConnectionState{Connected: true, State: "connected", Reconnects: 2}
+		},
+		Consumers: []Consumer{&MockConsumer{
+			status: consumer.Status{Queue: "analysis-run", Consuming: true, Since: now.Add(-time.Hour), LastDelivery: lastDelivery},
+			depth:  20,
+		}},
+		MaxQueueDepth: 10,
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz/ready", nil))
+
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	if report.Status != StatusUnavailable {
+		t.Errorf("Report.Status = %q, want %q", report.Status, StatusUnavailable)
+	}
+	if report.Connection == nil || report.Connection.State != "connected" || report.Connection.Reconnects != 2 {
+		t.Errorf("Report.Connection = %+v", report.Connection)
+	}
+	if len(report.Consumers) != 1 {
+		t.Fatalf("len(Report.Consumers) = %d, want 1", len(report.Consumers))
+	}
+	c := report.Consumers[0]
+	if c.Queue != "analysis-run" || !c.Consuming || !c.Backlogged {
+		t.Errorf("Report.Consumers[0] = %+v", c)
+	}
+	if c.QueueDepth == nil || *c.QueueDepth != 20 {
+		t.Errorf("Report.Consumers[0].QueueDepth = %v, want 20", c.QueueDepth)
+	}
+	if c.LastDelivery == nil || !c.LastDelivery.Equal(lastDelivery) {
+		t.Errorf("Report.Consumers[0].LastDelivery = %v, want %v", c.LastDelivery, lastDelivery)
+	}
+}
@@ -0,0 +1,250 @@
+// Package k8s is a small client of the Kubernetes REST API, covering what
+// the services need: restarting deployments and running jobs.
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/dslog"
+	"github.com/deepcode-ai/artifacts/retry"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	DefaultNamespace = "default"
+	DefaultTimeout   = 10 * time.Second
+)
+
+// PatchType is the content type of a patch request.
+type PatchType string
+
+const (
+	JSONPatch           PatchType = "application/json-patch+json"
+	MergePatch          PatchType = "application/merge-patch+json"
+	StrategicMergePatch PatchType = "application/strategic-merge-patch+json"
+)
+
+// APIError is returned when the API server answers with an error status. The
+// fields are filled from the Status object of the response when there is one.
+type APIError struct {
+	StatusCode int
+	// Reason is the machine readable reason, like NotFound or Conflict.
+	Reason  string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("kubernetes API error: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("kubernetes API error: %d %s: %s", e.StatusCode, e.Reason, e.Message)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// IsNotFound reports whether err is an *APIError for a missing object.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is an *APIError for an object that already
+// exists or was modified concurrently.
+func IsConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// ObjectMeta is the metadata common to every object.
+type ObjectMeta struct {
+	Name              string            `json:"name,omitempty"`
+	GenerateName      string            `json:"generateName,omitempty"`
+	Namespace         string            `json:"namespace,omitempty"`
+	UID               string            `json:"uid,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	Generation        int64             `json:"generation,omitempty"`
+	CreationTimestamp *time.Time        `json:"creationTimestamp,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+}
+
+type ClientOpts struct {
+	// Host is the base URL of the API server.
+	Host string
+	// HTTPClient sends the requests. Defaults to a client with a
+	// DefaultTimeout timeout.
+	HTTPClient *http.Client
+	// Token returns the bearer token of every request. Nil sends requests
+	// without one.
+	Token func() (string, error)
+	// Namespace is used by the calls given an empty namespace. Defaults to
+	// DefaultNamespace.
+	Namespace string
+	// Retry retries the requests failing with network errors, 429 or 5xx.
+	// Nil uses retry.Exponential(500ms) with a 10s cap and 5 attempts.
+	Retry *retry.Opts
+}
+
+// Client calls the Kubernetes REST API.
+type Client struct {
+	opts ClientOpts
+}
+
+func NewClient(opts *ClientOpts) *Client {
+	c := &Client{opts: *opts}
+	c.opts.Host = strings.TrimSuffix(c.opts.Host, "/")
+	if c.opts.HTTPClient == nil {
+		c.opts.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if c.opts.Namespace == "" {
+		c.opts.Namespace = DefaultNamespace
+	}
+	if c.opts.Retry == nil {
+		c.opts.Retry = &retry.Opts{
+			Attempts: retry.DefaultAttempts,
+			Strategy: retry.Exponential(500 * time.Millisecond),
+			MaxDelay: 10 * time.Second,
+		}
+	}
+	return c
+}
+
+// StaticToken returns a ClientOpts.Token always returning token.
+func StaticToken(token string) func() (string, error) {
+	return func() (string, error) {
+		return token, nil
+	}
+}
+
+func (c *Client) namespace(namespace string) string {
+	if namespace == "" {
+		return c.opts.Namespace
+	}
+	return namespace
+}
+
+// Do sends a request to the API server, retrying transient failures, and
+// decodes the response into out unless it is nil. body is marshalled to JSON
+// unless it is a []byte.
+func (c *Client) Do(ctx context.Context, method, path, contentType string, body, out interface{}) error {
+	var payload []byte
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		payload = b
+	default:
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("error encoding request body: %w", err)
+		}
+	}
+
+	opts := *c.opts.Retry
+	opts.Op = method + " " + path
+	opts.Retryable = temporary
+	opts.OnRetry = func(attempt int, delay time.Duration, err error) {
+		dslog.Warn("Kubernetes API request failed, retrying",
+			slog.String("method", method), slog.String("path", path),
+			slog.Int("attempt", attempt), slog.Duration("backoff", delay), slog.Any("error", err))
+	}
+	return retry.Do(ctx, &opts, func(ctx context.Context) error {
+		return c.do(ctx, method, path, contentType, payload, out)
+	})
+}
+
+func (c *Client) do(ctx context.Context, method, path, contentType string, payload []byte, out interface{}) error {
+	// The body is read by every attempt, so it is created for each.
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.opts.Host+path, body)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.opts.Token != nil {
+		token, err := c.opts.Token()
+		if err != nil {
+			return fmt.Errorf("error reading bearer token: %w", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	return nil
+}
+
+// newAPIError reads the Status object of an error response.
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var status struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &status) == nil {
+		apiErr.Reason = status.Reason
+		apiErr.Message = status.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+// temporary reports whether a failed request is worth retrying.
+func temporary(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// TokenFile returns a ClientOpts.Token reading the token from path on every
+// request.
+func TokenFile(path string) func() (string, error) {
+	return func() (string, error) {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+}
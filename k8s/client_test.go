@@ -0,0 +1,236 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/retry"
+)
+
+// MockAPIServer is a fake API server answering with the handler registered
+// for the method and path of each request, and recording every request.
+type MockAPIServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	requests []MockRequest
+}
+
+type MockRequest struct {
+	Method        string
+	Path          string
+	ContentType   string
+	Authorization string
+	Body          string
+}
+
+func newMockAPIServer(t *testing.T) *MockAPIServer {
+	s := &MockAPIServer{handlers: map[string]http.HandlerFunc{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		s.mu.Lock()
+		s.requests = append(s.requests, MockRequest{
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			ContentType:   r.Header.Get("Content-Type"),
+			Authorization: r.Header.Get("Authorization"),
+			Body:          string(body),
+		})
+		handler, ok := s.handlers[r.Method+" "+r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "NotFound", "not found")
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *MockAPIServer) handle(method, path string, handler http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method+" "+path] = handler
+}
+
+func (s *MockAPIServer) Requests() []MockRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MockRequest(nil), s.requests...)
+}
+
+func (s *MockAPIServer) client() *Client {
+	return NewClient(&ClientOpts{
+		Host:  s.URL,
+		Token: StaticToken("test-token"),
+		Retry: &retry.Opts{Attempts: 3, Strategy: retry.Constant(0)},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, status int, reason, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"kind":    "Status",
+		"status":  "Failure",
+		"reason":  reason,
+		"message": message,
+		"code":    status,
+	})
+}
+
+func TestClient_RestartDeployment(t *testing.T) {
+	s := newMockAPIServer(t)
+	path := "/apis/apps/v1/namespaces/analysis/deployments/janus"
+	attempts := 0
+	s.handle(http.MethodPatch, path, func(w http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts == 1 {
+			writeStatus(w, http.StatusServiceUnavailable, "ServiceUnavailable", "try again")
+			return
+		}
+		writeJSON(w, http.StatusOK, Deployment{Metadata: ObjectMeta{Name: "janus", Namespace: "analysis"}})
+	})
+
+	deployment, err := s.client().RestartDeployment(context.Background(), "analysis", "janus")
+	if err != nil {
+		t.Fatalf("Client.RestartDeployment() error = %v", err)
+	}
+	if deployment.Metadata.Name != "janus" {
+		t.Errorf("Client.RestartDeployment() = %+v", deployment)
+	}
+
+	requests := s.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	for _, req := range requests {
+		// Every attempt must send the whole patch.
+		var patch Deployment
+		if err := json.Unmarshal([]byte(req.Body), &patch); err != nil {
+			t.Fatalf("error decoding patch %q: %v", req.Body, err)
+		}
+		restartedAt := patch.Spec.Template.Metadata.Annotations[RestartedAtAnnotation]
+		if _, err := time.Parse(time.RFC3339, restartedAt); err != nil {
+			t.Errorf("patch %s has no valid %s annotation", req.Body, RestartedAtAnnotation)
+		}
+		if req.ContentType != string(StrategicMergePatch) {
+			t.Errorf("Content-Type = %q, want %q", req.ContentType, StrategicMergePatch)
+		}
+		if req.Authorization != "Bearer test-token" {
+			t.Errorf("Authorization = %q, want %q", req.Authorization, "Bearer test-token")
+		}
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	s := newMockAPIServer(t)
+	s.handle(http.MethodGet, "/apis/apps/v1/namespaces/default/deployments/forbidden", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusForbidden, "Forbidden", "deployments is forbidden")
+	})
+	s.handle(http.MethodGet, "/apis/apps/v1/namespaces/default/deployments/down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, "bad gateway")
+	})
+	c := s.client()
+
+	_, err := c.GetDeployment(context.Background(), "", "missing")
+	if !IsNotFound(err) {
+		t.Errorf("Client.GetDeployment() error = %v, want a not found error", err)
+	}
+
+	_, err = c.GetDeployment(context.Background(), "", "forbidden")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.Reason != "Forbidden" || apiErr.Message != "deployments is forbidden" {
+		t.Errorf("Client.GetDeployment() error = %#v, want a Forbidden *APIError", err)
+	}
+
+	_, err = c.GetDeployment(context.Background(), "", "down")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || apiErr.Message != "bad gateway" {
+		t.Errorf("Client.GetDeployment() error = %v, want a BadGateway *APIError", err)
+	}
+	if !errors.Is(err, retry.ErrExhausted) {
+		t.Errorf("Client.GetDeployment() error = %v, want the request retried", err)
+	}
+
+	// Only the 502 is retried.
+	if got := len(s.Requests()); got != 5 {
+		t.Errorf("got %d requests, want 5", got)
+	}
+}
+
+func TestClient_WaitForRollout(t *testing.T) {
+	replicas := int32(2)
+	rollout := func(status DeploymentStatus) Deployment {
+		d := Deployment{Metadata: ObjectMeta{Name: "janus", Namespace: "default", Generation: 2}, Status: status}
+		d.Spec.Replicas = &replicas
+		return d
+	}
+
+	t.Run("rolled out", func(t *testing.T) {
+		s := newMockAPIServer(t)
+		states := []DeploymentStatus{
+			{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+			{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 1, AvailableReplicas: 2},
+			{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+		}
+		polls := 0
+		s.handle(http.MethodGet, "/apis/apps/v1/namespaces/default/deployments/janus", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, rollout(states[polls]))
+			polls++
+		})
+
+		if _, err := s.client().WaitForRollout(context.Background(), "", "janus", time.Millisecond); err != nil {
+			t.Fatalf("Client.WaitForRollout() error = %v", err)
+		}
+		if polls != len(states) {
+			t.Errorf("polled %d times, want %d", polls, len(states))
+		}
+	})
+
+	t.Run("progress deadline exceeded", func(t *testing.T) {
+		s := newMockAPIServer(t)
+		s.handle(http.MethodGet, "/apis/apps/v1/namespaces/default/deployments/janus", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, rollout(DeploymentStatus{
+				ObservedGeneration: 2,
+				Conditions: []DeploymentCondition{
+					{Type: "Progressing", Status: "False", Reason: "ProgressDeadlineExceeded", Message: "timed out"},
+				},
+			}))
+		})
+
+		_, err := s.client().WaitForRollout(context.Background(), "", "janus", time.Millisecond)
+		var rolloutErr *RolloutError
+		if !errors.As(err, &rolloutErr) || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("Client.WaitForRollout() error = %v, want a *RolloutError", err)
+		}
+	})
+
+	t.Run("context done", func(t *testing.T) {
+		s := newMockAPIServer(t)
+		s.handle(http.MethodGet, "/apis/apps/v1/namespaces/default/deployments/janus", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, rollout(DeploymentStatus{ObservedGeneration: 1}))
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := s.client().WaitForRollout(ctx, "", "janus", time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Client.WaitForRollout() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
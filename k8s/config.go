@@ -0,0 +1,307 @@
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/dslog"
+	"github.com/spf13/viper"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// ServiceAccountDir is where Kubernetes mounts the service account of a
+	// pod.
+	ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// DefaultTokenReloadInterval is how often a token file is read again to
+	// pick up rotated tokens.
+	DefaultTokenReloadInterval = 1 * time.Minute
+)
+
+// ErrNotInCluster is returned by InClusterConfig outside of a pod.
+var ErrNotInCluster = errors.New("k8s: not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+
+// serviceAccountDir is overridden by the tests.
+var serviceAccountDir = ServiceAccountDir
+
+// Config is how to reach and authenticate to the API server.
+type Config struct {
+	Host string
+	// CAData is the PEM encoded CA of the API server. Nil uses the system
+	// roots.
+	CAData []byte
+	// Insecure skips the verification of the certificate of the API server.
+	Insecure bool
+	// ClientCertData and ClientKeyData are the PEM encoded client
+	// certificate and key, when authenticating with one.
+	ClientCertData []byte
+	ClientKeyData  []byte
+	// Token returns the bearer token. Nil sends requests without one.
+	Token func() (string, error)
+	// Namespace is the default namespace of the client.
+	Namespace string
+}
+
+// NewConfig returns the in-cluster config when running in a pod, and falls
+// back to the kubeconfig file otherwise, for local development. The
+// kubeconfig file is the first one of $KUBECONFIG, or ~/.kube/config.
+func NewConfig() (*Config, error) {
+	config, err := InClusterConfig()
+	if !errors.Is(err, ErrNotInCluster) {
+		return config, err
+	}
+
+	path := filepath.SplitList(os.Getenv("KUBECONFIG"))
+	if len(path) > 0 && path[0] != "" {
+		return KubeconfigConfig(path[0])
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("error locating kubeconfig: %w", err)
+	}
+	return KubeconfigConfig(filepath.Join(home, ".kube", "config"))
+}
+
+// InClusterConfig returns the config of the service account of the pod,
+// discovered from the standard mount and environment variables. The token is
+// read again every DefaultTokenReloadInterval, as the kubelet rotates it.
+func InClusterConfig() (*Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+
+	token := TokenFileReloader(filepath.Join(serviceAccountDir, "token"), DefaultTokenReloadInterval)
+	if _, err := token(); err != nil {
+		return nil, fmt.Errorf("error reading service account token: %w", err)
+	}
+	caData, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account CA: %w", err)
+	}
+	namespace := DefaultNamespace
+	if data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	return &Config{
+		Host:      "https://" + net.JoinHostPort(host, port),
+		CAData:    caData,
+		Token:     token,
+		Namespace: namespace,
+	}, nil
+}
+
+// kubeconfig is the subset of a kubeconfig file used by KubeconfigConfig.
+type kubeconfig struct {
+	CurrentContext string `mapstructure:"current-context"`
+	Clusters       []struct {
+		Name    string `mapstructure:"name"`
+		Cluster struct {
+			Server                   string `mapstructure:"server"`
+			CertificateAuthority     string `mapstructure:"certificate-authority"`
+			CertificateAuthorityData string `mapstructure:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `mapstructure:"insecure-skip-tls-verify"`
+		} `mapstructure:"cluster"`
+	} `mapstructure:"clusters"`
+	Users []struct {
+		Name string `mapstructure:"name"`
+		User struct {
+			Token                 string `mapstructure:"token"`
+			TokenFile             string `mapstructure:"tokenFile"`
+			ClientCertificate     string `mapstructure:"client-certificate"`
+			ClientCertificateData string `mapstructure:"client-certificate-data"`
+			ClientKey             string `mapstructure:"client-key"`
+			ClientKeyData         string `mapstructure:"client-key-data"`
+		} `mapstructure:"user"`
+	} `mapstructure:"users"`
+	Contexts []struct {
+		Name    string `mapstructure:"name"`
+		Context struct {
+			Cluster   string `mapstructure:"cluster"`
+			User      string `mapstructure:"user"`
+			Namespace string `mapstructure:"namespace"`
+		} `mapstructure:"context"`
+	} `mapstructure:"contexts"`
+}
+
+// KubeconfigConfig returns the config of the current context of the
+// kubeconfig file at path. Relative file paths in the kubeconfig are
+// resolved from its directory.
+func KubeconfigConfig(path string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading kubeconfig from %s: %w", path, err)
+	}
+	var kc kubeconfig
+	if err := v.Unmarshal(&kc); err != nil {
+		return nil, fmt.Errorf("error reading kubeconfig from %s: %w", path, err)
+	}
+
+	config, err := kc.config(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading kubeconfig from %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (kc *kubeconfig) config(dir string) (*Config, error) {
+	if kc.CurrentContext == "" {
+		return nil, errors.New("no current-context")
+	}
+	config := &Config{Namespace: DefaultNamespace}
+
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+			if c.Context.Namespace != "" {
+				config.Namespace = c.Context.Namespace
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found", kc.CurrentContext)
+	}
+
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		config.Host = c.Cluster.Server
+		config.Insecure = c.Cluster.InsecureSkipTLSVerify
+		var err error
+		if config.CAData, err = readData(dir, c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority); err != nil {
+			return nil, fmt.Errorf("cluster %q: certificate authority: %w", clusterName, err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found", clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		var err error
+		if config.ClientCertData, err = readData(dir, u.User.ClientCertificateData, u.User.ClientCertificate); err != nil {
+			return nil, fmt.Errorf("user %q: client certificate: %w", userName, err)
+		}
+		if config.ClientKeyData, err = readData(dir, u.User.ClientKeyData, u.User.ClientKey); err != nil {
+			return nil, fmt.Errorf("user %q: client key: %w", userName, err)
+		}
+		switch {
+		case u.User.Token != "":
+			config.Token = StaticToken(u.User.Token)
+		case u.User.TokenFile != "":
+			config.Token = TokenFileReloader(resolve(dir, u.User.TokenFile), DefaultTokenReloadInterval)
+		}
+	}
+	return config, nil
+}
+
+// readData returns the base64 encoded data, or else the content of the file.
+func readData(dir, data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file == "" {
+		return nil, nil
+	}
+	return os.ReadFile(resolve(dir, file))
+}
+
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// HTTPClient returns a client trusting the CA of the API server and
+// presenting the client certificate, if any.
+func (c *Config) HTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.Insecure, // skipcq: GSC-G402
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(c.CAData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(c.CAData) {
+			return nil, errors.New("error parsing CA: no certificate found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(c.ClientCertData) > 0 {
+		cert, err := tls.X509KeyPair(c.ClientCertData, c.ClientKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Timeout: DefaultTimeout, Transport: transport}, nil
+}
+
+// Client returns a client of the API server.
+func (c *Config) Client() (*Client, error) {
+	httpClient, err := c.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(&ClientOpts{
+		Host:       c.Host,
+		HTTPClient: httpClient,
+		Token:      c.Token,
+		Namespace:  c.Namespace,
+	}), nil
+}
+
+// TokenFileReloader returns a ClientOpts.Token reading the token from path
+// and reading it again once it is older than interval, to pick up rotated
+// tokens. When reading it again fails, the previous token is kept.
+func TokenFileReloader(path string, interval time.Duration) func() (string, error) {
+	var (
+		mu     sync.Mutex
+		token  string
+		readAt time.Time
+	)
+	read := TokenFile(path)
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && time.Since(readAt) < interval {
+			return token, nil
+		}
+
+		fresh, err := read()
+		if err != nil {
+			if token == "" {
+				return "", err
+			}
+			dslog.Warn("Failed to reload Kubernetes token, keeping the previous one",
+				slog.String("path", path), slog.Any("error", err))
+			readAt = time.Now()
+			return token, nil
+		}
+		token, readAt = fresh, time.Now()
+		return token, nil
+	}
+}
@@ -0,0 +1,160 @@
+package k8s
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTLSAPIServer returns a fake API server over TLS and its CA, PEM encoded.
+func newTLSAPIServer(t *testing.T, token string) (*httptest.Server, []byte) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			writeStatus(w, http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+			return
+		}
+		writeJSON(w, http.StatusOK, Deployment{Metadata: ObjectMeta{Name: "janus"}})
+	}))
+	t.Cleanup(s.Close)
+	return s, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInClusterConfig(t *testing.T) {
+	s, ca := newTLSAPIServer(t, "sa-token")
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "token"), "sa-token\n")
+	writeFile(t, filepath.Join(dir, "ca.crt"), string(ca))
+	writeFile(t, filepath.Join(dir, "namespace"), "analysis")
+
+	defer func(dir string) { serviceAccountDir = dir }(serviceAccountDir)
+	serviceAccountDir = dir
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+	if _, err := InClusterConfig(); !errors.Is(err, ErrNotInCluster) {
+		t.Fatalf("InClusterConfig() error = %v, want %v", err, ErrNotInCluster)
+	}
+
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+	config, err := InClusterConfig()
+	if err != nil {
+		t.Fatalf("InClusterConfig() error = %v", err)
+	}
+	if config.Host != s.URL || config.Namespace != "analysis" {
+		t.Errorf("InClusterConfig() = %+v", config)
+	}
+
+	client, err := config.Client()
+	if err != nil {
+		t.Fatalf("Config.Client() error = %v", err)
+	}
+	if _, err := client.GetDeployment(context.Background(), "", "janus"); err != nil {
+		t.Errorf("Client.GetDeployment() error = %v", err)
+	}
+}
+
+func TestTokenFileReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeFile(t, path, "first")
+	token := TokenFileReloader(path, 20*time.Millisecond)
+
+	if got, err := token(); got != "first" || err != nil {
+		t.Fatalf("token() = %q, %v, want %q", got, err, "first")
+	}
+
+	writeFile(t, path, "rotated")
+	if got, _ := token(); got != "first" {
+		t.Errorf("token() = %q before the reload interval, want %q", got, "first")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got, _ := token(); got != "rotated" {
+		t.Errorf("token() = %q after the reload interval, want %q", got, "rotated")
+	}
+
+	os.Remove(path)
+	time.Sleep(30 * time.Millisecond)
+	if got, err := token(); got != "rotated" || err != nil {
+		t.Errorf("token() = %q, %v once the file is gone, want the previous token", got, err)
+	}
+
+	if _, err := TokenFileReloader(path, time.Minute)(); err == nil {
+		t.Error("token() did not fail with no token file")
+	}
+}
+
+func TestKubeconfigConfig(t *testing.T) {
+	s, ca := newTLSAPIServer(t, "dev-token")
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ca.crt"), string(ca))
+	writeFile(t, filepath.Join(dir, "token"), "dev-token")
+	path := filepath.Join(dir, "config")
+	writeFile(t, path, `apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+- name: local
+  cluster:
+    server: `+s.URL+`
+    certificate-authority: ca.crt
+users:
+- name: admin
+  user:
+    token: prod-token
+- name: developer
+  user:
+    tokenFile: token
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+- name: dev
+  context:
+    cluster: local
+    user: developer
+    namespace: analysis
+`)
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBECONFIG", path+string(filepath.ListSeparator)+"/nonexistent")
+	config, err := NewConfig()
+	if err != nil {
+		t.Fatalf("NewConfig() error = %v", err)
+	}
+	if config.Host != s.URL || config.Namespace != "analysis" || string(config.CAData) != string(ca) {
+		t.Errorf("NewConfig() = %+v", config)
+	}
+
+	client, err := config.Client()
+	if err != nil {
+		t.Fatalf("Config.Client() error = %v", err)
+	}
+	if _, err := client.GetDeployment(context.Background(), "", "janus"); err != nil {
+		t.Errorf("Client.GetDeployment() error = %v", err)
+	}
+
+	writeFile(t, path, "current-context: missing\n")
+	if _, err := KubeconfigConfig(path); err == nil {
+		t.Error("KubeconfigConfig() did not fail with a missing context")
+	}
+}
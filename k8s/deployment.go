@@ -0,0 +1,149 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// RestartedAtAnnotation is the pod template annotation set by
+	// `kubectl rollout restart`.
+	RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	DefaultRolloutPollInterval = 2 * time.Second
+)
+
+// Deployment is the subset of apps/v1 Deployment used by the client.
+type Deployment struct {
+	Metadata ObjectMeta       `json:"metadata"`
+	Spec     DeploymentSpec   `json:"spec"`
+	Status   DeploymentStatus `json:"status"`
+}
+
+type DeploymentSpec struct {
+	// Replicas is the desired number of pods, 1 when nil.
+	Replicas *int32 `json:"replicas,omitempty"`
+	Template struct {
+		Metadata ObjectMeta `json:"metadata"`
+	} `json:"template"`
+}
+
+type DeploymentStatus struct {
+	ObservedGeneration  int64                 `json:"observedGeneration,omitempty"`
+	Replicas            int32                 `json:"replicas,omitempty"`
+	UpdatedReplicas     int32                 `json:"updatedReplicas,omitempty"`
+	ReadyReplicas       int32                 `json:"readyReplicas,omitempty"`
+	AvailableReplicas   int32                 `json:"availableReplicas,omitempty"`
+	UnavailableReplicas int32                 `json:"unavailableReplicas,omitempty"`
+	Conditions          []DeploymentCondition `json:"conditions,omitempty"`
+}
+
+type DeploymentCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// RolloutError is returned by WaitForRollout when the deployment exceeded
+// its progress deadline.
+type RolloutError struct {
+	Namespace string
+	Name      string
+	Message   string
+}
+
+func (e *RolloutError) Error() string {
+	return fmt.Sprintf("rollout of deployment %s/%s failed: %s", e.Namespace, e.Name, e.Message)
+}
+
+// RolledOut reports whether every replica runs the latest pod template, like
+// `kubectl rollout status`. It fails with a *RolloutError once the
+// deployment exceeded its progress deadline.
+func (d *Deployment) RolledOut() (bool, error) {
+	for _, condition := range d.Status.Conditions {
+		if condition.Type == "Progressing" && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, &RolloutError{Namespace: d.Metadata.Namespace, Name: d.Metadata.Name, Message: condition.Message}
+		}
+	}
+	if d.Status.ObservedGeneration < d.Metadata.Generation {
+		return false, nil
+	}
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	return d.Status.UpdatedReplicas >= replicas &&
+		d.Status.Replicas <= d.Status.UpdatedReplicas &&
+		d.Status.AvailableReplicas >= d.Status.UpdatedReplicas, nil
+}
+
+func deploymentPath(namespace, name string) string {
+	return fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", url.PathEscape(namespace), url.PathEscape(name))
+}
+
+// GetDeployment returns the deployment. An empty namespace is the namespace
+// of the client.
+func (c *Client) GetDeployment(ctx context.Context, namespace, name string) (*Deployment, error) {
+	var deployment Deployment
+	if err := c.Do(ctx, http.MethodGet, deploymentPath(c.namespace(namespace), name), "", nil, &deployment); err != nil {
+		return nil, fmt.Errorf("error getting deployment %s: %w", name, err)
+	}
+	return &deployment, nil
+}
+
+// PatchDeployment patches the deployment and returns it updated.
+func (c *Client) PatchDeployment(ctx context.Context, namespace, name string, patchType PatchType, patch []byte) (*Deployment, error) {
+	var deployment Deployment
+	if err := c.Do(ctx, http.MethodPatch, deploymentPath(c.namespace(namespace), name), string(patchType), patch, &deployment); err != nil {
+		return nil, fmt.Errorf("error patching deployment %s: %w", name, err)
+	}
+	return &deployment, nil
+}
+
+// RestartDeployment triggers a rolling restart of the deployment, like
+// `kubectl rollout restart`, by setting RestartedAtAnnotation on its pod
+// template. Use WaitForRollout to wait for the restart to complete.
+func (c *Client) RestartDeployment(ctx context.Context, namespace, name string) (*Deployment, error) {
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		RestartedAtAnnotation, time.Now().Format(time.RFC3339))
+	var deployment Deployment
+	if err := c.Do(ctx, http.MethodPatch, deploymentPath(c.namespace(namespace), name), string(StrategicMergePatch), []byte(patch), &deployment); err != nil {
+		return nil, fmt.Errorf("error restarting deployment %s: %w", name, err)
+	}
+	return &deployment, nil
+}
+
+// WaitForRollout polls the deployment every interval, DefaultRolloutPollInterval
+// when zero, until it is rolled out, it fails with a *RolloutError or ctx is
+// done.
+func (c *Client) WaitForRollout(ctx context.Context, namespace, name string, interval time.Duration) (*Deployment, error) {
+	if interval <= 0 {
+		interval = DefaultRolloutPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deployment, err := c.GetDeployment(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		done, err := deployment.RolledOut()
+		if err != nil {
+			return deployment, err
+		}
+		if done {
+			return deployment, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return deployment, fmt.Errorf("error waiting for rollout of deployment %s: %w", name, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/types"
+)
+
+const (
+	// AnalyzerContainer is the name of the container running the analyzer in
+	// the jobs built by NewAnalysisJob.
+	AnalyzerContainer = "analyzer"
+
+	LabelRunID    = "run-id"
+	LabelCheckSeq = "check-seq"
+	LabelAnalyzer = "analyzer"
+	// LabelJobName is set by Kubernetes on the pods of a job.
+	LabelJobName = "job-name"
+
+	DefaultJobPollInterval = 5 * time.Second
+)
+
+// Job is the subset of batch/v1 Job used by the client.
+type Job struct {
+	APIVersion string     `json:"apiVersion,omitempty"`
+	Kind       string     `json:"kind,omitempty"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       JobSpec    `json:"spec"`
+	Status     JobStatus  `json:"status,omitempty"`
+}
+
+type JobSpec struct {
+	BackoffLimit            *int32          `json:"backoffLimit,omitempty"`
+	ActiveDeadlineSeconds   *int64          `json:"activeDeadlineSeconds,omitempty"`
+	TTLSecondsAfterFinished *int32          `json:"ttlSecondsAfterFinished,omitempty"`
+	Template                PodTemplateSpec `json:"template"`
+}
+
+type PodTemplateSpec struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     PodSpec    `json:"spec"`
+}
+
+type PodSpec struct {
+	RestartPolicy      string                 `json:"restartPolicy,omitempty"`
+	ServiceAccountName string                 `json:"serviceAccountName,omitempty"`
+	NodeSelector       map[string]string      `json:"nodeSelector,omitempty"`
+	ImagePullSecrets   []LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	Containers         []Container            `json:"containers"`
+}
+
+type LocalObjectReference struct {
+	Name string `json:"name"`
+}
+
+type Container struct {
+	Name            string               `json:"name"`
+	Image           string               `json:"image"`
+	ImagePullPolicy string               `json:"imagePullPolicy,omitempty"`
+	Command         []string             `json:"command,omitempty"`
+	Args            []string             `json:"args,omitempty"`
+	Env             []EnvVar             `json:"env,omitempty"`
+	Resources       ResourceRequirements `json:"resources,omitempty"`
+}
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ResourceRequirements maps resource names, like cpu and memory, to
+// quantities, like 500m and 1Gi.
+type ResourceRequirements struct {
+	Limits   map[string]string `json:"limits,omitempty"`
+	Requests map[string]string `json:"requests,omitempty"`
+}
+
+type JobStatus struct {
+	Active         int32          `json:"active,omitempty"`
+	Succeeded      int32          `json:"succeeded,omitempty"`
+	Failed         int32          `json:"failed,omitempty"`
+	StartTime      *time.Time     `json:"startTime,omitempty"`
+	CompletionTime *time.Time     `json:"completionTime,omitempty"`
+	Conditions     []JobCondition `json:"conditions,omitempty"`
+}
+
+type JobCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Finished reports whether the job completed or failed for good, and which.
+func (j *Job) Finished() (finished, succeeded bool, condition JobCondition) {
+	for _, c := range j.Status.Conditions {
+		if c.Status != "True" {
+			continue
+		}
+		switch c.Type {
+		case "Complete":
+			return true, true, c
+		case "Failed":
+			return true, false, c
+		}
+	}
+	return false, false, JobCondition{}
+}
+
+// Pod is the subset of v1 Pod used to collect the exit status of jobs.
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Status   struct {
+		Phase             string            `json:"phase,omitempty"`
+		ContainerStatuses []ContainerStatus `json:"containerStatuses,omitempty"`
+	} `json:"status"`
+}
+
+type ContainerStatus struct {
+	Name  string `json:"name"`
+	State struct {
+		Terminated *ContainerStateTerminated `json:"terminated,omitempty"`
+	} `json:"state"`
+}
+
+type ContainerStateTerminated struct {
+	ExitCode   int32      `json:"exitCode"`
+	Reason     string     `json:"reason,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// JobOpts configures the jobs built by NewAnalysisJob.
+type JobOpts struct {
+	// Namespace of the job. Empty is the namespace of the client.
+	Namespace        string
+	ServiceAccount   string
+	ImagePullSecrets []string
+	NodeSelector     map[string]string
+	// Env is added to the environment of the analyzer, after the variables
+	// describing the run.
+	Env []EnvVar
+	// Labels are added to the job and its pods.
+	Labels map[string]string
+	// BackoffLimit is how many times a failed pod is retried.
+	BackoffLimit int32
+	// ActiveDeadline bounds how long the job may run. Zero means no limit.
+	ActiveDeadline time.Duration
+	// TTLAfterFinished is how long the finished job is kept before
+	// Kubernetes deletes it. Zero keeps it.
+	TTLAfterFinished time.Duration
+}
+
+// NewAnalysisJob renders the job running the analyzer of a check of an
+// analysis run. The job is named after the analyzer, the run and the check,
+// so that submitting it twice is a conflict rather than a second run.
+func NewAnalysisJob(run *types.AnalysisRun, check *types.Check, opts *JobOpts) (*Job, error) {
+	meta := check.AnalyzerMeta
+	if meta.ImagePath == "" {
+		return nil, fmt.Errorf("error building job for check %s: analyzer %s has no image", check.CheckSeq, meta.Shortcode)
+	}
+
+	labels := map[string]string{
+		LabelRunID:    labelValue(run.RunID),
+		LabelCheckSeq: labelValue(check.CheckSeq),
+		LabelAnalyzer: labelValue(meta.Shortcode),
+	}
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+
+	container := Container{
+		Name:  AnalyzerContainer,
+		Image: meta.ImagePath,
+		Env: append([]EnvVar{
+			{Name: "RUN_ID", Value: run.RunID},
+			{Name: "RUN_SERIAL", Value: run.RunSerial},
+			{Name: "CHECK_SEQ", Value: check.CheckSeq},
+			{Name: "ANALYZER", Value: meta.Shortcode},
+			{Name: "ANALYZER_VERSION", Value: meta.Version},
+		}, opts.Env...),
+	}
+	if meta.Command != "" {
+		container.Command = []string{"/bin/sh", "-c", meta.Command}
+	}
+	limits := map[string]string{}
+	if meta.CPULimit != "" {
+		limits["cpu"] = meta.CPULimit
+	}
+	if meta.MemoryLimit != "" {
+		limits["memory"] = meta.MemoryLimit
+	}
+	if len(limits) > 0 {
+		container.Resources.Limits = limits
+	}
+
+	backoffLimit := opts.BackoffLimit
+	job := &Job{
+		APIVersion: "batch/v1",
+		Kind:       "Job",
+		Metadata: ObjectMeta{
+			Name:      jobName(meta.Shortcode, run.RunID, check.CheckSeq),
+			Namespace: opts.Namespace,
+			Labels:    labels,
+		},
+		Spec: JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: PodTemplateSpec{
+				Metadata: ObjectMeta{Labels: labels},
+				Spec: PodSpec{
+					RestartPolicy:      "Never",
+					ServiceAccountName: opts.ServiceAccount,
+					NodeSelector:       opts.NodeSelector,
+					Containers:         []Container{container},
+				},
+			},
+		},
+	}
+	for _, secret := range opts.ImagePullSecrets {
+		job.Spec.Template.Spec.ImagePullSecrets = append(job.Spec.Template.Spec.ImagePullSecrets, LocalObjectReference{Name: secret})
+	}
+	if opts.ActiveDeadline > 0 {
+		seconds := int64(opts.ActiveDeadline / time.Second)
+		job.Spec.ActiveDeadlineSeconds = &seconds
+	}
+	if opts.TTLAfterFinished > 0 {
+		seconds := int32(opts.TTLAfterFinished / time.Second)
+		job.Spec.TTLSecondsAfterFinished = &seconds
+	}
+	return job, nil
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// maxJobNameLength leaves room in the 63 characters of a DNS label for the
+// suffix Kubernetes adds to the names of the pods of a job.
+const maxJobNameLength = 52
+
+// jobName returns a valid job name made of parts. Job names must be DNS
+// labels, and leave room for the suffix of the pod names. A name too long is
+// truncated and suffixed with a hash of the whole name, so that parts sharing
+// a long prefix, like the checks of an analyzer with a long shortcode, still
+// get different names.
+func jobName(parts ...string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(strings.Join(parts, "-")), "-"), "-")
+	if len(name) <= maxJobNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:4])
+	return strings.TrimRight(name[:maxJobNameLength-len(hash)-1], "-") + "-" + hash
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// labelValue returns a valid label value for v.
+func labelValue(v string) string {
+	v = invalidLabelChars.ReplaceAllString(v, "_")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return strings.Trim(v, "._-")
+}
+
+func jobsPath(namespace string) string {
+	return fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", url.PathEscape(namespace))
+}
+
+// CreateJob submits the job. An empty namespace is the namespace of the job,
+// or else of the client.
+func (c *Client) CreateJob(ctx context.Context, job *Job) (*Job, error) {
+	var created Job
+	if err := c.Do(ctx, http.MethodPost, jobsPath(c.namespace(job.Metadata.Namespace)), "", job, &created); err != nil {
+		return nil, fmt.Errorf("error creating job %s: %w", job.Metadata.Name, err)
+	}
+	return &created, nil
+}
+
+func (c *Client) GetJob(ctx context.Context, namespace, name string) (*Job, error) {
+	var job Job
+	if err := c.Do(ctx, http.MethodGet, jobsPath(c.namespace(namespace))+"/"+url.PathEscape(name), "", nil, &job); err != nil {
+		return nil, fmt.Errorf("error getting job %s: %w", name, err)
+	}
+	return &job, nil
+}
+
+// DeleteJob deletes the job along with its pods.
+func (c *Client) DeleteJob(ctx context.Context, namespace, name string) error {
+	body := map[string]string{"kind": "DeleteOptions", "apiVersion": "v1", "propagationPolicy": "Background"}
+	if err := c.Do(ctx, http.MethodDelete, jobsPath(c.namespace(namespace))+"/"+url.PathEscape(name), "", body, nil); err != nil {
+		return fmt.Errorf("error deleting job %s: %w", name, err)
+	}
+	return nil
+}
+
+// ListPods returns the pods matching the label selector.
+func (c *Client) ListPods(ctx context.Context, namespace, labelSelector string) ([]Pod, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", url.PathEscape(c.namespace(namespace)), url.QueryEscape(labelSelector))
+	var list struct {
+		Items []Pod `json:"items"`
+	}
+	if err := c.Do(ctx, http.MethodGet, path, "", nil, &list); err != nil {
+		return nil, fmt.Errorf("error listing pods: %w", err)
+	}
+	return list.Items, nil
+}
+
+// JobResult is the outcome of a finished job.
+type JobResult struct {
+	Job       *Job
+	Succeeded bool
+	// Reason and Message describe why the job failed, like
+	// BackoffLimitExceeded or DeadlineExceeded.
+	Reason  string
+	Message string
+	// ExitCode is the exit code of the last run of the analyzer, -1 when no
+	// run terminated.
+	ExitCode int32
+}
+
+// LaunchJob submits the job and waits for it to finish. A job already
+// submitted, with the same name, is waited for instead of failing.
+func (c *Client) LaunchJob(ctx context.Context, job *Job, interval time.Duration) (*JobResult, error) {
+	created, err := c.CreateJob(ctx, job)
+	if IsConflict(err) {
+		return c.WaitForJob(ctx, job.Metadata.Namespace, job.Metadata.Name, interval)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.WaitForJob(ctx, job.Metadata.Namespace, created.Metadata.Name, interval)
+}
+
+// WaitForJob polls the job every interval, DefaultJobPollInterval when zero,
+// until it finishes or ctx is done, and collects the exit status of its last
+// pod. A failed job is not an error, see JobResult.Succeeded.
+func (c *Client) WaitForJob(ctx context.Context, namespace, name string, interval time.Duration) (*JobResult, error) {
+	if interval <= 0 {
+		interval = DefaultJobPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		job, err := c.GetJob(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if finished, succeeded, condition := job.Finished(); finished {
+			result := &JobResult{
+				Job:       job,
+				Succeeded: succeeded,
+				Reason:    condition.Reason,
+				Message:   condition.Message,
+				ExitCode:  -1,
+			}
+			pods, err := c.ListPods(ctx, namespace, LabelJobName+"="+name)
+			if err != nil {
+				return result, err
+			}
+			if terminated := lastTerminated(pods); terminated != nil {
+				result.ExitCode = terminated.ExitCode
+				if result.Message == "" {
+					result.Message = terminated.Message
+				}
+			}
+			return result, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error waiting for job %s: %w", name, ctx.Err())
+		}
+	}
+}
+
+// lastTerminated returns the state of the analyzer container that terminated
+// last among the pods.
+func lastTerminated(pods []Pod) *ContainerStateTerminated {
+	var last *ContainerStateTerminated
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			terminated := status.State.Terminated
+			if status.Name != AnalyzerContainer || terminated == nil {
+				continue
+			}
+			if last == nil || (terminated.FinishedAt != nil && (last.FinishedAt == nil || terminated.FinishedAt.After(*last.FinishedAt))) {
+				last = terminated
+			}
+		}
+	}
+	return last
+}
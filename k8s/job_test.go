@@ -0,0 +1,201 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/types"
+)
+
+func testRun() (*types.AnalysisRun, *types.Check) {
+	check := types.Check{
+		CheckSeq: "2",
+		AnalyzerMeta: types.AnalyzerMeta{
+			Shortcode:   "python",
+			ImagePath:   "registry.example.com/analyzers/python:v1",
+			Command:     "/toolbox/analyze --check 2",
+			Version:     "v1",
+			CPULimit:    "500m",
+			MemoryLimit: "1Gi",
+		},
+	}
+	run := &types.AnalysisRun{RunID: "8C3B5E4A-run", RunSerial: "14", Checks: []types.Check{check}}
+	return run, &run.Checks[0]
+}
+
+func TestNewAnalysisJob(t *testing.T) {
+	run, check := testRun()
+	job, err := NewAnalysisJob(run, check, &JobOpts{
+		Namespace:        "analysis",
+		ImagePullSecrets: []string{"registry"},
+		Env:              []EnvVar{{Name: "LOG_LEVEL", Value: "debug"}},
+		Labels:           map[string]string{"team": "analysis"},
+		BackoffLimit:     1,
+		ActiveDeadline:   30 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewAnalysisJob() error = %v", err)
+	}
+
+	if job.Metadata.Name != "python-8c3b5e4a-run-2" || job.Metadata.Namespace != "analysis" {
+		t.Errorf("job metadata = %+v", job.Metadata)
+	}
+	wantLabels := map[string]string{LabelRunID: "8C3B5E4A-run", LabelCheckSeq: "2", LabelAnalyzer: "python", "team": "analysis"}
+	if !reflect.DeepEqual(job.Metadata.Labels, wantLabels) || !reflect.DeepEqual(job.Spec.Template.Metadata.Labels, wantLabels) {
+		t.Errorf("labels = %v and %v, want %v", job.Metadata.Labels, job.Spec.Template.Metadata.Labels, wantLabels)
+	}
+	if *job.Spec.BackoffLimit != 1 || *job.Spec.ActiveDeadlineSeconds != 1800 || job.Spec.TTLSecondsAfterFinished != nil {
+		t.Errorf("job spec = %+v", job.Spec)
+	}
+
+	pod := job.Spec.Template.Spec
+	if pod.RestartPolicy != "Never" || len(pod.ImagePullSecrets) != 1 || pod.ImagePullSecrets[0].Name != "registry" {
+		t.Errorf("pod spec = %+v", pod)
+	}
+	if len(pod.Containers) != 1 {
+		t.Fatalf("got %d containers, want 1", len(pod.Containers))
+	}
+	c := pod.Containers[0]
+	if c.Name != AnalyzerContainer || c.Image != check.AnalyzerMeta.ImagePath {
+		t.Errorf("container = %+v", c)
+	}
+	if want := []string{"/bin/sh", "-c", "/toolbox/analyze --check 2"}; !reflect.DeepEqual(c.Command, want) {
+		t.Errorf("container command = %q, want %q", c.Command, want)
+	}
+	if want := map[string]string{"cpu": "500m", "memory": "1Gi"}; !reflect.DeepEqual(c.Resources.Limits, want) {
+		t.Errorf("container limits = %v, want %v", c.Resources.Limits, want)
+	}
+	if last := c.Env[len(c.Env)-1]; last.Name != "LOG_LEVEL" || c.Env[0].Name != "RUN_ID" || c.Env[0].Value != run.RunID {
+		t.Errorf("container env = %+v", c.Env)
+	}
+
+	check.AnalyzerMeta.ImagePath = ""
+	if _, err := NewAnalysisJob(run, check, &JobOpts{}); err == nil {
+		t.Error("NewAnalysisJob() did not fail without an image")
+	}
+}
+
+func TestJobName(t *testing.T) {
+	tests := map[string][]string{
+		"python-run-1":          {"python", "run", "1"},
+		"test-coverage-ab-cd-3": {"test_coverage", "AB/CD", "3"},
+	}
+	for want, parts := range tests {
+		if got := jobName(parts...); got != want {
+			t.Errorf("jobName(%q) = %q, want %q", parts, got, want)
+		}
+	}
+}
+
+func TestJobName_Truncated(t *testing.T) {
+	shortcode := "a-very-long-analyzer-shortcode-from-the-marketplace"
+	names := map[string]bool{}
+	for _, checkSeq := range []string{"1", "10", "11", "110"} {
+		name := jobName(shortcode, "8C3B5E4A-run", checkSeq)
+		if len(name) > maxJobNameLength {
+			t.Errorf("jobName() = %q, longer than %d characters", name, maxJobNameLength)
+		}
+		if !strings.HasPrefix(name, shortcode[:20]) || strings.HasSuffix(name, "-") {
+			t.Errorf("jobName() = %q", name)
+		}
+		if names[name] {
+			t.Errorf("jobName() = %q for check %s, already used by another check", name, checkSeq)
+		}
+		names[name] = true
+	}
+
+	if jobName(shortcode, "run", "10") != jobName(shortcode, "run", "10") {
+		t.Error("jobName() is not stable")
+	}
+}
+
+func TestClient_LaunchJob(t *testing.T) {
+	run, check := testRun()
+	job, _ := NewAnalysisJob(run, check, &JobOpts{Namespace: "analysis"})
+	jobPath := "/apis/batch/v1/namespaces/analysis/jobs/" + job.Metadata.Name
+	finishedAt := time.Now()
+
+	terminated := func(exitCode int32, finishedAt time.Time) Pod {
+		var pod Pod
+		pod.Status.ContainerStatuses = []ContainerStatus{{Name: AnalyzerContainer}}
+		pod.Status.ContainerStatuses[0].State.Terminated = &ContainerStateTerminated{ExitCode: exitCode, FinishedAt: &finishedAt}
+		return pod
+	}
+
+	tests := []struct {
+		name          string
+		created       bool
+		conditions    []JobCondition
+		pods          []Pod
+		wantSucceeded bool
+		wantExitCode  int32
+		wantReason    string
+	}{
+		{
+			name:          "succeeded",
+			conditions:    []JobCondition{{Type: "Complete", Status: "True"}},
+			pods:          []Pod{terminated(0, finishedAt)},
+			wantSucceeded: true,
+		},
+		{
+			name:         "failed",
+			conditions:   []JobCondition{{Type: "Failed", Status: "True", Reason: "BackoffLimitExceeded"}},
+			pods:         []Pod{terminated(1, finishedAt.Add(-time.Minute)), terminated(137, finishedAt)},
+			wantExitCode: 137,
+			wantReason:   "BackoffLimitExceeded",
+		},
+		{
+			name:          "already submitted",
+			created:       true,
+			conditions:    []JobCondition{{Type: "Complete", Status: "True"}},
+			pods:          []Pod{terminated(0, finishedAt)},
+			wantSucceeded: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMockAPIServer(t)
+			s.handle(http.MethodPost, "/apis/batch/v1/namespaces/analysis/jobs", func(w http.ResponseWriter, r *http.Request) {
+				if tt.created {
+					writeStatus(w, http.StatusConflict, "AlreadyExists", "jobs already exists")
+					return
+				}
+				var submitted Job
+				json.NewDecoder(r.Body).Decode(&submitted)
+				writeJSON(w, http.StatusCreated, submitted)
+			})
+			polls := 0
+			s.handle(http.MethodGet, jobPath, func(w http.ResponseWriter, r *http.Request) {
+				// The job runs for a poll before finishing.
+				current := *job
+				if polls++; polls > 1 {
+					current.Status.Conditions = tt.conditions
+				}
+				writeJSON(w, http.StatusOK, current)
+			})
+			s.handle(http.MethodGet, "/api/v1/namespaces/analysis/pods", func(w http.ResponseWriter, r *http.Request) {
+				if got := r.URL.Query().Get("labelSelector"); got != LabelJobName+"="+job.Metadata.Name {
+					t.Errorf("labelSelector = %q", got)
+				}
+				writeJSON(w, http.StatusOK, map[string]interface{}{"items": tt.pods})
+			})
+
+			result, err := s.client().LaunchJob(context.Background(), job, time.Millisecond)
+			if err != nil {
+				t.Fatalf("Client.LaunchJob() error = %v", err)
+			}
+			if result.Succeeded != tt.wantSucceeded || result.ExitCode != tt.wantExitCode || result.Reason != tt.wantReason {
+				t.Errorf("Client.LaunchJob() = %+v", result)
+			}
+			if polls != 2 {
+				t.Errorf("polled %d times, want 2", polls)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	PublisherTypeMulti = "multi"
+)
+
+// Config describes a publisher and the middleware it is wrapped with. The
+// mapstructure tags make it loadable with viper:
+//
+//	var cfg publisher.Config
+//	if err := viper.UnmarshalKey("app.publisher", &cfg); err != nil {
+//		return err
+//	}
+//	p, closer, err := publisher.FromConfig(ctx, &cfg)
+//	if err != nil {
+//		return err
+//	}
+//	defer closer.Close()
+//
+// Only the section matching Type is used.
+type Config struct {
+	Type     string       `mapstructure:"type"`
+	HTTP     HTTPOpts     `mapstructure:"http"`
+	RabbitMQ RabbitMQOpts `mapstructure:"rabbitmq"`
+	NATS     NATSOpts     `mapstructure:"nats"`
+	Kafka    KafkaOpts    `mapstructure:"kafka"`
+	Multi    MultiConfig  `mapstructure:"multi"`
+
+	// Timeout bounds every publish attempt. Zero means no timeout.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Retry retries failed publishes. Nil disables retries.
+	Retry *RetryConfig `mapstructure:"retry"`
+	// Outbox persists payloads before publishing them. Nil disables the
+	// outbox.
+	Outbox *OutboxConfig `mapstructure:"outbox"`
+}
+
+type MultiConfig struct {
+	Policy        string              `mapstructure:"policy"`
+	Destinations  []DestinationConfig `mapstructure:"destinations"`
+	ShadowTimeout time.Duration       `mapstructure:"shadow_timeout"`
+}
+
+type DestinationConfig struct {
+	Name   string `mapstructure:"name"`
+	Config `mapstructure:",squash"`
+}
+
+type RetryConfig struct {
+	Attempts int           `mapstructure:"attempts"`
+	Delay    time.Duration `mapstructure:"delay"`
+}
+
+type OutboxConfig struct {
+	Path          string        `mapstructure:"path"`
+	RetryInterval time.Duration `mapstructure:"retry_interval"`
+}
+
+// ConfigError is a validation error of a single config field.
+type ConfigError struct {
+	Field string
+	Msg   string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid publisher config: %s: %s", e.Field, e.Msg)
+}
+
+// Validate checks the config and returns every problem found, joined. Each of
+// them is a *ConfigError.
+func (c *Config) Validate() error {
+	return errors.Join(c.validate("")...)
+}
+
+func (c *Config) validate(prefix string) []error {
+	var errs []error
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Field: prefix + field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	switch c.Type {
+	case "":
+		invalid("type", "is required")
+	case PublisherTypeHTTP:
+		if c.HTTP.URL == "" {
+			invalid("http.url", "is required")
+		}
+		switch c.HTTP.MaskingMode {
+		case "", MaskingModeNone, MaskingModeSimple, MaskingModeEncrypted:
+		default:
+			invalid("http.masking_mode", "must be one of %q, %q or %q, got %q",
+				MaskingModeNone, MaskingModeSimple, MaskingModeEncrypted, c.HTTP.MaskingMode)
+		}
+		if c.HTTP.Timeout < 0 {
+			invalid("http.timeout", "must not be negative")
+		}
+	case PublisherTypeRabbitMQ:
+		if c.RabbitMQ.URL == "" {
+			invalid("rabbitmq.url", "is required")
+		}
+		if c.RabbitMQ.Exchange == "" {
+			invalid("rabbitmq.exchange", "is required")
+		}
+	case PublisherTypeNATS:
+		if c.NATS.URL == "" {
+			invalid("nats.url", "is required")
+		}
+		if c.NATS.Subject == "" {
+			invalid("nats.subject", "is required")
+		}
+	case PublisherTypeKafka:
+		if len(c.Kafka.Brokers) == 0 {
+			invalid("kafka.brokers", "at least one broker is required")
+		}
+		if c.Kafka.Topic == "" {
+			invalid("kafka.topic", "is required")
+		}
+	case PublisherTypeMulti:
+		switch c.Multi.Policy {
+		case "", MultiPolicyAll, MultiPolicyAny, MultiPolicyPrimary:
+		default:
+			invalid("multi.policy", "must be one of %q, %q or %q, got %q",
+				MultiPolicyAll, MultiPolicyAny, MultiPolicyPrimary, c.Multi.Policy)
+		}
+		if len(c.Multi.Destinations) == 0 {
+			invalid("multi.destinations", "at least one destination is required")
+		}
+		names := map[string]bool{}
+		for i := range c.Multi.Destinations {
+			d := &c.Multi.Destinations[i]
+			field := fmt.Sprintf("multi.destinations[%d]", i)
+			if d.Name == "" {
+				invalid(field+".name", "is required")
+			} else if names[d.Name] {
+				invalid(field+".name", "duplicate destination %q", d.Name)
+			}
+			names[d.Name] = true
+			if d.Outbox != nil {
+				invalid(field+".outbox", "is only supported on the top level publisher")
+			}
+			errs = append(errs, d.validate(prefix+field+".")...)
+		}
+	default:
+		invalid("type", "must be one of %q, %q, %q, %q or %q, got %q",
+			PublisherTypeHTTP, PublisherTypeRabbitMQ, PublisherTypeNATS, PublisherTypeKafka, PublisherTypeMulti, c.Type)
+	}
+
+	if c.Timeout < 0 {
+		invalid("timeout", "must not be negative")
+	}
+	if c.Retry != nil {
+		if c.Retry.Attempts < 1 {
+			invalid("retry.attempts", "must be at least 1, got %d", c.Retry.Attempts)
+		}
+		if c.Retry.Delay < 0 {
+			invalid("retry.delay", "must not be negative")
+		}
+	}
+	if c.Outbox != nil {
+		if c.Outbox.Path == "" {
+			invalid("outbox.path", "is required")
+		}
+		if c.Outbox.RetryInterval < 0 {
+			invalid("outbox.retry_interval", "must not be negative")
+		}
+	}
+	return errs
+}
+
+// FromConfig validates the config and returns a ready Publisher. The
+// publisher is wrapped, from the outermost, with the given middlewares, the
+// outbox, the retries and the timeout. When the outbox is enabled and no
+// middleware is given, the returned Publisher is an *Outbox, which should be
+// drained on shutdown.
+//
+// The returned io.Closer closes everything FromConfig opened: the outbox, the
+// shadow publishes of multi publishers and the connections to the brokers,
+// in that order. It must be called once the Publisher is not used anymore.
+func FromConfig(ctx context.Context, cfg *Config, middlewares ...Middleware) (Publisher, io.Closer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	// The publishers built so far are closed if a later one cannot be built,
+	// so that their connections are not leaked.
+	var built closers
+	p, err := newFromConfig(ctx, cfg, &built)
+	if err != nil {
+		built.closeAndLog()
+		return nil, nil, err
+	}
+
+	if cfg.Outbox != nil {
+		outbox, err := NewOutbox(ctx, &OutboxOpts{
+			Path:          cfg.Outbox.Path,
+			Publisher:     p,
+			RetryInterval: cfg.Outbox.RetryInterval,
+		})
+		if err != nil {
+			built.closeAndLog()
+			return nil, nil, err
+		}
+		built = append(built, outbox)
+		p = outbox
+	}
+	return Chain(p, middlewares...), built, nil
+}
+
+// newFromConfig builds the publisher wrapped with its retries and timeout.
+// Every publisher built that holds connections or goroutines is appended to
+// built, after the ones it wraps.
+func newFromConfig(ctx context.Context, cfg *Config, built *closers) (Publisher, error) {
+	var (
+		p   Publisher
+		err error
+	)
+	switch cfg.Type {
+	case PublisherTypeHTTP:
+		opts := cfg.HTTP
+		p = NewHTTPPublisher(&opts)
+	case PublisherTypeRabbitMQ:
+		opts := cfg.RabbitMQ
+		p = NewRabbitMQPublisher(ctx, &opts)
+	case PublisherTypeNATS:
+		opts := cfg.NATS
+		p, err = NewNATSPublisher(&opts)
+	case PublisherTypeKafka:
+		opts := cfg.Kafka
+		p, err = NewKafkaPublisher(&opts)
+	case PublisherTypeMulti:
+		p, err = newMultiFromConfig(ctx, &cfg.Multi, built)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s publisher: %w", cfg.Type, err)
+	}
+	if c, ok := p.(io.Closer); ok {
+		*built = append(*built, c)
+	}
+
+	var middlewares []Middleware
+	if cfg.Retry != nil {
+		middlewares = append(middlewares, WithRetry(cfg.Retry.Attempts, cfg.Retry.Delay))
+	}
+	if cfg.Timeout > 0 {
+		middlewares = append(middlewares, WithTimeout(cfg.Timeout))
+	}
+	return Chain(p, middlewares...), nil
+}
+
+func newMultiFromConfig(ctx context.Context, cfg *MultiConfig, built *closers) (Publisher, error) {
+	destinations := make([]Destination, 0, len(cfg.Destinations))
+	for i := range cfg.Destinations {
+		d := &cfg.Destinations[i]
+		p, err := newFromConfig(ctx, &d.Config, built)
+		if err != nil {
+			return nil, fmt.Errorf("destination %q: %w", d.Name, err)
+		}
+		destinations = append(destinations, Destination{Name: d.Name, Publisher: p})
+	}
+
+	return NewMultiPublisher(&MultiOpts{
+		Policy:        cfg.Policy,
+		Destinations:  destinations,
+		ShadowTimeout: cfg.ShadowTimeout,
+	})
+}
+
+// closers closes publishers in the reverse order they were built, so that
+// the wrapping ones are closed before the ones they publish through.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []error
+	for i := len(c) - 1; i >= 0; i-- {
+		if err := c[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c closers) closeAndLog() {
+	if err := c.Close(); err != nil {
+		log.Println("error while closing publisher", err)
+	}
+}
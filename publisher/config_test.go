@@ -0,0 +1,259 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func loadTestConfig(t *testing.T, yaml string) *Config {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	if err := v.UnmarshalKey("publisher", &cfg); err != nil {
+		t.Fatalf("viper.UnmarshalKey() error = %v", err)
+	}
+	return &cfg
+}
+
+func TestConfig_Viper(t *testing.T) {
+	cfg := loadTestConfig(t, `
+publisher:
+  type: multi
+  timeout: 5s
+  multi:
+    policy: primary
+    destinations:
+      - name: rmq
+        type: rabbitmq
+        rabbitmq:
+          url: amqp://localhost:5672/
+          exchange: celery
+          routing_key: celery
+          compress: true
+      - name: asgard
+        type: http
+        http:
+          url: http://localhost:8080
+          masking_mode: simple
+          timeout: 10s
+        retry:
+          attempts: 3
+          delay: 1s
+`)
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Config.Validate() error = %v", err)
+	}
+	if cfg.Timeout != 5*time.Second || cfg.Multi.Policy != MultiPolicyPrimary {
+		t.Errorf("Config timeout = %v, policy = %v", cfg.Timeout, cfg.Multi.Policy)
+	}
+	rmq, asgard := cfg.Multi.Destinations[0], cfg.Multi.Destinations[1]
+	if rmq.RabbitMQ.RoutingKey != "celery" || !rmq.RabbitMQ.Compress {
+		t.Errorf("Config rabbitmq destination = %+v", rmq.RabbitMQ)
+	}
+	if asgard.HTTP.MaskingMode != MaskingModeSimple || asgard.HTTP.Timeout != 10*time.Second {
+		t.Errorf("Config http destination = %+v", asgard.HTTP)
+	}
+	if asgard.Retry == nil || asgard.Retry.Attempts != 3 || asgard.Retry.Delay != time.Second {
+		t.Errorf("Config http destination retry = %+v", asgard.Retry)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := &Config{
+		Type: PublisherTypeMulti,
+		Multi: MultiConfig{
+			Policy: "some",
+			Destinations: []DestinationConfig{
+				{Name: "rmq", Config: Config{Type: PublisherTypeRabbitMQ}},
+				{Name: "rmq", Config: Config{Type: PublisherTypeHTTP, HTTP: HTTPOpts{URL: "http://localhost"}, Outbox: &OutboxConfig{Path: "outbox"}}},
+				{Name: "sqs", Config: Config{Type: "sqs"}},
+			},
+		},
+		Retry: &RetryConfig{},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Config.Validate() expected error")
+	}
+	wantFields := []string{
+		"multi.policy",
+		"multi.destinations[0].rabbitmq.url",
+		"multi.destinations[0].rabbitmq.exchange",
+		"multi.destinations[1].name",
+		"multi.destinations[1].outbox",
+		"multi.destinations[2].type",
+		"retry.attempts",
+	}
+	for _, field := range wantFields {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Config.Validate() error does not mention %s: %v", field, err)
+		}
+	}
+
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Errorf("Config.Validate() error = %T, want to wrap *ConfigError", err)
+	}
+
+	if _, _, err := FromConfig(context.Background(), cfg); err == nil {
+		t.Error("FromConfig() expected error for invalid config")
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to exercise the retry middleware.
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		Type:    PublisherTypeHTTP,
+		HTTP:    HTTPOpts{URL: server.URL},
+		Timeout: time.Second,
+		Retry:   &RetryConfig{Attempts: 2, Delay: time.Millisecond},
+	}
+
+	var seen int32
+	counting := func(next Publisher) Publisher {
+		return PublisherFunc(func(ctx context.Context, payload Payload) error {
+			atomic.AddInt32(&seen, 1)
+			return next.Publish(ctx, payload)
+		})
+	}
+
+	p, closer, err := FromConfig(context.Background(), cfg, counting)
+	if err != nil {
+		t.Fatalf("FromConfig() error = %v", err)
+	}
+	defer closer.Close()
+	if err := p.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if atomic.LoadInt32(&seen) != 1 || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("middleware saw %d payloads and server %d requests, want 1 and 2", seen, requests)
+	}
+
+	// Without middlewares the outbox is returned as is.
+	cfg.Outbox = &OutboxConfig{Path: filepath.Join(t.TempDir(), "outbox")}
+	p, closer, err = FromConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("FromConfig() error = %v", err)
+	}
+	outbox, ok := p.(*Outbox)
+	if !ok {
+		t.Fatalf("FromConfig() = %T, want *Outbox", p)
+	}
+	defer closer.Close()
+
+	if err := outbox.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("Outbox.Publish() error = %v", err)
+	}
+	drain(t, outbox)
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("server received %d requests, want 3", requests)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	mock := &MockPublisher{failures: 2}
+	p := Chain(mock, WithRetry(3, time.Millisecond))
+	if err := p.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if len(mock.Published()) != 1 {
+		t.Errorf("Publish() delivered %d payloads, want 1", len(mock.Published()))
+	}
+
+	mock = &MockPublisher{failures: alwaysFail}
+	p = Chain(mock, WithRetry(2, time.Millisecond))
+	if err := p.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err == nil {
+		t.Error("Publish() expected error after exhausting retries")
+	}
+}
+
+func TestFromConfig_ClosesBuiltDestinations(t *testing.T) {
+	s := runNATSServer(t)
+	cfg := &Config{
+		Type: PublisherTypeMulti,
+		Multi: MultiConfig{Destinations: []DestinationConfig{
+			{Name: "nats", Config: Config{Type: PublisherTypeNATS, NATS: NATSOpts{URL: s.ClientURL(), Subject: "results"}}},
+			{Name: "down", Config: Config{Type: PublisherTypeNATS, NATS: NATSOpts{URL: "nats://127.0.0.1:1", Subject: "results"}}},
+		}},
+	}
+
+	if _, _, err := FromConfig(context.Background(), cfg); err == nil {
+		t.Fatal("FromConfig() expected error for unreachable destination")
+	}
+
+	// The connection of the first destination is closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.NumClients() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server has %d clients left, want 0", s.NumClients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFromConfig_Close(t *testing.T) {
+	s := runNATSServer(t)
+	nats := Config{Type: PublisherTypeNATS, NATS: NATSOpts{URL: s.ClientURL(), Subject: "results"}}
+	cfg := &Config{
+		Type: PublisherTypeMulti,
+		Multi: MultiConfig{
+			Policy: MultiPolicyPrimary,
+			Destinations: []DestinationConfig{
+				{Name: "primary", Config: nats},
+				{Name: "shadow", Config: nats},
+			},
+		},
+		Retry:  &RetryConfig{Attempts: 2, Delay: time.Millisecond},
+		Outbox: &OutboxConfig{Path: filepath.Join(t.TempDir(), "outbox")},
+	}
+
+	p, closer, err := FromConfig(context.Background(), cfg, WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("FromConfig() error = %v", err)
+	}
+	if err := p.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if s.NumClients() != 2 {
+		t.Fatalf("server has %d clients, want 2", s.NumClients())
+	}
+
+	if err := closer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.NumClients() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server has %d clients left after Close, want 0", s.NumClients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := p.Publish(context.Background(), &MockPayload{payload: []byte("test")}); !errors.Is(err, ErrOutboxClosed) {
+		t.Errorf("Publish() after Close error = %v, want %v", err, ErrOutboxClosed)
+	}
+}
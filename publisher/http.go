@@ -5,7 +5,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
+
+	"github.com/deepcode-ai/artifacts/trace"
 )
 
 const (
@@ -28,10 +31,10 @@ type HTTPPublisher struct {
 }
 
 type HTTPOpts struct {
-	URL         string
-	MaskingMode string
-	Token       string
-	Timeout     time.Duration
+	URL         string        `mapstructure:"url"`
+	MaskingMode string        `mapstructure:"masking_mode"`
+	Token       string        `mapstructure:"token"`
+	Timeout     time.Duration `mapstructure:"timeout"`
 }
 
 func NewHTTPPublisher(opts *HTTPOpts) Publisher {
@@ -54,7 +57,19 @@ func NewHTTPPublisher(opts *HTTPOpts) Publisher {
 
 // Publish sends the payload to the configured URL.
 // TODO: Add backoff and retry logic.
-func (h *HTTPPublisher) Publish(ctx context.Context, payload Payload) error {
+func (h *HTTPPublisher) Publish(ctx context.Context, payload Payload) (err error) {
+	// The span name is fixed and the URL is left out of the attributes, so
+	// that the tokens its query string may carry are not exported.
+	ctx, span := trace.Start(ctx, "http.publish", trace.SpanKindClient)
+	span.SetAttribute("http.method", http.MethodPost)
+	if u, err := url.Parse(h.URL); err == nil {
+		span.SetAttribute("http.host", u.Host)
+	}
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	body, err := payload.Bytes()
 	if err != nil {
 		return err
@@ -67,6 +82,7 @@ func (h *HTTPPublisher) Publish(ctx context.Context, payload Payload) error {
 	if h.Token != "" {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.Token))
 	}
+	trace.Inject(ctx, trace.HeaderCarrier(req.Header))
 
 	res, err := h.HTTPClient.Do(req)
 	if err != nil {
@@ -8,6 +8,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/deepcode-ai/artifacts/trace"
 )
 
 func TestNewHTTPPublisher(t *testing.T) {
@@ -242,3 +244,41 @@ func TestHTTPPublisher_Publish(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPPublisher_PublishTraceContext(t *testing.T) {
+	exporter := &trace.InMemoryExporter{}
+	trace.SetDefault(trace.NewTracer(exporter))
+	defer trace.SetDefault(trace.NewTracer(nil))
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(trace.TraceparentHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	h := NewHTTPPublisher(&HTTPOpts{URL: server.URL + "/results?token=secret"})
+	ctx, parent := trace.Start(context.Background(), "handle", trace.SpanKindInternal)
+	if err := h.Publish(ctx, &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("HTTPPublisher.Publish() error = %v", err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Kind != trace.SpanKindClient || spans[0].Name != "http.publish" {
+		t.Fatalf("exported spans %+v, want an http.publish client span", spans)
+	}
+	if host := strings.TrimPrefix(server.URL, "http://"); spans[0].Attributes["http.host"] != host {
+		t.Errorf("http.host = %v, want %s", spans[0].Attributes["http.host"], host)
+	}
+	for key, value := range spans[0].Attributes {
+		if strings.Contains(value, "secret") {
+			t.Errorf("span attribute %s = %v leaks the query string", key, value)
+		}
+	}
+	if spans[0].Parent != parent.SpanContext() {
+		t.Errorf("client span parent = %+v, want %+v", spans[0].Parent, parent.SpanContext())
+	}
+	if !strings.Contains(traceparent, spans[0].SpanContext.SpanID.String()) {
+		t.Errorf("HTTPPublisher.Publish() propagated %q, want the client span %+v", traceparent, spans[0].SpanContext)
+	}
+}
@@ -0,0 +1,105 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/deepcode-ai/artifacts/trace/carriers"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	PublisherTypeKafka = "kafka"
+)
+
+const (
+	KafkaMaxAttempts  = 5                // Max number of attempts to deliver a message
+	KafkaWriteTimeout = 10 * time.Second // Timeout for each write to the brokers
+)
+
+type KafkaOpts struct {
+	Brokers  []string `mapstructure:"brokers"`
+	Topic    string   `mapstructure:"topic"`
+	Compress bool     `mapstructure:"compress"`
+}
+
+// kafkaWriter is the subset of *kafka.Writer used by the Kafka publisher.
+type kafkaWriter interface {
+	WriteMessages(context.Context, ...kafka.Message) error
+	Close() error
+}
+
+type Kafka struct {
+	writer   kafkaWriter
+	topic    string
+	compress bool
+}
+
+func NewKafkaPublisher(opts *KafkaOpts) (Publisher, error) {
+	if len(opts.Brokers) == 0 {
+		return nil, errors.New("at least one kafka broker is required")
+	}
+	if opts.Topic == "" {
+		return nil, errors.New("kafka topic is required")
+	}
+
+	return &Kafka{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(opts.Brokers...),
+			Topic:        opts.Topic,
+			Balancer:     &kafka.LeastBytes{},
+			MaxAttempts:  KafkaMaxAttempts,
+			WriteTimeout: KafkaWriteTimeout,
+			RequiredAcks: kafka.RequireAll,
+		},
+		topic:    opts.Topic,
+		compress: opts.Compress,
+	}, nil
+}
+
+// Publish writes the payload to the configured topic and waits for every
+// in-sync replica to acknowledge it.
+func (k *Kafka) Publish(ctx context.Context, payload Payload) (err error) {
+	ctx, span := trace.Start(ctx, "publish "+k.topic, trace.SpanKindProducer)
+	span.SetAttribute("messaging.system", PublisherTypeKafka)
+	span.SetAttribute("messaging.destination", k.topic)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	body, err := payload.Bytes()
+	if err != nil {
+		log.Println("error while compressing payload before publishing to Kafka", err)
+		return err
+	}
+
+	message := kafka.Message{
+		Value: body,
+		Headers: []kafka.Header{
+			{Key: "Content-Type", Value: []byte(RabbitMQContentType)},
+		},
+	}
+	if k.compress {
+		message.Headers = append(message.Headers, kafka.Header{
+			Key:   RabbitMQCompressionHeader,
+			Value: []byte(RabbitMQCompressionZstd),
+		})
+	}
+	// The trace context is propagated to the consumers in the headers.
+	trace.Inject(ctx, (*carriers.Kafka)(&message.Headers))
+
+	if err := k.writer.WriteMessages(ctx, message); err != nil {
+		log.Println("error while publishing to Kafka", err)
+		return err
+	}
+	return nil
+}
+
+// Close flushes pending writes and closes the connections to the brokers.
+func (k *Kafka) Close() error {
+	return k.writer.Close()
+}
@@ -0,0 +1,291 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/deepcode-ai/artifacts/trace/carriers"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+type MockKafkaWriter struct {
+	err      error
+	messages []kafka.Message
+}
+
+func (w *MockKafkaWriter) WriteMessages(_ context.Context, messages ...kafka.Message) error {
+	w.messages = append(w.messages, messages...)
+	return w.err
+}
+
+func (*MockKafkaWriter) Close() error {
+	return nil
+}
+
+func TestKafka_Publish(t *testing.T) {
+	tests := []struct {
+		name     string
+		writer   *MockKafkaWriter
+		payload  Payload
+		compress bool
+		wantErr  bool
+	}{
+		{
+			name:    "success",
+			writer:  &MockKafkaWriter{},
+			payload: &MockPayload{payload: []byte("test")},
+		},
+		{
+			name:     "compressed payload",
+			writer:   &MockKafkaWriter{},
+			payload:  &MockPayload{payload: []byte("test")},
+			compress: true,
+		},
+		{
+			name:    "uncompressible payload",
+			writer:  &MockKafkaWriter{},
+			payload: &MockPayload{err: errors.New("test-error")},
+			wantErr: true,
+		},
+		{
+			name:    "error writing",
+			writer:  &MockKafkaWriter{err: errors.New("test-error")},
+			payload: &MockPayload{payload: []byte("test")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &Kafka{writer: tt.writer, compress: tt.compress}
+			err := k.Publish(context.Background(), tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Kafka.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(tt.writer.messages) != 1 || string(tt.writer.messages[0].Value) != "test" {
+				t.Fatalf("Kafka.Publish() wrote %v, want a single %q message", tt.writer.messages, "test")
+			}
+			var compressed bool
+			for _, h := range tt.writer.messages[0].Headers {
+				if h.Key == RabbitMQCompressionHeader && string(h.Value) == RabbitMQCompressionZstd {
+					compressed = true
+				}
+			}
+			if compressed != tt.compress {
+				t.Errorf("Kafka.Publish() compression header = %v, want %v", compressed, tt.compress)
+			}
+		})
+	}
+}
+
+// MockKafkaBroker is an in-process stand-in for a single node Kafka cluster.
+// It speaks the Kafka wire protocol over TCP, serves a single partition of the
+// results topic and records the produced messages.
+type MockKafkaBroker struct {
+	listener net.Listener
+	// produceErr is the error code every produce request is answered with.
+	produceErr kafka.Error
+
+	mu       sync.Mutex
+	messages []kafka.Message
+}
+
+func runKafkaBroker(t *testing.T, produceErr kafka.Error) *MockKafkaBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &MockKafkaBroker{listener: listener, produceErr: produceErr}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *MockKafkaBroker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *MockKafkaBroker) Messages() []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]kafka.Message(nil), b.messages...)
+}
+
+func (b *MockKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		apiVersion, correlationID, _, req, err := protocol.ReadRequest(conn)
+		if err != nil {
+			return
+		}
+
+		var res protocol.Message
+		switch req := req.(type) {
+		case *apiversions.Request:
+			res = &apiversions.Response{ApiKeys: []apiversions.ApiKeyResponse{
+				{ApiKey: int16(protocol.ApiVersions), MinVersion: 0, MaxVersion: 2},
+				{ApiKey: int16(protocol.Metadata), MinVersion: 0, MaxVersion: 8},
+				{ApiKey: int16(protocol.Produce), MinVersion: 0, MaxVersion: 7},
+			}}
+		case *metadata.Request:
+			res = b.metadata()
+		case *produce.Request:
+			res = b.produce(req)
+			if !req.HasResponse() {
+				continue
+			}
+		default:
+			return
+		}
+		if err := protocol.WriteResponse(conn, apiVersion, correlationID, res); err != nil {
+			return
+		}
+	}
+}
+
+func (b *MockKafkaBroker) metadata() *metadata.Response {
+	addr := b.listener.Addr().(*net.TCPAddr)
+	res := &metadata.Response{
+		Brokers:      []metadata.ResponseBroker{{NodeID: 1, Host: addr.IP.String(), Port: int32(addr.Port)}},
+		ControllerID: 1,
+	}
+	// The topics are listed when the client asks for every topic, with nil
+	// topic names, as well.
+	for _, topic := range []string{"results"} {
+		res.Topics = append(res.Topics, metadata.ResponseTopic{
+			Name:       topic,
+			Partitions: []metadata.ResponsePartition{{PartitionIndex: 0, LeaderID: 1, ReplicaNodes: []int32{1}, IsrNodes: []int32{1}}},
+		})
+	}
+	return res
+}
+
+func (b *MockKafkaBroker) produce(req *produce.Request) *produce.Response {
+	res := &produce.Response{}
+	for _, topic := range req.Topics {
+		resTopic := produce.ResponseTopic{Topic: topic.Topic}
+		for _, partition := range topic.Partitions {
+			resTopic.Partitions = append(resTopic.Partitions, produce.ResponsePartition{
+				Partition: partition.Partition,
+				ErrorCode: int16(b.produceErr),
+			})
+			if b.produceErr != 0 || partition.RecordSet.Records == nil {
+				continue
+			}
+			for {
+				record, err := partition.RecordSet.Records.ReadRecord()
+				if err != nil {
+					break
+				}
+				value, _ := protocol.ReadAll(record.Value)
+				message := kafka.Message{Topic: topic.Topic, Value: value}
+				for _, h := range record.Headers {
+					message.Headers = append(message.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+				}
+				b.mu.Lock()
+				b.messages = append(b.messages, message)
+				b.mu.Unlock()
+			}
+		}
+		res.Topics = append(res.Topics, resTopic)
+	}
+	return res
+}
+
+// TestKafkaPublisher_Broker publishes through a real writer to an in-process
+// broker.
+func TestKafkaPublisher_Broker(t *testing.T) {
+	tests := []struct {
+		name       string
+		produceErr kafka.Error
+		wantErr    bool
+	}{
+		{name: "acknowledged"},
+		{name: "rejected by the broker", produceErr: kafka.MessageSizeTooLarge, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := runKafkaBroker(t, tt.produceErr)
+			p, err := NewKafkaPublisher(&KafkaOpts{Brokers: []string{broker.Addr()}, Topic: "results", Compress: true})
+			if err != nil {
+				t.Fatalf("NewKafkaPublisher() error = %v", err)
+			}
+			defer p.(*Kafka).Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err = p.Publish(ctx, &MockPayload{payload: []byte("test")})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Kafka.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				var writeErrs kafka.WriteErrors
+				if !errors.As(err, &writeErrs) || !errors.Is(writeErrs[0], tt.produceErr) {
+					t.Errorf("Kafka.Publish() error = %v, want %v", err, tt.produceErr)
+				}
+				return
+			}
+
+			messages := broker.Messages()
+			if len(messages) != 1 || messages[0].Topic != "results" || string(messages[0].Value) != "test" {
+				t.Fatalf("broker received %v, want a single %q message on results", messages, "test")
+			}
+			headers := map[string]string{}
+			for _, h := range messages[0].Headers {
+				headers[h.Key] = string(h.Value)
+			}
+			if headers["Content-Type"] != RabbitMQContentType || headers[RabbitMQCompressionHeader] != RabbitMQCompressionZstd {
+				t.Errorf("broker received headers %v", headers)
+			}
+		})
+	}
+}
+
+func TestKafka_PublishTraceContext(t *testing.T) {
+	exporter := &trace.InMemoryExporter{}
+	trace.SetDefault(trace.NewTracer(exporter))
+	defer trace.SetDefault(trace.NewTracer(nil))
+
+	writer := &MockKafkaWriter{}
+	k := &Kafka{writer: writer, topic: "results"}
+
+	ctx, parent := trace.Start(context.Background(), "handle", trace.SpanKindInternal)
+	if err := k.Publish(ctx, &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("Kafka.Publish() error = %v", err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Kind != trace.SpanKindProducer || spans[0].Name != "publish results" {
+		t.Fatalf("exported spans %+v, want a producer span", spans)
+	}
+	if spans[0].Parent != parent.SpanContext() {
+		t.Errorf("producer span parent = %+v, want %+v", spans[0].Parent, parent.SpanContext())
+	}
+	headers := carriers.Kafka(writer.messages[0].Headers)
+	got := trace.SpanContextFromContext(trace.Extract(context.Background(), &headers))
+	if got.SpanID != spans[0].SpanContext.SpanID || got.TraceID != parent.SpanContext().TraceID {
+		t.Errorf("Kafka.Publish() propagated %+v, want the producer span %+v", got, spans[0].SpanContext)
+	}
+}
@@ -0,0 +1,70 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Middleware decorates a Publisher with additional behaviour.
+type Middleware func(Publisher) Publisher
+
+// PublisherFunc is an adapter to allow the use of ordinary functions as
+// publishers.
+type PublisherFunc func(ctx context.Context, payload Payload) error
+
+func (f PublisherFunc) Publish(ctx context.Context, payload Payload) error {
+	return f(ctx, payload)
+}
+
+// Chain wraps the publisher with the middlewares. The first middleware is the
+// outermost one, i.e. the first to see every payload.
+func Chain(p Publisher, middlewares ...Middleware) Publisher {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		p = middlewares[i](p)
+	}
+	return p
+}
+
+// WithTimeout bounds every publish by the timeout.
+func WithTimeout(timeout time.Duration) Middleware {
+	return func(next Publisher) Publisher {
+		return PublisherFunc(func(ctx context.Context, payload Payload) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next.Publish(ctx, payload)
+		})
+	}
+}
+
+// WithRetry retries failed publishes up to attempts times in total, waiting
+// attempt*delay between attempts.
+func WithRetry(attempts int, delay time.Duration) Middleware {
+	return func(next Publisher) Publisher {
+		return PublisherFunc(func(ctx context.Context, payload Payload) error {
+			payload, err := bufferPayload(payload)
+			if err != nil {
+				return err
+			}
+
+			for attempt := 1; ; attempt++ {
+				err = next.Publish(ctx, payload)
+				if err == nil || attempt >= attempts {
+					break
+				}
+				wait := time.Duration(attempt) * delay
+				log.Printf("publish attempt %d/%d failed, retrying in %s: %v", attempt, attempts, wait, err)
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return fmt.Errorf("publish retries interrupted after %d attempts: %w", attempt, err)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("publish failed after %d attempts: %w", attempts, err)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MultiPolicyAll fails the publish if any destination fails.
+	MultiPolicyAll = "all"
+	// MultiPolicyAny succeeds if at least one destination succeeds. The
+	// errors of the destinations that failed are passed to OnError.
+	MultiPolicyAny = "any"
+	// MultiPolicyPrimary only takes the first destination into account. The
+	// others are shadows: they receive every payload in the background, with
+	// their own timeout, and their errors are passed to OnError.
+	MultiPolicyPrimary = "primary"
+)
+
+const (
+	DefaultShadowTimeout = 20 * time.Second
+)
+
+type Destination struct {
+	Name      string
+	Publisher Publisher
+}
+
+type MultiOpts struct {
+	Policy string
+	// Destinations the payloads are sent to. With MultiPolicyPrimary, the
+	// first destination is the primary.
+	Destinations []Destination
+	// ShadowTimeout bounds every publish to a shadow destination with
+	// MultiPolicyPrimary. Defaults to DefaultShadowTimeout.
+	ShadowTimeout time.Duration
+	// OnError is called with the errors that do not fail the publish: those
+	// of the destinations that failed with MultiPolicyAny when another one
+	// succeeded, and those of the shadows with MultiPolicyPrimary. The errors
+	// of the shadows are passed one at a time, from their goroutine. Defaults
+	// to logging the errors.
+	OnError func(err *MultiError)
+}
+
+// MultiPublisher sends every payload to several publishers at once, for
+// example to RabbitMQ and to an HTTP endpoint while migrating between them.
+// With MultiPolicyPrimary, it should be closed on shutdown so that the
+// publishes to the shadows are not cut short.
+type MultiPublisher struct {
+	policy        string
+	destinations  []Destination
+	shadowTimeout time.Duration
+	onError       func(err *MultiError)
+
+	// shadowCtx bounds the lifetime of the publishes to the shadows, it is
+	// canceled by Close.
+	shadowCtx    context.Context
+	cancelShadow context.CancelFunc
+	mu           sync.Mutex
+	closed       bool
+	shadows      sync.WaitGroup
+}
+
+// DestinationError is the error returned by a single destination.
+type DestinationError struct {
+	Destination string
+	Err         error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Destination, e.Err)
+}
+
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned by MultiPublisher.Publish when the policy is not
+// satisfied, and passed to OnError otherwise. It holds the error of every
+// destination that failed.
+type MultiError struct {
+	Errors []*DestinationError
+}
+
+func (e *MultiError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("publishing failed for %d destination(s): %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Err returns the error of the named destination, or nil if it succeeded.
+func (e *MultiError) Err(destination string) error {
+	for _, err := range e.Errors {
+		if err.Destination == destination {
+			return err.Err
+		}
+	}
+	return nil
+}
+
+func NewMultiPublisher(opts *MultiOpts) (Publisher, error) {
+	if len(opts.Destinations) == 0 {
+		return nil, errors.New("multi publisher requires at least one destination")
+	}
+	if opts.Policy == "" {
+		opts.Policy = MultiPolicyAll
+	}
+	if opts.ShadowTimeout == 0 {
+		opts.ShadowTimeout = DefaultShadowTimeout
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err *MultiError) {
+			log.Println("error while publishing to some destinations", err)
+		}
+	}
+	switch opts.Policy {
+	case MultiPolicyAll, MultiPolicyAny, MultiPolicyPrimary:
+	default:
+		return nil, fmt.Errorf("unknown multi publisher policy: %q", opts.Policy)
+	}
+
+	names := make(map[string]bool, len(opts.Destinations))
+	for i, d := range opts.Destinations {
+		if d.Publisher == nil {
+			return nil, fmt.Errorf("multi publisher destination %d has no publisher", i)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("duplicate multi publisher destination: %q", d.Name)
+		}
+		names[d.Name] = true
+	}
+
+	shadowCtx, cancelShadow := context.WithCancel(context.Background())
+	return &MultiPublisher{
+		policy:        opts.Policy,
+		destinations:  opts.Destinations,
+		shadowTimeout: opts.ShadowTimeout,
+		onError:       opts.OnError,
+		shadowCtx:     shadowCtx,
+		cancelShadow:  cancelShadow,
+	}, nil
+}
+
+// Publish sends the payload to every destination concurrently and waits for
+// all of them before applying the policy. With MultiPolicyPrimary, only the
+// primary is waited for.
+func (m *MultiPublisher) Publish(ctx context.Context, payload Payload) error {
+	payload, err := bufferPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	if m.policy == MultiPolicyPrimary {
+		return m.publishPrimary(ctx, payload)
+	}
+
+	errs := make([]error, len(m.destinations))
+	var wg sync.WaitGroup
+	wg.Add(len(m.destinations))
+	for i := range m.destinations {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.destinations[i].Publisher.Publish(ctx, payload)
+		}(i)
+	}
+	wg.Wait()
+
+	multiErr := &MultiError{}
+	for i, err := range errs {
+		if err != nil {
+			multiErr.Errors = append(multiErr.Errors, &DestinationError{
+				Destination: m.destinations[i].Name,
+				Err:         err,
+			})
+		}
+	}
+	if len(multiErr.Errors) == 0 {
+		return nil
+	}
+
+	if m.policy == MultiPolicyAll || len(multiErr.Errors) == len(m.destinations) {
+		return multiErr
+	}
+
+	m.onError(multiErr)
+	return nil
+}
+
+// Wait blocks until the publishes to the shadows in flight are done.
+func (m *MultiPublisher) Wait() {
+	m.shadows.Wait()
+}
+
+// Close cancels the publishes to the shadows in flight and waits for them.
+// The payloads published afterwards are not sent to the shadows anymore. The
+// destinations are not closed.
+func (m *MultiPublisher) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	m.cancelShadow()
+	m.shadows.Wait()
+	return nil
+}
+
+// publishPrimary publishes to the primary destination and hands the payload
+// over to the shadows without waiting for them, so that a slow or failing
+// shadow never delays or fails the primary.
+func (m *MultiPublisher) publishPrimary(ctx context.Context, payload Payload) error {
+	m.mu.Lock()
+	if !m.closed {
+		for _, d := range m.destinations[1:] {
+			m.shadows.Add(1)
+			go m.publishShadow(ctx, d, payload)
+		}
+	}
+	m.mu.Unlock()
+
+	primary := m.destinations[0]
+	if err := primary.Publisher.Publish(ctx, payload); err != nil {
+		return &MultiError{Errors: []*DestinationError{{Destination: primary.Name, Err: err}}}
+	}
+	return nil
+}
+
+// publishShadow publishes to a shadow destination. It keeps the values of
+// ctx, like the trace context, but not its cancellation: the shadow publish
+// outlives the primary one and is only bound by the shadow timeout and Close.
+func (m *MultiPublisher) publishShadow(ctx context.Context, d Destination, payload Payload) {
+	defer m.shadows.Done()
+	ctx, cancel := context.WithTimeout(shadowContext{Context: m.shadowCtx, values: ctx}, m.shadowTimeout)
+	defer cancel()
+
+	if err := d.Publisher.Publish(ctx, payload); err != nil {
+		m.onError(&MultiError{Errors: []*DestinationError{{Destination: d.Name, Err: err}}})
+	}
+}
+
+// shadowContext carries the values of the context of a publish with the
+// deadline and cancellation of the publisher.
+type shadowContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c shadowContext) Value(key interface{}) interface{} { return c.values.Value(key) }
+
+// amqpRawPayload is a payload whose bytes have already been computed and that
+// keeps the AMQP properties of the original payload.
+type amqpRawPayload struct {
+	rawPayload
+	props AMQPProperties
+}
+
+func (p *amqpRawPayload) AMQPProperties() AMQPProperties {
+	return p.props
+}
+
+// bufferPayload computes the bytes of the payload once so that they are not
+// recomputed, possibly concurrently, by every destination.
+func bufferPayload(payload Payload) (Payload, error) {
+	body, err := payload.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := payload.(AMQPPayload); ok {
+		return &amqpRawPayload{rawPayload: body, props: p.AMQPProperties()}, nil
+	}
+	return rawPayload(body), nil
+}
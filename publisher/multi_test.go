@@ -0,0 +1,282 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+const alwaysFail = 1 << 30
+
+func TestNewMultiPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *MultiOpts
+		wantErr bool
+	}{
+		{
+			name: "defaults to all",
+			opts: &MultiOpts{Destinations: []Destination{{Name: "rmq", Publisher: &MockPublisher{}}}},
+		},
+		{
+			name:    "no destinations",
+			opts:    &MultiOpts{Policy: MultiPolicyAny},
+			wantErr: true,
+		},
+		{
+			name:    "unknown policy",
+			opts:    &MultiOpts{Policy: "some", Destinations: []Destination{{Name: "rmq", Publisher: &MockPublisher{}}}},
+			wantErr: true,
+		},
+		{
+			name:    "missing publisher",
+			opts:    &MultiOpts{Destinations: []Destination{{Name: "rmq"}}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate destination",
+			opts: &MultiOpts{Destinations: []Destination{
+				{Name: "rmq", Publisher: &MockPublisher{}},
+				{Name: "rmq", Publisher: &MockPublisher{}},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMultiPublisher(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMultiPublisher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMultiPublisher_Publish(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		failures   [2]int
+		wantErr    bool
+		wantFailed []string
+	}{
+		{name: "all succeed", policy: MultiPolicyAll},
+		{name: "all with one failure", policy: MultiPolicyAll, failures: [2]int{0, alwaysFail}, wantErr: true, wantFailed: []string{"http"}},
+		{name: "any with one failure", policy: MultiPolicyAny, failures: [2]int{alwaysFail, 0}},
+		{name: "any with every failure", policy: MultiPolicyAny, failures: [2]int{alwaysFail, alwaysFail}, wantErr: true, wantFailed: []string{"rmq", "http"}},
+		{name: "primary with shadow failure", policy: MultiPolicyPrimary, failures: [2]int{0, alwaysFail}},
+		{name: "primary failure", policy: MultiPolicyPrimary, failures: [2]int{alwaysFail, 0}, wantErr: true, wantFailed: []string{"rmq"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rmq := &MockPublisher{failures: tt.failures[0]}
+			http := &MockPublisher{failures: tt.failures[1]}
+			m, err := NewMultiPublisher(&MultiOpts{
+				Policy: tt.policy,
+				Destinations: []Destination{
+					{Name: "rmq", Publisher: rmq},
+					{Name: "http", Publisher: http},
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewMultiPublisher() error = %v", err)
+			}
+
+			err = m.Publish(context.Background(), &MockPayload{payload: []byte("test")})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MultiPublisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+
+			var multiErr *MultiError
+			if !errors.As(err, &multiErr) {
+				t.Fatalf("MultiPublisher.Publish() error = %T, want *MultiError", err)
+			}
+			if len(multiErr.Errors) != len(tt.wantFailed) {
+				t.Fatalf("MultiPublisher.Publish() failed destinations = %v, want %v", multiErr.Errors, tt.wantFailed)
+			}
+			for _, name := range tt.wantFailed {
+				if multiErr.Err(name) == nil {
+					t.Errorf("MultiPublisher.Publish() expected error for destination %q", name)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiPublisher_PayloadError(t *testing.T) {
+	rmq := &MockPublisher{}
+	m, err := NewMultiPublisher(&MultiOpts{Destinations: []Destination{{Name: "rmq", Publisher: rmq}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(context.Background(), &MockPayload{err: errors.New("test-error")}); err == nil {
+		t.Error("MultiPublisher.Publish() expected error for unreadable payload")
+	}
+	if len(rmq.Published()) != 0 {
+		t.Error("MultiPublisher.Publish() must not publish unreadable payloads")
+	}
+}
+
+// BlockingPublisher blocks every publish until release is closed or the
+// context of the publish is done.
+type BlockingPublisher struct {
+	release chan struct{}
+	done    chan error
+}
+
+func (p *BlockingPublisher) Publish(ctx context.Context, _ Payload) error {
+	var err error
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.done <- err
+	return err
+}
+
+func TestMultiPublisher_PublishShadow(t *testing.T) {
+	tests := []struct {
+		name          string
+		shadowTimeout time.Duration
+		release       bool
+		wantErr       error
+	}{
+		{name: "slow shadow", shadowTimeout: time.Minute, release: true},
+		{name: "shadow timeout", shadowTimeout: 10 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &MockPublisher{}
+			shadow := &BlockingPublisher{release: make(chan struct{}), done: make(chan error, 1)}
+			m, err := NewMultiPublisher(&MultiOpts{
+				Policy:        MultiPolicyPrimary,
+				ShadowTimeout: tt.shadowTimeout,
+				Destinations: []Destination{
+					{Name: "rmq", Publisher: primary},
+					{Name: "http", Publisher: shadow},
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewMultiPublisher() error = %v", err)
+			}
+
+			// The primary publish returns, and its context is canceled,
+			// while the shadow is still blocked.
+			ctx, cancel := context.WithCancel(context.Background())
+			if err := m.Publish(ctx, &MockPayload{payload: []byte("test")}); err != nil {
+				t.Fatalf("MultiPublisher.Publish() error = %v", err)
+			}
+			cancel()
+			if len(primary.Published()) != 1 {
+				t.Error("MultiPublisher.Publish() did not publish to the primary")
+			}
+
+			if tt.release {
+				close(shadow.release)
+			}
+			select {
+			case err := <-shadow.done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("shadow publish error = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("shadow publish never returned")
+			}
+		})
+	}
+}
+
+func TestMultiPublisher_OnError(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		failures   [2]int
+		wantFailed string
+	}{
+		{name: "any with one failure", policy: MultiPolicyAny, failures: [2]int{alwaysFail, 0}, wantFailed: "rmq"},
+		{name: "primary with shadow failure", policy: MultiPolicyPrimary, failures: [2]int{0, alwaysFail}, wantFailed: "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				errs   []*MultiError
+				rmq    = &MockPublisher{failures: tt.failures[0]}
+				shadow = &MockPublisher{failures: tt.failures[1]}
+			)
+			m, err := NewMultiPublisher(&MultiOpts{
+				Policy: tt.policy,
+				Destinations: []Destination{
+					{Name: "rmq", Publisher: rmq},
+					{Name: "http", Publisher: shadow},
+				},
+				OnError: func(err *MultiError) {
+					mu.Lock()
+					defer mu.Unlock()
+					errs = append(errs, err)
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewMultiPublisher() error = %v", err)
+			}
+
+			if err := m.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+				t.Fatalf("MultiPublisher.Publish() error = %v", err)
+			}
+			m.(*MultiPublisher).Wait()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(errs) != 1 || len(errs[0].Errors) != 1 || errs[0].Err(tt.wantFailed) == nil {
+				t.Errorf("OnError() called with %v, want the error of %q", errs, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestMultiPublisher_Close(t *testing.T) {
+	shadow := &BlockingPublisher{release: make(chan struct{}), done: make(chan error, 2)}
+	m, err := NewMultiPublisher(&MultiOpts{
+		Policy:        MultiPolicyPrimary,
+		ShadowTimeout: time.Minute,
+		OnError:       func(*MultiError) {},
+		Destinations: []Destination{
+			{Name: "rmq", Publisher: &MockPublisher{}},
+			{Name: "http", Publisher: shadow},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewMultiPublisher() error = %v", err)
+	}
+	if err := m.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("MultiPublisher.Publish() error = %v", err)
+	}
+
+	// Close cancels the blocked shadow publish and waits for it.
+	if err := m.(*MultiPublisher).Close(); err != nil {
+		t.Fatalf("MultiPublisher.Close() error = %v", err)
+	}
+	select {
+	case err := <-shadow.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("shadow publish error = %v, want %v", err, context.Canceled)
+		}
+	default:
+		t.Fatal("MultiPublisher.Close() returned before the shadow publish")
+	}
+
+	// The shadows are left out once closed.
+	if err := m.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("MultiPublisher.Publish() error = %v", err)
+	}
+	m.(*MultiPublisher).Wait()
+	if len(shadow.done) != 0 {
+		t.Error("MultiPublisher.Publish() published to a shadow after Close")
+	}
+}
@@ -0,0 +1,119 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	PublisherTypeNATS = "nats"
+)
+
+const (
+	NATSReconnectWait = 1 * time.Second  // How long to wait before another reconnect attempt
+	NATSMaxReconnects = -1               // Reconnect forever
+	NATSFlushTimeout  = 10 * time.Second // How long to wait for the server to process a message
+)
+
+type NATSOpts struct {
+	URL      string `mapstructure:"url"`
+	Subject  string `mapstructure:"subject"`
+	Token    string `mapstructure:"token"`
+	Name     string `mapstructure:"name"`
+	Compress bool   `mapstructure:"compress"`
+}
+
+// natsConn is the subset of *nats.Conn used by the NATS publisher.
+type natsConn interface {
+	PublishMsg(*nats.Msg) error
+	FlushWithContext(context.Context) error
+	Close()
+}
+
+type NATS struct {
+	conn     natsConn
+	subject  string
+	compress bool
+}
+
+func NewNATSPublisher(opts *NATSOpts) (Publisher, error) {
+	if opts.Subject == "" {
+		return nil, errors.New("nats subject is required")
+	}
+
+	natsOpts := []nats.Option{
+		nats.ReconnectWait(NATSReconnectWait),
+		nats.MaxReconnects(NATSMaxReconnects),
+	}
+	if opts.Token != "" {
+		natsOpts = append(natsOpts, nats.Token(opts.Token))
+	}
+	if opts.Name != "" {
+		natsOpts = append(natsOpts, nats.Name(opts.Name))
+	}
+
+	conn, err := nats.Connect(opts.URL, natsOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATS{
+		conn:     conn,
+		subject:  opts.Subject,
+		compress: opts.Compress,
+	}, nil
+}
+
+// Publish sends the payload to the configured subject and waits for the
+// server to process it, for at most NATSFlushTimeout unless ctx has a
+// deadline.
+func (n *NATS) Publish(ctx context.Context, payload Payload) (err error) {
+	ctx, span := trace.Start(ctx, "publish "+n.subject, trace.SpanKindProducer)
+	span.SetAttribute("messaging.system", PublisherTypeNATS)
+	span.SetAttribute("messaging.destination", n.subject)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	body, err := payload.Bytes()
+	if err != nil {
+		log.Println("error while compressing payload before publishing to NATS", err)
+		return err
+	}
+
+	message := nats.NewMsg(n.subject)
+	message.Data = body
+	message.Header.Set("Content-Type", RabbitMQContentType)
+	if n.compress {
+		message.Header.Set(RabbitMQCompressionHeader, RabbitMQCompressionZstd)
+	}
+	trace.Inject(ctx, trace.HeaderCarrier(message.Header))
+
+	if err := n.conn.PublishMsg(message); err != nil {
+		log.Println("error while publishing to NATS", err)
+		return err
+	}
+	// The NATS client refuses to flush without a deadline.
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, NATSFlushTimeout)
+		defer cancel()
+	}
+	if err := n.conn.FlushWithContext(ctx); err != nil {
+		log.Println("error while flushing NATS connection", err)
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the NATS server.
+func (n *NATS) Close() error {
+	n.conn.Close()
+	return nil
+}
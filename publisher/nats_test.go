@@ -0,0 +1,173 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+type MockNATSConn struct {
+	publishErr error
+	flushErr   error
+	message    *nats.Msg
+}
+
+func (c *MockNATSConn) PublishMsg(m *nats.Msg) error {
+	c.message = m
+	return c.publishErr
+}
+
+func (c *MockNATSConn) FlushWithContext(_ context.Context) error {
+	return c.flushErr
+}
+
+func (*MockNATSConn) Close() {}
+
+func TestNATS_Publish(t *testing.T) {
+	tests := []struct {
+		name     string
+		conn     *MockNATSConn
+		payload  Payload
+		compress bool
+		wantErr  bool
+	}{
+		{
+			name:    "success",
+			conn:    &MockNATSConn{},
+			payload: &MockPayload{payload: []byte("test")},
+		},
+		{
+			name:     "compressed payload",
+			conn:     &MockNATSConn{},
+			payload:  &MockPayload{payload: []byte("test")},
+			compress: true,
+		},
+		{
+			name:    "uncompressible payload",
+			conn:    &MockNATSConn{},
+			payload: &MockPayload{err: errors.New("test-error")},
+			wantErr: true,
+		},
+		{
+			name:    "error publishing",
+			conn:    &MockNATSConn{publishErr: errors.New("test-error")},
+			payload: &MockPayload{payload: []byte("test")},
+			wantErr: true,
+		},
+		{
+			name:    "error flushing",
+			conn:    &MockNATSConn{flushErr: errors.New("test-error")},
+			payload: &MockPayload{payload: []byte("test")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &NATS{conn: tt.conn, subject: "results", compress: tt.compress}
+			err := n.Publish(context.Background(), tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NATS.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			m := tt.conn.message
+			if m.Subject != "results" || string(m.Data) != "test" {
+				t.Errorf("NATS.Publish() message = %s %q, want results %q", m.Subject, m.Data, "test")
+			}
+			if got := m.Header.Get(RabbitMQCompressionHeader); (got == RabbitMQCompressionZstd) != tt.compress {
+				t.Errorf("NATS.Publish() compression header = %q, compress %v", got, tt.compress)
+			}
+		})
+	}
+}
+
+func runNATSServer(t *testing.T) *server.Server {
+	t.Helper()
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// TestNATSPublisher_Server publishes through a real connection to an
+// in-process NATS server.
+func TestNATSPublisher_Server(t *testing.T) {
+	s := runNATSServer(t)
+
+	sub, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	messages, err := sub.SubscribeSync("results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewNATSPublisher(&NATSOpts{URL: s.ClientURL(), Subject: "results", Compress: true})
+	if err != nil {
+		t.Fatalf("NewNATSPublisher() error = %v", err)
+	}
+	defer p.(*NATS).Close()
+
+	if err := p.Publish(context.Background(), &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("NATS.Publish() error = %v", err)
+	}
+	m, err := messages.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("error receiving the message: %v", err)
+	}
+	if string(m.Data) != "test" {
+		t.Errorf("received %q, want %q", m.Data, "test")
+	}
+	if m.Header.Get("Content-Type") != RabbitMQContentType || m.Header.Get(RabbitMQCompressionHeader) != RabbitMQCompressionZstd {
+		t.Errorf("received headers %v", m.Header)
+	}
+
+	// Once the server is gone, the publish is buffered for reconnection and
+	// the flush is never acknowledged.
+	s.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.Publish(ctx, &MockPayload{payload: []byte("test")}); err == nil {
+		t.Error("NATS.Publish() expected error once the server is gone")
+	}
+}
+
+func TestNATS_PublishTraceContext(t *testing.T) {
+	exporter := &trace.InMemoryExporter{}
+	trace.SetDefault(trace.NewTracer(exporter))
+	defer trace.SetDefault(trace.NewTracer(nil))
+
+	conn := &MockNATSConn{}
+	n := &NATS{conn: conn, subject: "results"}
+
+	ctx, parent := trace.Start(context.Background(), "handle", trace.SpanKindInternal)
+	if err := n.Publish(ctx, &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("NATS.Publish() error = %v", err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Kind != trace.SpanKindProducer || spans[0].Name != "publish results" {
+		t.Fatalf("exported spans %+v, want a producer span", spans)
+	}
+	if spans[0].Parent != parent.SpanContext() {
+		t.Errorf("producer span parent = %+v, want %+v", spans[0].Parent, parent.SpanContext())
+	}
+	got := trace.SpanContextFromContext(trace.Extract(context.Background(), trace.HeaderCarrier(conn.message.Header)))
+	if got.SpanID != spans[0].SpanContext.SpanID || got.TraceID != parent.SpanContext().TraceID {
+		t.Errorf("NATS.Publish() propagated %+v, want the producer span %+v", got, spans[0].SpanContext)
+	}
+}
@@ -0,0 +1,410 @@
+package publisher
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutboxRetryInterval = 5 * time.Second
+)
+
+const (
+	outboxRecordPut byte = 'P'
+	outboxRecordAck byte = 'A'
+
+	outboxHeaderSize  = 1 + 8 + 4 // type + sequence + body length
+	outboxTrailerSize = 4         // crc32 of header and body
+)
+
+var ErrOutboxClosed = errors.New("outbox is closed")
+
+type OutboxOpts struct {
+	// Path of the append-only file the payloads are persisted to.
+	Path string
+	// Publisher the persisted payloads are delivered through.
+	Publisher Publisher
+	// RetryInterval is how long to wait before retrying a failed delivery.
+	RetryInterval time.Duration
+}
+
+// Outbox is a Publisher that persists every payload to a local append-only
+// file before delivering it through the wrapped Publisher. Payloads that could
+// not be delivered survive restarts and are replayed in the order they were
+// published.
+type Outbox struct {
+	publisher     Publisher
+	retryInterval time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	nextSeq uint64
+	pending []outboxEntry
+	changed chan struct{} // closed and replaced whenever pending shrinks
+	closed  bool
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type outboxEntry struct {
+	seq  uint64
+	body []byte
+}
+
+// rawPayload is a payload whose bytes have already been computed.
+type rawPayload []byte
+
+func (r rawPayload) Bytes() ([]byte, error) {
+	return r, nil
+}
+
+// NewOutbox opens (or creates) the outbox file, replays the payloads that were
+// not delivered before the last shutdown and starts delivering them in the
+// background.
+func NewOutbox(ctx context.Context, opts *OutboxOpts) (*Outbox, error) {
+	if opts.Path == "" {
+		return nil, errors.New("outbox path is required")
+	}
+	if opts.Publisher == nil {
+		return nil, errors.New("outbox publisher is required")
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = DefaultOutboxRetryInterval
+	}
+
+	pending, nextSeq, offset, err := replayOutbox(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(opts.Path); err == nil && offset < info.Size() {
+		log.Printf("outbox: unreadable record at offset %d of %s, moving the rest of the file to %s.corrupt", offset, opts.Path, opts.Path)
+		if err := preserveOutboxTail(opts.Path, offset); err != nil {
+			return nil, fmt.Errorf("error preserving unreadable outbox records: %w", err)
+		}
+	}
+	file, err := compactOutbox(opts.Path, pending)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	o := &Outbox{
+		publisher:     opts.Publisher,
+		retryInterval: opts.RetryInterval,
+		file:          file,
+		nextSeq:       nextSeq,
+		pending:       pending,
+		changed:       make(chan struct{}),
+		wake:          make(chan struct{}, 1),
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+	if len(pending) > 0 {
+		log.Printf("outbox: replaying %d undelivered payloads from %s", len(pending), opts.Path)
+	}
+
+	go o.run(ctx)
+	return o, nil
+}
+
+// Publish persists the payload and queues it for delivery. It returns once
+// the payload is safely on disk, not once it has been delivered.
+func (o *Outbox) Publish(_ context.Context, payload Payload) error {
+	body, err := payload.Bytes()
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrOutboxClosed
+	}
+
+	// The sequence is used up even if the write fails: the record may be on
+	// disk in part, or in full when only the sync failed, and must not be
+	// confused with the next one on replay.
+	seq := o.nextSeq
+	o.nextSeq++
+	if err := o.write(outboxRecordPut, seq, body); err != nil {
+		return fmt.Errorf("error persisting payload to outbox: %w", err)
+	}
+	o.pending = append(o.pending, outboxEntry{seq: seq, body: body})
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the number of payloads that are yet to be delivered.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Drain blocks until every pending payload has been delivered or the context
+// is done. It is meant to be called during graceful shutdown, before Close.
+func (o *Outbox) Drain(ctx context.Context) error {
+	for {
+		o.mu.Lock()
+		pending, changed := len(o.pending), o.changed
+		o.mu.Unlock()
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-o.done:
+			return fmt.Errorf("outbox closed with %d undelivered payloads", o.Pending())
+		case <-ctx.Done():
+			return fmt.Errorf("outbox drain interrupted with %d undelivered payloads: %w", o.Pending(), ctx.Err())
+		}
+	}
+}
+
+// Close stops the delivery loop and closes the outbox file. Payloads that
+// were not delivered stay on disk and are replayed by the next NewOutbox.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	o.mu.Unlock()
+
+	o.cancel()
+	<-o.done
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
+
+// run delivers the pending payloads one at a time, in order. A failed
+// delivery is retried until it succeeds so that later payloads never
+// overtake it.
+func (o *Outbox) run(ctx context.Context) {
+	defer close(o.done)
+
+	for {
+		o.mu.Lock()
+		if len(o.pending) == 0 {
+			o.mu.Unlock()
+			select {
+			case <-o.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		entry := o.pending[0]
+		o.mu.Unlock()
+
+		if err := o.publisher.Publish(ctx, rawPayload(entry.body)); err != nil {
+			log.Printf("outbox: error delivering payload %d, retrying in %s: %v", entry.seq, o.retryInterval, err)
+			select {
+			case <-time.After(o.retryInterval):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := o.ack(entry.seq); err != nil {
+			// The payload was delivered but the acknowledgement could not be
+			// persisted. It will be delivered again after a restart.
+			log.Printf("outbox: error acknowledging payload %d: %v", entry.seq, err)
+		}
+	}
+}
+
+// ack marks the head of the queue as delivered.
+func (o *Outbox) ack(seq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending = o.pending[1:]
+	close(o.changed)
+	o.changed = make(chan struct{})
+
+	// Nothing is left to replay, start over with an empty file instead of
+	// letting it grow forever.
+	if len(o.pending) == 0 {
+		return o.file.Truncate(0)
+	}
+	return o.write(outboxRecordAck, seq, nil)
+}
+
+// write appends a record to the outbox file and flushes it to disk.
+func (o *Outbox) write(recordType byte, seq uint64, body []byte) error {
+	if _, err := o.file.Write(encodeOutboxRecord(recordType, seq, body)); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+func encodeOutboxRecord(recordType byte, seq uint64, body []byte) []byte {
+	record := make([]byte, outboxHeaderSize+len(body)+outboxTrailerSize)
+	record[0] = recordType
+	binary.BigEndian.PutUint64(record[1:9], seq)
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(body)))
+	copy(record[outboxHeaderSize:], body)
+
+	checksum := crc32.ChecksumIEEE(record[:outboxHeaderSize+len(body)])
+	binary.BigEndian.PutUint32(record[outboxHeaderSize+len(body):], checksum)
+	return record
+}
+
+// replayOutbox reads the outbox file and returns the payloads that were
+// persisted but never acknowledged, ordered by sequence, along with the offset
+// of the first record that could not be read. The offset is the size of the
+// file when every record was read.
+func replayOutbox(path string) ([]outboxEntry, uint64, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var (
+		reader  = bufio.NewReader(file)
+		header  = make([]byte, outboxHeaderSize)
+		bodies  = map[uint64][]byte{}
+		order   []uint64
+		nextSeq uint64
+		offset  int64
+	)
+	for offset < info.Size() {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		recordType := header[0]
+		seq := binary.BigEndian.Uint64(header[1:9])
+		// The length is checked against what is left of the file before
+		// anything is allocated, so that a corrupt length cannot cause a huge
+		// allocation.
+		size := int64(binary.BigEndian.Uint32(header[9:13])) + outboxTrailerSize
+		if size > info.Size()-offset-outboxHeaderSize {
+			break
+		}
+		rest := make([]byte, size)
+		if _, err := io.ReadFull(reader, rest); err != nil {
+			break
+		}
+		body := rest[:len(rest)-outboxTrailerSize]
+		checksum := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, body)
+		if checksum != binary.BigEndian.Uint32(rest[len(body):]) {
+			break
+		}
+		offset += outboxHeaderSize + size
+
+		switch recordType {
+		case outboxRecordPut:
+			bodies[seq] = body
+			order = append(order, seq)
+		case outboxRecordAck:
+			delete(bodies, seq)
+		}
+		if seq >= nextSeq {
+			nextSeq = seq + 1
+		}
+	}
+
+	pending := make([]outboxEntry, 0, len(bodies))
+	for _, seq := range order {
+		if body, ok := bodies[seq]; ok {
+			pending = append(pending, outboxEntry{seq: seq, body: body})
+		}
+	}
+	return pending, nextSeq, offset, nil
+}
+
+// preserveOutboxTail appends the bytes of the outbox file from offset on to
+// the .corrupt file next to it, so that the records after an unreadable one
+// are not lost to compaction and can be recovered by hand. A torn record at
+// the end of the file, left by a crash in the middle of a write, ends up there
+// as well.
+func preserveOutboxTail(path string, offset int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	corrupt, err := os.OpenFile(path+".corrupt", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(corrupt, file); err != nil {
+		corrupt.Close()
+		return err
+	}
+	if err := corrupt.Sync(); err != nil {
+		corrupt.Close()
+		return err
+	}
+	return corrupt.Close()
+}
+
+// compactOutbox rewrites the outbox file with only the pending payloads and
+// returns it opened for appending.
+func compactOutbox(path string, pending []outboxEntry) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range pending {
+		if _, err := writer.Write(encodeOutboxRecord(outboxRecordPut, entry.seq, entry.body)); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+}
@@ -0,0 +1,227 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MockPublisher struct {
+	mu        sync.Mutex
+	failures  int
+	published []string
+}
+
+func (m *MockPublisher) Publish(_ context.Context, payload Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("test-error")
+	}
+	body, err := payload.Bytes()
+	if err != nil {
+		return err
+	}
+	m.published = append(m.published, string(body))
+	return nil
+}
+
+func (m *MockPublisher) Published() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.published...)
+}
+
+func newTestOutbox(t *testing.T, path string, publisher Publisher) *Outbox {
+	t.Helper()
+	o, err := NewOutbox(context.Background(), &OutboxOpts{
+		Path:          path,
+		Publisher:     publisher,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewOutbox() error = %v", err)
+	}
+	return o
+}
+
+func publishAll(t *testing.T, o *Outbox, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if err := o.Publish(context.Background(), &MockPayload{payload: []byte(body)}); err != nil {
+			t.Fatalf("Outbox.Publish() error = %v", err)
+		}
+	}
+}
+
+func drain(t *testing.T, o *Outbox) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := o.Drain(ctx); err != nil {
+		t.Fatalf("Outbox.Drain() error = %v", err)
+	}
+}
+
+func TestOutbox_Publish(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+	}{
+		{name: "success"},
+		{name: "retries failed deliveries in order", failures: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &MockPublisher{failures: tt.failures}
+			o := newTestOutbox(t, filepath.Join(t.TempDir(), "outbox"), mock)
+			defer o.Close()
+
+			publishAll(t, o, "one", "two", "three")
+			drain(t, o)
+
+			want := []string{"one", "two", "three"}
+			if got := mock.Published(); !reflect.DeepEqual(got, want) {
+				t.Errorf("Outbox delivered = %v, want %v", got, want)
+			}
+			if o.Pending() != 0 {
+				t.Errorf("Outbox.Pending() = %d, want 0", o.Pending())
+			}
+		})
+	}
+}
+
+func TestOutbox_PayloadError(t *testing.T) {
+	o := newTestOutbox(t, filepath.Join(t.TempDir(), "outbox"), &MockPublisher{})
+	defer o.Close()
+
+	if err := o.Publish(context.Background(), &MockPayload{err: errors.New("test-error")}); err == nil {
+		t.Error("Outbox.Publish() expected error for unreadable payload")
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Outbox.Close() error = %v", err)
+	}
+	if err := o.Publish(context.Background(), &MockPayload{payload: []byte("test")}); !errors.Is(err, ErrOutboxClosed) {
+		t.Errorf("Outbox.Publish() after close error = %v, want %v", err, ErrOutboxClosed)
+	}
+}
+
+func TestOutbox_ReplayAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	// The broker is down: nothing gets delivered before shutdown.
+	down := &MockPublisher{failures: 1 << 30}
+	o := newTestOutbox(t, path, down)
+	publishAll(t, o, "one", "two", "three")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := o.Drain(ctx); err == nil {
+		t.Error("Outbox.Drain() expected error when the publisher is down")
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Outbox.Close() error = %v", err)
+	}
+
+	// Simulate a crash in the middle of writing a record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := encodeOutboxRecord(outboxRecordPut, 99, []byte("torn"))
+	if _, err := f.Write(torn[:len(torn)-2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	up := &MockPublisher{}
+	o = newTestOutbox(t, path, up)
+	defer o.Close()
+	publishAll(t, o, "four")
+	drain(t, o)
+
+	want := []string{"one", "two", "three", "four"}
+	if got := up.Published(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Outbox replayed = %v, want %v", got, want)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("Outbox file size after drain = %d, want 0", info.Size())
+	}
+}
+
+func TestOutbox_ReplayCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	// A record whose length field claims ~4GB sits between two valid ones.
+	corrupt := encodeOutboxRecord(outboxRecordPut, 1, []byte("two"))
+	corrupt[9], corrupt[10], corrupt[11], corrupt[12] = 0xff, 0xff, 0xff, 0xf0
+	var records []byte
+	records = append(records, encodeOutboxRecord(outboxRecordPut, 0, []byte("one"))...)
+	records = append(records, corrupt...)
+	records = append(records, encodeOutboxRecord(outboxRecordPut, 2, []byte("three"))...)
+	if err := os.WriteFile(path, records, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	up := &MockPublisher{}
+	o := newTestOutbox(t, path, up)
+	defer o.Close()
+	drain(t, o)
+
+	if got, want := up.Published(), []string{"one"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Outbox replayed = %v, want %v", got, want)
+	}
+
+	// The unreadable record and everything after it survive compaction.
+	tail, err := os.ReadFile(path + ".corrupt")
+	if err != nil {
+		t.Fatalf("error reading the preserved records: %v", err)
+	}
+	want := records[len(encodeOutboxRecord(outboxRecordPut, 0, []byte("one"))):]
+	if !reflect.DeepEqual(tail, want) {
+		t.Errorf("preserved %q, want %q", tail, want)
+	}
+}
+
+func TestOutbox_PublishWriteError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	down := &MockPublisher{failures: 1 << 30}
+	o := newTestOutbox(t, path, down)
+
+	// The write fails, the record may still be on disk in part.
+	o.mu.Lock()
+	file := o.file
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.file = readOnly
+	o.mu.Unlock()
+	if err := o.Publish(context.Background(), &MockPayload{payload: []byte("lost")}); err == nil {
+		t.Fatal("Outbox.Publish() expected error")
+	}
+	o.mu.Lock()
+	o.file = file
+	o.mu.Unlock()
+	readOnly.Close()
+
+	publishAll(t, o, "one")
+	o.mu.Lock()
+	seq := o.pending[0].seq
+	o.mu.Unlock()
+	if seq != 1 {
+		t.Errorf("Outbox.Publish() reused sequence %d of the failed write", seq)
+	}
+	o.Close()
+}
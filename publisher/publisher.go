@@ -1,7 +1,10 @@
 // Publisher is a message publisher that publishes resutls to Asgard.
 package publisher
 
-import "context"
+import (
+	"context"
+	"fmt"
+)
 
 type Payload interface {
 	Bytes() ([]byte, error)
@@ -10,3 +13,32 @@ type Payload interface {
 type Publisher interface {
 	Publish(ctx context.Context, payload Payload) error
 }
+
+// New returns a Publisher of the given type. opts must be the options of
+// that type: *HTTPOpts for PublisherTypeHTTP, *RabbitMQOpts for
+// PublisherTypeRabbitMQ, *NATSOpts for PublisherTypeNATS and *KafkaOpts for
+// PublisherTypeKafka. A nil opts is an error.
+func New(ctx context.Context, publisherType string, opts interface{}) (Publisher, error) {
+	switch publisherType {
+	case PublisherTypeHTTP:
+		if o, ok := opts.(*HTTPOpts); ok && o != nil {
+			return NewHTTPPublisher(o), nil
+		}
+	case PublisherTypeRabbitMQ:
+		if o, ok := opts.(*RabbitMQOpts); ok && o != nil {
+			return NewRabbitMQPublisher(ctx, o), nil
+		}
+	case PublisherTypeNATS:
+		if o, ok := opts.(*NATSOpts); ok && o != nil {
+			return NewNATSPublisher(o)
+		}
+	case PublisherTypeKafka:
+		if o, ok := opts.(*KafkaOpts); ok && o != nil {
+			return NewKafkaPublisher(o)
+		}
+	default:
+		return nil, fmt.Errorf("expected publisherType to be one of %q, %q, %q or %q. Received %s",
+			PublisherTypeHTTP, PublisherTypeRabbitMQ, PublisherTypeNATS, PublisherTypeKafka, publisherType)
+	}
+	return nil, fmt.Errorf("unexpected options %T for publisher type %s, want non-nil options of that type", opts, publisherType)
+}
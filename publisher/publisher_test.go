@@ -0,0 +1,80 @@
+package publisher
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name          string
+		publisherType string
+		opts          interface{}
+		want          Publisher
+		wantErr       bool
+	}{
+		{
+			name:          "http",
+			publisherType: PublisherTypeHTTP,
+			opts:          &HTTPOpts{URL: "http://localhost:8080"},
+			want:          &HTTPPublisher{},
+		},
+		{
+			name:          "kafka",
+			publisherType: PublisherTypeKafka,
+			opts:          &KafkaOpts{Brokers: []string{"localhost:9092"}, Topic: "results"},
+			want:          &Kafka{},
+		},
+		{
+			name:          "kafka without topic",
+			publisherType: PublisherTypeKafka,
+			opts:          &KafkaOpts{Brokers: []string{"localhost:9092"}},
+			wantErr:       true,
+		},
+		{
+			name:          "nats without subject",
+			publisherType: PublisherTypeNATS,
+			opts:          &NATSOpts{URL: "nats://localhost:4222"},
+			wantErr:       true,
+		},
+		{
+			name:          "mismatched options",
+			publisherType: PublisherTypeRabbitMQ,
+			opts:          &HTTPOpts{URL: "http://localhost:8080"},
+			wantErr:       true,
+		},
+		{
+			name:          "nil options",
+			publisherType: PublisherTypeHTTP,
+			opts:          (*HTTPOpts)(nil),
+			wantErr:       true,
+		},
+		{
+			name:          "nil kafka options",
+			publisherType: PublisherTypeKafka,
+			opts:          (*KafkaOpts)(nil),
+			wantErr:       true,
+		},
+		{
+			name:          "unknown type",
+			publisherType: "sqs",
+			opts:          &HTTPOpts{URL: "http://localhost:8080"},
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(context.Background(), tt.publisherType, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("New() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
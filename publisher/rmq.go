@@ -5,7 +5,9 @@ import (
 	"log"
 	"time"
 
-	"github.com/furdarius/rabbitroutine"
+	"github.com/deepcode-ai/artifacts/rmq"
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/deepcode-ai/artifacts/trace/carriers"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -17,50 +19,98 @@ const (
 	RabbitMQCompressionHeader      = "compression"
 	RabbitMQCompressionZstd        = "application/zstd"
 	RabbitMQContentType            = "application/json"
-	RabbitMQReconnectAttempts      = 5               // How many times to attempt reconnecting
+	RabbitMQReconnectAttempts      = 5               // How many times to attempt dialing in a row
 	RabbitMQReconnectWait          = 1 * time.Second // How long to wait before another reconnect attempt
 	RabbitMQPublishBaseDelay       = 2 * time.Second // Base duration for every retry
 	RabbitMQMaxPublishRetries uint = 5               // Max number of retries
 )
 
 type RabbitMQOpts struct {
-	URL        string
-	Exchange   string
-	RoutingKey string
-	Compress   bool
+	URL        string `mapstructure:"url"`
+	Exchange   string `mapstructure:"exchange"`
+	RoutingKey string `mapstructure:"routing_key"`
+	Compress   bool   `mapstructure:"compress"`
+
+	// Conn is the connection to publish on, shared with the other consumers
+	// and publishers of the service. When nil, the publisher opens its own
+	// connection to URL.
+	Conn *rmq.Conn `mapstructure:"-"`
+}
+
+// AMQPProperties are the message properties a payload can ask the RabbitMQ
+// publisher to set, on top of the defaults.
+type AMQPProperties struct {
+	Headers         map[string]interface{}
+	ContentType     string
+	ContentEncoding string
+	CorrelationID   string
+	DeliveryMode    uint8
+}
+
+// AMQPPayload is implemented by payloads that carry their own AMQP headers and
+// properties, like Celery task messages.
+type AMQPPayload interface {
+	Payload
+	AMQPProperties() AMQPProperties
+}
+
+// amqpPublisher publishes a message and waits for the broker to confirm it,
+// like *rmq.Conn.
+type amqpPublisher interface {
+	Publish(ctx context.Context, exchange, key string, message amqp.Publishing) error
 }
 
 type RabbitMQ struct {
-	publisher  rabbitroutine.Publisher
+	publisher  amqpPublisher
+	conn       *rmq.Conn // closed by Close when owned by the publisher
 	exchange   string
 	routingKey string
 	compress   bool
 }
 
-var connector = rabbitroutine.NewConnector(rabbitroutine.Config{
-	Wait:              RabbitMQReconnectWait,     // how long wait between reconnect
-	ReconnectAttempts: RabbitMQReconnectAttempts, // max attempts for dialling
-})
-
-var rabbitroutinePublisher = rabbitroutine.NewRetryPublisher(
-	rabbitroutine.NewEnsurePublisher(rabbitroutine.NewPool(connector)),
-	rabbitroutine.PublishMaxAttemptsSetup(RabbitMQMaxPublishRetries),
-	rabbitroutine.PublishDelaySetup(
-		rabbitroutine.LinearDelay(RabbitMQPublishBaseDelay), // time.Duration(attempt) * delay
-	),
-)
-
 func NewRabbitMQPublisher(ctx context.Context, opts *RabbitMQOpts) Publisher {
-	go connector.Dial(ctx, opts.URL)
-	return &RabbitMQ{
-		publisher:  rabbitroutinePublisher,
+	r := &RabbitMQ{
 		exchange:   opts.Exchange,
 		routingKey: opts.RoutingKey,
 		compress:   opts.Compress,
 	}
+
+	conn := opts.Conn
+	if conn == nil {
+		conn = rmq.NewConn(ctx, &rmq.ConnOpts{
+			URL:            opts.URL,
+			ReconnectDelay: RabbitMQReconnectWait,
+			MaxAttempts:    RabbitMQReconnectAttempts,
+		})
+		r.conn = conn
+	}
+	r.publisher = &retryPublisher{
+		publisher: conn,
+		attempts:  RabbitMQMaxPublishRetries,
+		delay:     RabbitMQPublishBaseDelay,
+	}
+	return r
 }
 
-func (r *RabbitMQ) Publish(ctx context.Context, payload Payload) error {
+// Close closes the connection of the publisher, unless it was given one in
+// RabbitMQOpts.
+func (r *RabbitMQ) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+func (r *RabbitMQ) Publish(ctx context.Context, payload Payload) (err error) {
+	ctx, span := trace.Start(ctx, "publish "+r.exchange, trace.SpanKindProducer)
+	span.SetAttribute("messaging.system", PublisherTypeRabbitMQ)
+	span.SetAttribute("messaging.destination", r.exchange)
+	span.SetAttribute("messaging.routing_key", r.routingKey)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	body, err := payload.Bytes()
 	if err != nil {
 		log.Println("error while compressing payload before publishing to RabbitMQ", err)
@@ -73,12 +123,23 @@ func (r *RabbitMQ) Publish(ctx context.Context, payload Payload) error {
 		Body:         body,
 	}
 
+	if p, ok := payload.(AMQPPayload); ok {
+		applyAMQPProperties(&message, p.AMQPProperties())
+	}
+
 	if r.compress {
-		message.Headers = amqp.Table{
-			RabbitMQCompressionHeader: RabbitMQCompressionZstd,
+		if message.Headers == nil {
+			message.Headers = amqp.Table{}
 		}
+		message.Headers[RabbitMQCompressionHeader] = RabbitMQCompressionZstd
 	}
 
+	// The trace context is propagated to the consumers in the headers.
+	if message.Headers == nil {
+		message.Headers = amqp.Table{}
+	}
+	trace.Inject(ctx, carriers.AMQP(message.Headers))
+
 	if err := r.publisher.Publish(ctx,
 		r.exchange,   // Exchange
 		r.routingKey, // Routing key
@@ -90,3 +151,52 @@ func (r *RabbitMQ) Publish(ctx context.Context, payload Payload) error {
 	log.Println("published to RabbitMQ")
 	return nil
 }
+
+// applyAMQPProperties overrides the defaults of the message with the
+// properties set by the payload.
+func applyAMQPProperties(message *amqp.Publishing, props AMQPProperties) {
+	if len(props.Headers) > 0 {
+		message.Headers = make(amqp.Table, len(props.Headers))
+		for k, v := range props.Headers {
+			message.Headers[k] = v
+		}
+	}
+	if props.ContentType != "" {
+		message.ContentType = props.ContentType
+	}
+	if props.ContentEncoding != "" {
+		message.ContentEncoding = props.ContentEncoding
+	}
+	if props.CorrelationID != "" {
+		message.CorrelationId = props.CorrelationID
+	}
+	if props.DeliveryMode != 0 {
+		message.DeliveryMode = props.DeliveryMode
+	}
+}
+
+// retryPublisher retries failed publishings up to attempts times, waiting
+// attempt * delay before every retry.
+type retryPublisher struct {
+	publisher amqpPublisher
+	attempts  uint
+	delay     time.Duration
+}
+
+func (p *retryPublisher) Publish(ctx context.Context, exchange, key string, message amqp.Publishing) error {
+	var err error
+	for attempt := uint(1); ; attempt++ {
+		if err = p.publisher.Publish(ctx, exchange, key, message); err == nil || attempt >= p.attempts {
+			return err
+		}
+		log.Printf("error while publishing to RabbitMQ, attempt %d: %v", attempt, err)
+
+		timer := time.NewTimer(time.Duration(attempt) * p.delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
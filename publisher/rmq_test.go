@@ -3,9 +3,12 @@ package publisher
 import (
 	"context"
 	"errors"
-	"reflect"
 	"testing"
+	"time"
 
+	"github.com/deepcode-ai/artifacts/rmq"
+	"github.com/deepcode-ai/artifacts/trace"
+	"github.com/deepcode-ai/artifacts/trace/carriers"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -72,8 +75,65 @@ func TestNewRabbitMQPublisher(t *testing.T) {
 		t.Errorf("NewRabbitMQPublisher() routingKey = %v, want %v", p.routingKey, "celery")
 	}
 
-	if !reflect.DeepEqual(p.publisher, rabbitroutinePublisher) {
-		t.Errorf("NewRabbitMQPublisher() publisher = %v, want %v", p.publisher, rabbitroutinePublisher)
+	retry, ok := p.publisher.(*retryPublisher)
+	if !ok || retry.publisher != p.conn || retry.attempts != RabbitMQMaxPublishRetries {
+		t.Errorf("NewRabbitMQPublisher() publisher = %#v, want retries over its own connection", p.publisher)
+	}
+	if err := p.Publish(ctx, &MockPayload{payload: []byte("test")}); err != nil {
+		t.Errorf("RabbitMQ.Publish() error = %v", err)
+	}
+	p.Close()
+}
+
+func TestNewRabbitMQPublisher_SharedConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := rmq.NewConn(ctx, &rmq.ConnOpts{URL: RESULT_RMQ_URL})
+
+	p := NewRabbitMQPublisher(ctx, &RabbitMQOpts{Exchange: "celery", Conn: conn}).(*RabbitMQ)
+	if retry := p.publisher.(*retryPublisher); retry.publisher != conn {
+		t.Errorf("NewRabbitMQPublisher() publishes on %v, want the shared connection", retry.publisher)
+	}
+	if p.Close(); conn.Err() != nil {
+		t.Error("RabbitMQ.Close() closed the shared connection")
+	}
+}
+
+type FlakyAMQPPublisher struct {
+	failures int
+	calls    int
+}
+
+func (p *FlakyAMQPPublisher) Publish(_ context.Context, _, _ string, _ amqp.Publishing) error {
+	p.calls++
+	if p.calls <= p.failures {
+		return errors.New("test-error")
+	}
+	return nil
+}
+
+func TestRetryPublisher(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "success after retries", failures: 2, wantCalls: 3},
+		{name: "out of attempts", failures: 5, wantCalls: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := &FlakyAMQPPublisher{failures: tt.failures}
+			p := &retryPublisher{publisher: flaky, attempts: 3, delay: time.Millisecond}
+			if err := p.Publish(context.Background(), "celery", "celery", amqp.Publishing{}); (err != nil) != tt.wantErr {
+				t.Errorf("retryPublisher.Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if flaky.calls != tt.wantCalls {
+				t.Errorf("retryPublisher.Publish() calls = %d, want %d", flaky.calls, tt.wantCalls)
+			}
+		})
 	}
 }
 
@@ -148,3 +208,85 @@ func TestRabbitMQ_Publish(t *testing.T) {
 		})
 	}
 }
+
+type MockAMQPPayload struct {
+	MockPayload
+	props AMQPProperties
+}
+
+func (p *MockAMQPPayload) AMQPProperties() AMQPProperties {
+	return p.props
+}
+
+type RecordingAMQPPublisher struct {
+	message amqp.Publishing
+}
+
+func (p *RecordingAMQPPublisher) Publish(_ context.Context, _, _ string, message amqp.Publishing) error {
+	p.message = message
+	return nil
+}
+
+func TestRabbitMQ_PublishAMQPPayload(t *testing.T) {
+	recorder := &RecordingAMQPPublisher{}
+	r := &RabbitMQ{
+		publisher: recorder,
+		compress:  true,
+	}
+
+	payload := &MockAMQPPayload{
+		MockPayload: MockPayload{payload: []byte("test")},
+		props: AMQPProperties{
+			Headers:         map[string]interface{}{"task": "test-task"},
+			ContentEncoding: "utf-8",
+			CorrelationID:   "test-id",
+			DeliveryMode:    amqp.Persistent,
+		},
+	}
+	if err := r.Publish(context.Background(), payload); err != nil {
+		t.Fatalf("RabbitMQ.Publish() error = %v", err)
+	}
+
+	message := recorder.message
+	if message.Headers["task"] != "test-task" {
+		t.Errorf("RabbitMQ.Publish() task header = %v, want test-task", message.Headers["task"])
+	}
+	if message.Headers[RabbitMQCompressionHeader] != RabbitMQCompressionZstd {
+		t.Errorf("RabbitMQ.Publish() compression header = %v, want %v", message.Headers[RabbitMQCompressionHeader], RabbitMQCompressionZstd)
+	}
+	if message.ContentType != RabbitMQContentType || message.ContentEncoding != "utf-8" {
+		t.Errorf("RabbitMQ.Publish() content type = %v, encoding = %v", message.ContentType, message.ContentEncoding)
+	}
+	if message.CorrelationId != "test-id" || message.DeliveryMode != amqp.Persistent {
+		t.Errorf("RabbitMQ.Publish() correlation id = %v, delivery mode = %v", message.CorrelationId, message.DeliveryMode)
+	}
+	if _, ok := payload.props.Headers[RabbitMQCompressionHeader]; ok {
+		t.Error("RabbitMQ.Publish() must not modify the payload headers")
+	}
+}
+
+func TestRabbitMQ_PublishTraceContext(t *testing.T) {
+	exporter := &trace.InMemoryExporter{}
+	trace.SetDefault(trace.NewTracer(exporter))
+	defer trace.SetDefault(trace.NewTracer(nil))
+
+	recorder := &RecordingAMQPPublisher{}
+	r := &RabbitMQ{publisher: recorder, exchange: "celery"}
+
+	ctx, parent := trace.Start(context.Background(), "handle", trace.SpanKindInternal)
+	if err := r.Publish(ctx, &MockPayload{payload: []byte("test")}); err != nil {
+		t.Fatalf("RabbitMQ.Publish() error = %v", err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Kind != trace.SpanKindProducer {
+		t.Fatalf("exported spans %+v, want a producer span", spans)
+	}
+	if spans[0].Parent != parent.SpanContext() {
+		t.Errorf("producer span parent = %+v, want %+v", spans[0].Parent, parent.SpanContext())
+	}
+	got := trace.SpanContextFromContext(trace.Extract(context.Background(), carriers.AMQP(recorder.message.Headers)))
+	if got.SpanID != spans[0].SpanContext.SpanID || got.TraceID != parent.SpanContext().TraceID {
+		t.Errorf("RabbitMQ.Publish() propagated %+v, want the producer span %+v", got, spans[0].SpanContext)
+	}
+}
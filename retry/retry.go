@@ -0,0 +1,223 @@
+// Package retry runs operations until they succeed, backing off between
+// attempts:
+//
+//	err := retry.Do(ctx, &retry.Opts{
+//		Op:        "restart deployment",
+//		Attempts:  5,
+//		Strategy:  retry.Exponential(time.Second),
+//		MaxDelay:  30 * time.Second,
+//		Jitter:    0.2,
+//		Retryable: isTransient,
+//		OnRetry:   logRetry,
+//	}, func(ctx context.Context) error {
+//		...
+//	})
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultAttempts = 5
+	DefaultDelay    = 1 * time.Second
+)
+
+// ErrExhausted is matched, with errors.Is, by the *Error returned once Do
+// has used up its attempts or its time.
+var ErrExhausted = errors.New("retry: attempts exhausted")
+
+// Error is returned by Do when every attempt failed. It matches both
+// ErrExhausted and the error of the last attempt.
+type Error struct {
+	Op       string
+	Attempts int
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("failed to %s after %d attempts: %v", e.Op, e.Attempts, e.Err)
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{ErrExhausted, e.Err}
+}
+
+// Strategy returns how long to wait after the given failed attempt, starting
+// from 1.
+type Strategy func(attempt int) time.Duration
+
+// Constant waits d after every attempt.
+func Constant(d time.Duration) Strategy {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// Linear waits d after the first attempt, 2d after the second and so on.
+func Linear(d time.Duration) Strategy {
+	return func(attempt int) time.Duration {
+		return time.Duration(attempt) * d
+	}
+}
+
+// Exponential waits d after the first attempt and doubles the wait with
+// every attempt.
+func Exponential(d time.Duration) Strategy {
+	return func(attempt int) time.Duration {
+		delay := d
+		for i := 1; i < attempt; i++ {
+			if delay > maxDuration/2 {
+				return maxDuration
+			}
+			delay *= 2
+		}
+		return delay
+	}
+}
+
+// Fibonacci waits d, 2d, 3d, 5d, 8d and so on, following the Fibonacci
+// series. The wait saturates instead of overflowing.
+func Fibonacci(d time.Duration) Strategy {
+	return func(attempt int) time.Duration {
+		if d <= 0 || attempt < 1 {
+			return 0
+		}
+		limit := int64(maxDuration / d)
+		n, next := int64(1), int64(2)
+		for i := 1; i < attempt; i++ {
+			if next > limit {
+				return maxDuration
+			}
+			n, next = next, saturatingAdd(n, next)
+		}
+		return time.Duration(n) * d
+	}
+}
+
+const maxDuration = time.Duration(1<<63 - 1)
+
+func saturatingAdd(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// FibonacciNext returns the next number in the Fibonacci series greater than
+// start, or math.MaxInt when there is none.
+func FibonacciNext(start int) int {
+	n, next := 1, 1
+	for n <= start {
+		if next > math.MaxInt-n {
+			return math.MaxInt
+		}
+		n, next = next, n+next
+	}
+	return n
+}
+
+type Opts struct {
+	// Op names the operation in errors, as in "failed to <Op> after 3
+	// attempts". Defaults to "run operation".
+	Op string
+	// Attempts is how many times to run the operation before giving up.
+	// Defaults to DefaultAttempts. A negative value retries until
+	// MaxElapsed is reached or ctx is done.
+	Attempts int
+	// Strategy computes the wait between attempts. Defaults to
+	// Constant(DefaultDelay).
+	Strategy Strategy
+	// MaxDelay caps the wait between two attempts. Zero means no cap.
+	MaxDelay time.Duration
+	// Jitter randomizes every wait by up to this fraction of it, in either
+	// direction. Zero disables it.
+	Jitter float64
+	// MaxElapsed gives up once the next attempt would start later than this
+	// after the first one. Zero means no limit.
+	MaxElapsed time.Duration
+	// Retryable reports whether an error is worth retrying. Errors it
+	// rejects are returned right away. Nil retries every error.
+	Retryable func(error) bool
+	// OnRetry is called after every failed attempt that is retried, with
+	// the wait before the next one.
+	OnRetry func(attempt int, delay time.Duration, err error)
+}
+
+func (o *Opts) setDefaults() {
+	if o.Op == "" {
+		o.Op = "run operation"
+	}
+	if o.Attempts == 0 {
+		o.Attempts = DefaultAttempts
+	}
+	if o.Strategy == nil {
+		o.Strategy = Constant(DefaultDelay)
+	}
+}
+
+// delay returns how long to wait after the given failed attempt.
+func (o *Opts) delay(attempt int) time.Duration {
+	delay := o.Strategy(attempt)
+	if o.MaxDelay > 0 && delay > o.MaxDelay {
+		delay = o.MaxDelay
+	}
+	if o.Jitter > 0 {
+		delay += time.Duration(o.Jitter * (2*rand.Float64() - 1) * float64(delay))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// Do runs fn until it succeeds, backing off between failed attempts. It
+// returns the error of fn as is when Retryable rejects it, an *Error once
+// the attempts or MaxElapsed are used up, and the error of ctx, wrapping the
+// last error, once ctx is done.
+func Do(ctx context.Context, opts *Opts, fn func(context.Context) error) error {
+	o := Opts{}
+	if opts != nil {
+		o = *opts
+	}
+	o.setDefaults()
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("error retrying to %s: %w", o.Op, err)
+		}
+
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if o.Retryable != nil && !o.Retryable(err) {
+			return err
+		}
+		if o.Attempts > 0 && attempt >= o.Attempts {
+			return &Error{Op: o.Op, Attempts: attempt, Err: err}
+		}
+
+		delay := o.delay(attempt)
+		if o.MaxElapsed > 0 && time.Since(start)+delay > o.MaxElapsed {
+			return &Error{Op: o.Op, Attempts: attempt, Err: err}
+		}
+		if o.OnRetry != nil {
+			o.OnRetry(attempt, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("error retrying to %s: %w, last error: %w", o.Op, ctx.Err(), err)
+		}
+	}
+}
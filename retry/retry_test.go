@@ -0,0 +1,149 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy Strategy
+		want     []time.Duration
+	}{
+		{"constant", Constant(time.Second), []time.Duration{time.Second, time.Second, time.Second, time.Second}},
+		{"linear", Linear(time.Second), []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second}},
+		{"exponential", Exponential(time.Second), []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{"fibonacci", Fibonacci(time.Second), []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := tt.strategy(i + 1); got != want {
+					t.Errorf("attempt %d: delay = %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+
+	if got := Exponential(time.Hour)(100); got != maxDuration {
+		t.Errorf("Exponential() overflowed to %s", got)
+	}
+	for _, attempt := range []int{92, 108, 200, 10_000} {
+		if got := Fibonacci(time.Second)(attempt); got != maxDuration {
+			t.Errorf("Fibonacci() at attempt %d = %s, want %s", attempt, got, maxDuration)
+		}
+	}
+	if got := Fibonacci(1)(200); got != maxDuration {
+		t.Errorf("Fibonacci(1) overflowed to %s", got)
+	}
+}
+
+func TestFibonacciNext(t *testing.T) {
+	tests := []struct {
+		start, want int
+	}{
+		{0, 1},
+		{1, 2},
+		{2, 3},
+		{4, 5},
+		{89, 144},
+		{math.MaxInt - 1, math.MaxInt},
+	}
+	for _, tt := range tests {
+		if got := FibonacciNext(tt.start); got != tt.want {
+			t.Errorf("FibonacciNext(%d) = %d, want %d", tt.start, got, tt.want)
+		}
+	}
+}
+
+func TestOpts_delay(t *testing.T) {
+	o := Opts{Strategy: Exponential(time.Second), MaxDelay: 5 * time.Second, Jitter: 0.5}
+	for attempt := 1; attempt <= 10; attempt++ {
+		want := Exponential(time.Second)(attempt)
+		if want > o.MaxDelay {
+			want = o.MaxDelay
+		}
+		if got := o.delay(attempt); got < want/2 || got > want*3/2 {
+			t.Errorf("attempt %d: delay = %s, want within 50%% of %s", attempt, got, want)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	errTransient := errors.New("transient")
+	errPermanent := errors.New("permanent")
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		var attempts, retries int
+		err := Do(context.Background(), &Opts{Strategy: Constant(0), OnRetry: func(int, time.Duration, error) { retries++ }},
+			func(context.Context) error {
+				if attempts++; attempts < 3 {
+					return errTransient
+				}
+				return nil
+			})
+		if err != nil || attempts != 3 || retries != 2 {
+			t.Errorf("Do() = %v after %d attempts and %d retries, want nil after 3 and 2", err, attempts, retries)
+		}
+	})
+
+	t.Run("gives up after attempts", func(t *testing.T) {
+		attempts := 0
+		err := Do(context.Background(), &Opts{Op: "trigger job", Attempts: 4, Strategy: Constant(0)},
+			func(context.Context) error {
+				attempts++
+				return errTransient
+			})
+		var retryErr *Error
+		if !errors.As(err, &retryErr) || retryErr.Attempts != 4 || retryErr.Op != "trigger job" {
+			t.Fatalf("Do() error = %v, want an *Error after 4 attempts", err)
+		}
+		if !errors.Is(err, ErrExhausted) || !errors.Is(err, errTransient) {
+			t.Errorf("Do() error = %v, want it to match ErrExhausted and the last error", err)
+		}
+		if attempts != 4 {
+			t.Errorf("attempts = %d, want 4", attempts)
+		}
+	})
+
+	t.Run("stops on permanent errors", func(t *testing.T) {
+		attempts := 0
+		err := Do(context.Background(), &Opts{
+			Strategy:  Constant(0),
+			Retryable: func(err error) bool { return !errors.Is(err, errPermanent) },
+		}, func(context.Context) error {
+			attempts++
+			return errPermanent
+		})
+		if err != errPermanent || attempts != 1 {
+			t.Errorf("Do() = %v after %d attempts, want %v after 1", err, attempts, errPermanent)
+		}
+	})
+
+	t.Run("stops after max elapsed", func(t *testing.T) {
+		attempts := 0
+		err := Do(context.Background(), &Opts{Attempts: -1, Strategy: Constant(20 * time.Millisecond), MaxElapsed: 50 * time.Millisecond},
+			func(context.Context) error {
+				attempts++
+				return errTransient
+			})
+		if !errors.Is(err, ErrExhausted) || attempts != 3 {
+			t.Errorf("Do() = %v after %d attempts, want ErrExhausted after 3", err, attempts)
+		}
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := Do(ctx, &Opts{Attempts: -1, Strategy: Constant(time.Hour)}, func(context.Context) error {
+			cancel()
+			return errTransient
+		})
+		if !errors.Is(err, context.Canceled) || !errors.Is(err, errTransient) {
+			t.Errorf("Do() error = %v, want it to match context.Canceled and the last error", err)
+		}
+	})
+}
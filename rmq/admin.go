@@ -0,0 +1,191 @@
+package rmq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DefaultManagementTimeout = 10 * time.Second
+	DefaultVHost             = "/"
+)
+
+// ErrNotFound is returned by Admin when the object does not exist.
+var ErrNotFound = errors.New("rmq: not found")
+
+// Admin reads the topology of a vhost and manages its policies.
+type Admin interface {
+	Exchange(ctx context.Context, name string) (*Exchange, error)
+	Queue(ctx context.Context, name string) (*Queue, error)
+	Bindings(ctx context.Context, exchange, queue string) ([]Binding, error)
+	Policy(ctx context.Context, name string) (*Policy, error)
+	PutPolicy(ctx context.Context, policy *Policy) error
+}
+
+type ManagementOpts struct {
+	// URL is the URL of the management API, like http://localhost:15672.
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// VHost defaults to DefaultVHost.
+	VHost   string        `mapstructure:"vhost"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// ManagementClient is an Admin backed by the RabbitMQ management API.
+type ManagementClient struct {
+	url      string
+	username string
+	password string
+	vhost    string
+	client   *http.Client
+}
+
+func NewManagementClient(opts *ManagementOpts) *ManagementClient {
+	vhost := opts.VHost
+	if vhost == "" {
+		vhost = DefaultVHost
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultManagementTimeout
+	}
+	return &ManagementClient{
+		url:      strings.TrimSuffix(opts.URL, "/"),
+		username: opts.Username,
+		password: opts.Password,
+		vhost:    vhost,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// do sends the request to the path under the vhost and decodes the response
+// into v, when not nil.
+func (c *ManagementClient) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode >= 300:
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("management API returned %s: %s", resp.Status, bytes.TrimSpace(b))
+	case v == nil:
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *ManagementClient) path(kind string, names ...string) string {
+	path := "/api/" + kind + "/" + url.PathEscape(c.vhost)
+	for _, name := range names {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
+
+func (c *ManagementClient) Exchange(ctx context.Context, name string) (*Exchange, error) {
+	var e struct {
+		Type       string     `json:"type"`
+		Durable    bool       `json:"durable"`
+		AutoDelete bool       `json:"auto_delete"`
+		Internal   bool       `json:"internal"`
+		Arguments  amqp.Table `json:"arguments"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.path("exchanges", name), nil, &e); err != nil {
+		return nil, err
+	}
+	return &Exchange{
+		Name:       name,
+		Kind:       e.Type,
+		Durable:    e.Durable,
+		AutoDelete: e.AutoDelete,
+		Internal:   e.Internal,
+		Args:       e.Arguments,
+	}, nil
+}
+
+func (c *ManagementClient) Queue(ctx context.Context, name string) (*Queue, error) {
+	var q struct {
+		Type       string     `json:"type"`
+		Durable    bool       `json:"durable"`
+		AutoDelete bool       `json:"auto_delete"`
+		Exclusive  bool       `json:"exclusive"`
+		Arguments  amqp.Table `json:"arguments"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.path("queues", name), nil, &q); err != nil {
+		return nil, err
+	}
+	return &Queue{
+		Name:       name,
+		Type:       q.Type,
+		Durable:    q.Durable,
+		AutoDelete: q.AutoDelete,
+		Exclusive:  q.Exclusive,
+		Args:       q.Arguments,
+	}, nil
+}
+
+func (c *ManagementClient) Bindings(ctx context.Context, exchange, queue string) ([]Binding, error) {
+	var bindings []struct {
+		RoutingKey string     `json:"routing_key"`
+		Arguments  amqp.Table `json:"arguments"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.path("bindings", "e", exchange, "q", queue), nil, &bindings); err != nil {
+		return nil, err
+	}
+
+	result := make([]Binding, 0, len(bindings))
+	for _, b := range bindings {
+		result = append(result, Binding{
+			Queue:      queue,
+			Exchange:   exchange,
+			RoutingKey: b.RoutingKey,
+			Args:       b.Arguments,
+		})
+	}
+	return result, nil
+}
+
+func (c *ManagementClient) Policy(ctx context.Context, name string) (*Policy, error) {
+	policy := &Policy{}
+	if err := c.do(ctx, http.MethodGet, c.path("policies", name), nil, policy); err != nil {
+		return nil, err
+	}
+	policy.Name = name
+	return policy, nil
+}
+
+func (c *ManagementClient) PutPolicy(ctx context.Context, policy *Policy) error {
+	return c.do(ctx, http.MethodPut, c.path("policies", policy.Name), policy, nil)
+}
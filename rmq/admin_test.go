@@ -0,0 +1,108 @@
+package rmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestManagementClient(t *testing.T, handler http.HandlerFunc) *ManagementClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewManagementClient(&ManagementOpts{
+		URL:      server.URL + "/",
+		Username: "guest",
+		Password: "guest",
+		VHost:    "janus",
+	})
+}
+
+func TestManagementClient_Queue(t *testing.T) {
+	c := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "guest" || pass != "guest" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/api/queues/janus/analysis-run":
+			w.Write([]byte(`{"name":"analysis-run","type":"quorum","durable":true,"arguments":{"x-queue-type":"quorum"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	q, err := c.Queue(context.Background(), "analysis-run")
+	if err != nil {
+		t.Fatalf("ManagementClient.Queue() error = %v", err)
+	}
+	if q.Type != QueueTypeQuorum || !q.Durable || q.Args["x-queue-type"] != QueueTypeQuorum {
+		t.Errorf("ManagementClient.Queue() = %+v", q)
+	}
+
+	if _, err := c.Queue(context.Background(), "autofix-run"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ManagementClient.Queue() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestManagementClient_Bindings(t *testing.T) {
+	c := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/bindings/janus/e/atlas-jobs/q/analysis-run" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`[{"routing_key":"analysis-run","arguments":{}}]`))
+	})
+
+	bindings, err := c.Bindings(context.Background(), "atlas-jobs", "analysis-run")
+	if err != nil {
+		t.Fatalf("ManagementClient.Bindings() error = %v", err)
+	}
+	if len(bindings) != 1 || bindings[0].RoutingKey != "analysis-run" || bindings[0].Exchange != "atlas-jobs" {
+		t.Errorf("ManagementClient.Bindings() = %+v", bindings)
+	}
+}
+
+func TestManagementClient_PutPolicy(t *testing.T) {
+	var got map[string]interface{}
+	c := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.EscapedPath() != "/api/policies/janus/analysis-limits" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	err := c.PutPolicy(context.Background(), &Policy{
+		Name:       "analysis-limits",
+		Pattern:    "^analysis-",
+		ApplyTo:    "queues",
+		Definition: map[string]interface{}{"max-length": 10000},
+	})
+	if err != nil {
+		t.Fatalf("ManagementClient.PutPolicy() error = %v", err)
+	}
+	if got["pattern"] != "^analysis-" || got["apply-to"] != "queues" || got["name"] != nil {
+		t.Errorf("ManagementClient.PutPolicy() sent %v", got)
+	}
+}
+
+func TestManagementClient_Error(t *testing.T) {
+	c := newTestManagementClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	if _, err := c.Exchange(context.Background(), "atlas-jobs"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("ManagementClient.Exchange() error = %v, want a server error", err)
+	}
+}
+
+func TestManagementClient_DefaultVHost(t *testing.T) {
+	c := NewManagementClient(&ManagementOpts{URL: "http://localhost:15672"})
+	if got, want := c.path("queues", "analysis-run"), "/api/queues/%2F/analysis-run"; got != want {
+		t.Errorf("ManagementClient.path() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,334 @@
+// Package rmq manages RabbitMQ connections shared by the consumers and the
+// publishers of a service: it keeps the connection up, pools the channels
+// used for publishing and declares topologies.
+package rmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DefaultReconnectDelay    = 1 * time.Second
+	DefaultMaxReconnectDelay = 30 * time.Second
+	DefaultPoolSize          = 8
+)
+
+var (
+	// ErrClosed is returned once the connection is closed for good: Close was
+	// called, its context is done or it ran out of dial attempts.
+	ErrClosed = errors.New("rmq: connection closed")
+	// ErrNotConnected is returned when the connection is down and being
+	// reestablished.
+	ErrNotConnected = errors.New("rmq: not connected")
+	// ErrNacked is returned when the broker does not confirm a publishing.
+	ErrNacked = errors.New("rmq: publishing not confirmed by the broker")
+)
+
+type ConnOpts struct {
+	URL string
+	// Dial opens the connection to URL. Defaults to amqp.Dial.
+	Dial func(url string) (*amqp.Connection, error)
+	// ReconnectDelay is the delay before redialing after a failed dial. It
+	// doubles with every consecutive failure. Defaults to
+	// DefaultReconnectDelay.
+	ReconnectDelay time.Duration
+	// MaxReconnectDelay caps the delay between two dials. Defaults to
+	// DefaultMaxReconnectDelay.
+	MaxReconnectDelay time.Duration
+	// MaxAttempts is the number of consecutive failed dials after which the
+	// connection is closed for good. Zero means dialing forever.
+	MaxAttempts int
+	// PoolSize is how many idle publishing channels are kept open. Defaults
+	// to DefaultPoolSize.
+	PoolSize int
+}
+
+// connection is the subset of *amqp.Connection used by Conn.
+type connection interface {
+	Channel() (*amqp.Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// Conn is a RabbitMQ connection that is reestablished whenever the broker
+// closes it. Channels opened with Channel are bound to the connection of the
+// moment and must be reopened once it is lost; Publish takes care of that.
+type Conn struct {
+	opts  ConnOpts
+	dial  func() (connection, error)
+	pool  *pool
+	hooks hooks
+
+	mu    sync.Mutex
+	conn  connection
+	ready chan struct{} // closed once connected
+	err   error         // why the connection was closed for good
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewConn returns a connection to the broker at opts.URL. It is dialed in the
+// background and redialed whenever it is lost, until ctx is done or Close is
+// called. Use Wait to block until it is up.
+func NewConn(ctx context.Context, opts *ConnOpts) *Conn {
+	dial := opts.Dial
+	if dial == nil {
+		dial = amqp.Dial
+	}
+	c := newConn(opts, func() (connection, error) {
+		conn, err := dial(opts.URL)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+	go c.run(ctx)
+	return c
+}
+
+func newConn(opts *ConnOpts, dial func() (connection, error)) *Conn {
+	if opts.ReconnectDelay == 0 {
+		opts.ReconnectDelay = DefaultReconnectDelay
+	}
+	if opts.MaxReconnectDelay == 0 {
+		opts.MaxReconnectDelay = DefaultMaxReconnectDelay
+	}
+	if opts.PoolSize == 0 {
+		opts.PoolSize = DefaultPoolSize
+	}
+
+	c := &Conn{
+		opts:    *opts,
+		dial:    dial,
+		ready:   make(chan struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	c.pool = newPool(c.opts.PoolSize, c.openPublishChannel)
+	return c
+}
+
+// hooks are called by run as the state of the connection changes. They are
+// set by Supervisor.
+type hooks struct {
+	// connect is called with every new connection before it is used. An
+	// error closes it, and counts as a failed attempt.
+	connect func(conn connection) error
+	// failed is called after every failed attempt.
+	failed func(attempt int, err error)
+	// lost is called when the broker closes the connection.
+	lost func(err error)
+	// closed is called once the connection is closed for good.
+	closed func(err error)
+}
+
+// run dials the connection and redials it whenever it is lost.
+func (c *Conn) run(ctx context.Context) {
+	delay := c.opts.ReconnectDelay
+	for attempt := 1; ; attempt++ {
+		conn, err := c.connect()
+		if err != nil {
+			log.Printf("Failed to connect to RabbitMQ, attempt %d: %v", attempt, err)
+			if c.hooks.failed != nil {
+				c.hooks.failed(attempt, err)
+			}
+			if c.opts.MaxAttempts > 0 && attempt >= c.opts.MaxAttempts {
+				c.shutdown(fmt.Errorf("%w: giving up after %d attempts: %v", ErrClosed, attempt, err))
+				return
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				c.shutdown(fmt.Errorf("%w: %v", ErrClosed, ctx.Err()))
+				return
+			case <-c.closing:
+				c.shutdown(ErrClosed)
+				return
+			}
+			if delay *= 2; delay > c.opts.MaxReconnectDelay {
+				delay = c.opts.MaxReconnectDelay
+			}
+			continue
+		}
+
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		c.connected(conn)
+		log.Println("Successfully connected to RabbitMQ")
+		attempt, delay = 0, c.opts.ReconnectDelay
+
+		select {
+		case reason := <-closed:
+			c.disconnected()
+			err := errors.New("RabbitMQ connection closed")
+			if reason != nil {
+				err = fmt.Errorf("RMQ Connection closed. Code: %d: Reason: %s", reason.Code, reason.Reason)
+			}
+			log.Println(err)
+			sentry.CaptureException(err)
+			if c.hooks.lost != nil {
+				c.hooks.lost(err)
+			}
+		case <-ctx.Done():
+			conn.Close()
+			c.shutdown(fmt.Errorf("%w: %v", ErrClosed, ctx.Err()))
+			return
+		case <-c.closing:
+			conn.Close()
+			c.shutdown(ErrClosed)
+			return
+		}
+	}
+}
+
+// connect dials the connection and runs the connect hook.
+func (c *Conn) connect() (connection, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if c.hooks.connect != nil {
+		if err := c.hooks.connect(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *Conn) connected(conn connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	close(c.ready)
+}
+
+func (c *Conn) disconnected() {
+	c.mu.Lock()
+	c.conn = nil
+	c.ready = make(chan struct{})
+	c.mu.Unlock()
+	c.pool.drain()
+}
+
+func (c *Conn) shutdown(err error) {
+	c.mu.Lock()
+	c.conn = nil
+	c.err = err
+	c.mu.Unlock()
+	c.pool.drain()
+	if c.hooks.closed != nil {
+		c.hooks.closed(err)
+	}
+	close(c.done)
+}
+
+// Wait blocks until the connection is up. It returns the reason the
+// connection was closed for good, wrapping ErrClosed, if it is, and the error
+// of ctx if ctx is done first.
+func (c *Conn) Wait(ctx context.Context) error {
+	c.mu.Lock()
+	ready := c.ready
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel closed once the connection is closed for good.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was closed for good, or nil if it is not.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// IsConnected reports whether the connection is currently up.
+func (c *Conn) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil && !c.conn.IsClosed()
+}
+
+// Channel opens a channel on the current connection. It returns
+// ErrNotConnected while the connection is being reestablished and an error
+// wrapping ErrClosed once it is closed for good.
+func (c *Conn) Channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	conn, err := c.conn, c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+// Publish publishes the message on a pooled channel and waits for the broker
+// to confirm it. If the connection is down, it waits for it to be back until
+// ctx is done.
+func (c *Conn) Publish(ctx context.Context, exchange, key string, message amqp.Publishing) error {
+	if err := c.Wait(ctx); err != nil {
+		return err
+	}
+
+	ch, err := c.pool.get()
+	if err != nil {
+		return fmt.Errorf("error opening publishing channel: %w", err)
+	}
+	if err := ch.publish(ctx, exchange, key, message); err != nil {
+		ch.Close()
+		return err
+	}
+	c.pool.put(ch)
+	return nil
+}
+
+// Close closes the connection for good.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+	<-c.done
+	return nil
+}
+
+func (c *Conn) openPublishChannel() (publishChannel, error) {
+	ch, err := c.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("error enabling publisher confirms: %w", err)
+	}
+	return confirmChannel{ch}, nil
+}
@@ -0,0 +1,180 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MockConnection is a connection the test closes like the broker would.
+type MockConnection struct {
+	mu     sync.Mutex
+	notify chan *amqp.Error
+	closed bool
+}
+
+func (c *MockConnection) Channel() (*amqp.Channel, error) {
+	return nil, errors.New("test-error")
+}
+
+func (c *MockConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify = receiver
+	return receiver
+}
+
+func (c *MockConnection) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *MockConnection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *MockConnection) closeByBroker() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.notify <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+}
+
+// MockDialer fails to dial the first failures times and records the
+// connections it returns.
+type MockDialer struct {
+	mu          sync.Mutex
+	failures    int
+	dials       int
+	connections []*MockConnection
+	dialed      chan *MockConnection
+}
+
+func newMockDialer(failures int) *MockDialer {
+	return &MockDialer{failures: failures, dialed: make(chan *MockConnection, 8)}
+}
+
+func (d *MockDialer) dial() (connection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.dials <= d.failures {
+		return nil, errors.New("connection refused")
+	}
+	conn := &MockConnection{}
+	d.connections = append(d.connections, conn)
+	d.dialed <- conn
+	return conn, nil
+}
+
+func (d *MockDialer) waitForDial(t *testing.T) *MockConnection {
+	t.Helper()
+	select {
+	case conn := <-d.dialed:
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a dial")
+		return nil
+	}
+}
+
+func newTestConn(ctx context.Context, dialer *MockDialer, maxAttempts int) *Conn {
+	c := newConn(&ConnOpts{
+		ReconnectDelay:    time.Millisecond,
+		MaxReconnectDelay: 4 * time.Millisecond,
+		MaxAttempts:       maxAttempts,
+	}, dialer.dial)
+	go c.run(ctx)
+	return c
+}
+
+func TestConn_Reconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialer := newMockDialer(2)
+	c := newTestConn(ctx, dialer, 0)
+
+	if err := c.Wait(ctx); err != nil {
+		t.Fatalf("Conn.Wait() error = %v", err)
+	}
+	first := dialer.waitForDial(t)
+	if !c.IsConnected() {
+		t.Error("Conn.IsConnected() = false after connecting")
+	}
+
+	first.closeByBroker()
+	second := dialer.waitForDial(t)
+	if err := c.Wait(ctx); err != nil {
+		t.Fatalf("Conn.Wait() error = %v after reconnecting", err)
+	}
+	if first == second || !c.IsConnected() {
+		t.Error("Conn did not reconnect after the broker closed the connection")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Conn.Close() error = %v", err)
+	}
+	if !second.IsClosed() {
+		t.Error("Conn.Close() did not close the connection")
+	}
+	if _, err := c.Channel(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Conn.Channel() error = %v after Close, want %v", err, ErrClosed)
+	}
+}
+
+func TestConn_MaxAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialer := newMockDialer(10)
+	c := newTestConn(ctx, dialer, 3)
+
+	if err := c.Wait(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Conn.Wait() error = %v, want %v", err, ErrClosed)
+	}
+	if dialer.dials != 3 {
+		t.Errorf("Conn dialed %d times, want 3", dialer.dials)
+	}
+}
+
+func TestConn_WaitContext(t *testing.T) {
+	dialer := newMockDialer(1 << 30)
+	c := newTestConn(context.Background(), dialer, 0)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Conn.Wait() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := c.Channel(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Conn.Channel() error = %v while connecting, want %v", err, ErrNotConnected)
+	}
+}
+
+func TestConn_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dialer := newMockDialer(0)
+	c := newTestConn(ctx, dialer, 0)
+	conn := dialer.waitForDial(t)
+
+	cancel()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Conn was not closed once ctx is done")
+	}
+	if err := c.Wait(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Conn.Wait() error = %v after ctx is done, want %v", err, ErrClosed)
+	}
+	if !conn.IsClosed() {
+		t.Error("Conn did not close the connection once ctx is done")
+	}
+}
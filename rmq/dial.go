@@ -0,0 +1,163 @@
+package rmq
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"time"
+
+	"github.com/deepcode-ai/artifacts/dslog"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	DefaultDialMaxAttempts    = 10
+	DefaultDialInitialBackoff = 1 * time.Second
+	DefaultDialMaxBackoff     = 30 * time.Second
+	DefaultDialJitter         = 0.2
+	DefaultHeartbeat          = 10 * time.Second
+)
+
+// ErrDialExhausted is matched, with errors.Is, by the *DialError returned
+// once Dial has used up its attempts.
+var ErrDialExhausted = errors.New("rmq: dial attempts exhausted")
+
+// DialError is returned by Dial when every attempt failed. It matches both
+// ErrDialExhausted and the error of the last attempt.
+type DialError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("failed to connect to RabbitMQ after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *DialError) Unwrap() []error {
+	return []error{ErrDialExhausted, e.Err}
+}
+
+type DialOptions struct {
+	// MaxAttempts is how many times to dial before giving up. Defaults to
+	// DefaultDialMaxAttempts.
+	MaxAttempts int
+	// InitialBackoff is the wait after the first failed attempt. It doubles
+	// with every attempt. Defaults to DefaultDialInitialBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts. Defaults to
+	// DefaultDialMaxBackoff.
+	MaxBackoff time.Duration
+	// Jitter randomizes every wait by up to this fraction of it, in either
+	// direction, so that services restarting together do not dial in
+	// lockstep. Zero disables it.
+	Jitter float64
+	// TLSConfig is used for amqps:// URLs. Defaults to the system roots.
+	TLSConfig *tls.Config
+	// Heartbeat is the heartbeat interval negotiated with the broker.
+	// Defaults to DefaultHeartbeat.
+	Heartbeat time.Duration
+}
+
+// DefaultDialOptions returns the options used when none are given, with
+// jitter enabled.
+func DefaultDialOptions() DialOptions {
+	return DialOptions{
+		MaxAttempts:    DefaultDialMaxAttempts,
+		InitialBackoff: DefaultDialInitialBackoff,
+		MaxBackoff:     DefaultDialMaxBackoff,
+		Jitter:         DefaultDialJitter,
+		Heartbeat:      DefaultHeartbeat,
+	}
+}
+
+func (o *DialOptions) setDefaults() {
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = DefaultDialMaxAttempts
+	}
+	if o.InitialBackoff == 0 {
+		o.InitialBackoff = DefaultDialInitialBackoff
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = DefaultDialMaxBackoff
+	}
+	if o.Heartbeat == 0 {
+		o.Heartbeat = DefaultHeartbeat
+	}
+}
+
+// backoff returns how long to wait after the given failed attempt.
+func (o *DialOptions) backoff(attempt int) time.Duration {
+	delay := o.InitialBackoff
+	for i := 1; i < attempt && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxBackoff {
+		delay = o.MaxBackoff
+	}
+	if o.Jitter > 0 {
+		delay += time.Duration(o.Jitter * (2*rand.Float64() - 1) * float64(delay))
+	}
+	return delay
+}
+
+// Dial connects to the broker at rawURL, backing off between failed attempts.
+// It gives up with a *DialError once opts.MaxAttempts attempts failed, and
+// with the error of ctx once ctx is done. Every attempt is logged.
+func Dial(ctx context.Context, rawURL string, opts DialOptions) (*amqp.Connection, error) {
+	return dial(ctx, rawURL, opts, amqp.DialConfig)
+}
+
+func dial(ctx context.Context, rawURL string, opts DialOptions, dialConfig func(string, amqp.Config) (*amqp.Connection, error)) (*amqp.Connection, error) {
+	opts.setDefaults()
+	config := amqp.Config{
+		Heartbeat:       opts.Heartbeat,
+		TLSClientConfig: opts.TLSConfig,
+		Locale:          "en_US",
+	}
+	broker := redactURL(rawURL)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return nil, fmt.Errorf("error connecting to RabbitMQ: %w", err)
+		}
+
+		var conn *amqp.Connection
+		if conn, err = dialConfig(rawURL, config); err == nil {
+			dslog.Info("Connected to RabbitMQ", slog.String("broker", broker), slog.Int("attempt", attempt))
+			return conn, nil
+		}
+
+		if attempt >= opts.MaxAttempts {
+			dslog.Error("Failed to connect to RabbitMQ, giving up",
+				slog.String("broker", broker), slog.Int("attempt", attempt), slog.Any("error", err))
+			return nil, &DialError{Attempts: attempt, Err: err}
+		}
+
+		backoff := opts.backoff(attempt)
+		dslog.Warn("Failed to connect to RabbitMQ, retrying",
+			slog.String("broker", broker), slog.Int("attempt", attempt),
+			slog.Duration("backoff", backoff), slog.Any("error", err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("error connecting to RabbitMQ: %w", ctx.Err())
+		}
+	}
+}
+
+// redactURL hides the password of the URL so that it can be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid url>"
+	}
+	return u.Redacted()
+}
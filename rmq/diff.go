@@ -0,0 +1,141 @@
+package rmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Drift is a difference between a topology and the broker.
+type Drift struct {
+	// Kind is "exchange", "queue", "binding" or "policy".
+	Kind string
+	Name string
+	// Field is the field that differs. It is empty when the object is
+	// missing from the broker.
+	Field string
+	Want  interface{}
+	Got   interface{}
+}
+
+func (d Drift) String() string {
+	if d.Field == "" {
+		return fmt.Sprintf("%s %q is missing", d.Kind, d.Name)
+	}
+	return fmt.Sprintf("%s %q: %s is %v, want %v", d.Kind, d.Name, d.Field, d.Got, d.Want)
+}
+
+// Diff reports how the broker differs from the topology, without changing
+// anything. It is the dry-run of Apply: missing objects are created by Apply,
+// while exchanges and queues declared with other flags or arguments have to
+// be deleted first.
+func (t *Topology) Diff(ctx context.Context, admin Admin) ([]Drift, error) {
+	var drifts []Drift
+	add := func(kind, name, field string, want, got interface{}) {
+		drifts = append(drifts, Drift{Kind: kind, Name: name, Field: field, Want: want, Got: got})
+	}
+	compare := func(kind, name, field string, want, got interface{}) {
+		if !equal(want, got) {
+			add(kind, name, field, want, got)
+		}
+	}
+
+	for _, want := range t.Exchanges {
+		got, err := admin.Exchange(ctx, want.Name)
+		if errors.Is(err, ErrNotFound) {
+			add("exchange", want.Name, "", nil, nil)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading exchange: %s %w", want.Name, err)
+		}
+		compare("exchange", want.Name, "kind", want.Kind, got.Kind)
+		compare("exchange", want.Name, "durable", want.Durable, got.Durable)
+		compare("exchange", want.Name, "auto_delete", want.AutoDelete, got.AutoDelete)
+		compare("exchange", want.Name, "internal", want.Internal, got.Internal)
+		compare("exchange", want.Name, "args", want.Args, got.Args)
+	}
+
+	for _, want := range t.Queues {
+		got, err := admin.Queue(ctx, want.Name)
+		if errors.Is(err, ErrNotFound) {
+			add("queue", want.Name, "", nil, nil)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading queue: %s %w", want.Name, err)
+		}
+		if want.Type != "" {
+			compare("queue", want.Name, "type", want.Type, got.Type)
+		}
+		compare("queue", want.Name, "durable", want.Durable, got.Durable)
+		compare("queue", want.Name, "auto_delete", want.AutoDelete, got.AutoDelete)
+		compare("queue", want.Name, "exclusive", want.Exclusive, got.Exclusive)
+		compare("queue", want.Name, "args", want.Arguments(), got.Args)
+	}
+
+	for _, want := range t.Bindings {
+		name := want.Exchange + "/" + want.RoutingKey + "->" + want.Queue
+		bindings, err := admin.Bindings(ctx, want.Exchange, want.Queue)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("error reading bindings of queue: %s %w", want.Queue, err)
+		}
+		found := false
+		for _, got := range bindings {
+			if got.RoutingKey == want.RoutingKey && equal(want.Args, got.Args) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("binding", name, "", nil, nil)
+		}
+	}
+
+	for _, want := range t.Policies {
+		got, err := admin.Policy(ctx, want.Name)
+		if errors.Is(err, ErrNotFound) {
+			add("policy", want.Name, "", nil, nil)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading policy: %s %w", want.Name, err)
+		}
+		compare("policy", want.Name, "pattern", want.Pattern, got.Pattern)
+		compare("policy", want.Name, "apply_to", applyTo(want.ApplyTo), applyTo(got.ApplyTo))
+		compare("policy", want.Name, "priority", want.Priority, got.Priority)
+		compare("policy", want.Name, "definition", want.Definition, got.Definition)
+	}
+	return drifts, nil
+}
+
+func applyTo(v string) string {
+	if v == "" {
+		return "all"
+	}
+	return v
+}
+
+// equal compares values through their JSON encoding, so that numbers read
+// from a file and from the management API compare equal whatever their Go
+// type, and so do nil and empty maps.
+func equal(want, got interface{}) bool {
+	return reflect.DeepEqual(normalize(want), normalize(got))
+}
+
+func normalize(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n interface{}
+	if err := json.Unmarshal(b, &n); err != nil {
+		return v
+	}
+	if m, ok := n.(map[string]interface{}); ok && len(m) == 0 {
+		return nil
+	}
+	return n
+}
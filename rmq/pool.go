@@ -0,0 +1,91 @@
+package rmq
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// publishChannel is a channel messages are published on.
+type publishChannel interface {
+	publish(ctx context.Context, exchange, key string, message amqp.Publishing) error
+	IsClosed() bool
+	Close() error
+}
+
+// confirmChannel is a channel in confirm mode.
+type confirmChannel struct {
+	*amqp.Channel
+}
+
+func (ch confirmChannel) publish(ctx context.Context, exchange, key string, message amqp.Publishing) error {
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange, // Exchange
+		key,      // Routing key
+		false,    // Mandatory
+		false,    // Immediate
+		message,
+	)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return ErrNacked
+	}
+	return nil
+}
+
+// pool keeps up to size idle channels open for publishing.
+type pool struct {
+	open func() (publishChannel, error)
+	idle chan publishChannel
+}
+
+func newPool(size int, open func() (publishChannel, error)) *pool {
+	return &pool{
+		open: open,
+		idle: make(chan publishChannel, size),
+	}
+}
+
+// get returns an idle channel, or a new one if there is none.
+func (p *pool) get() (publishChannel, error) {
+	for {
+		select {
+		case ch := <-p.idle:
+			if !ch.IsClosed() {
+				return ch, nil
+			}
+		default:
+			return p.open()
+		}
+	}
+}
+
+// put returns the channel to the pool, or closes it if the pool is full.
+func (p *pool) put(ch publishChannel) {
+	if ch.IsClosed() {
+		return
+	}
+	select {
+	case p.idle <- ch:
+	default:
+		ch.Close()
+	}
+}
+
+// drain closes every idle channel.
+func (p *pool) drain() {
+	for {
+		select {
+		case ch := <-p.idle:
+			ch.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type MockPublishChannel struct {
+	id     int
+	closed bool
+}
+
+func (ch *MockPublishChannel) publish(_ context.Context, _, _ string, _ amqp.Publishing) error {
+	return nil
+}
+
+func (ch *MockPublishChannel) IsClosed() bool {
+	return ch.closed
+}
+
+func (ch *MockPublishChannel) Close() error {
+	ch.closed = true
+	return nil
+}
+
+func newTestPool(size int) (*pool, *int) {
+	opened := 0
+	return newPool(size, func() (publishChannel, error) {
+		opened++
+		return &MockPublishChannel{id: opened}, nil
+	}), &opened
+}
+
+func TestPool(t *testing.T) {
+	p, opened := newTestPool(1)
+
+	first, _ := p.get()
+	second, _ := p.get()
+	if *opened != 2 {
+		t.Fatalf("pool opened %d channels, want 2", *opened)
+	}
+
+	p.put(first)
+	p.put(second)
+	if !second.IsClosed() {
+		t.Error("pool.put() kept a channel beyond its size")
+	}
+
+	if ch, _ := p.get(); ch != first {
+		t.Error("pool.get() did not reuse the idle channel")
+	}
+	p.put(first)
+
+	first.Close()
+	if ch, _ := p.get(); ch == first || *opened != 3 {
+		t.Error("pool.get() returned a closed channel")
+	}
+}
+
+func TestPool_Drain(t *testing.T) {
+	p, _ := newTestPool(2)
+	first, _ := p.get()
+	second, _ := p.get()
+	p.put(first)
+	p.put(second)
+
+	p.drain()
+	if !first.IsClosed() || !second.IsClosed() {
+		t.Error("pool.drain() did not close the idle channels")
+	}
+}
+
+func TestPool_OpenError(t *testing.T) {
+	p := newPool(1, func() (publishChannel, error) {
+		return nil, ErrNotConnected
+	})
+	if _, err := p.get(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("pool.get() error = %v, want %v", err, ErrNotConnected)
+	}
+}
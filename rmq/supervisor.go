@@ -0,0 +1,286 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type State int
+
+const (
+	// StateIdle is the state of a supervisor that has not been started.
+	StateIdle State = iota
+	// StateConnecting is the state until the first connection is up.
+	StateConnecting
+	// StateConnected is the state while the connection is up and every
+	// callback has run.
+	StateConnected
+	// StateReconnecting is the state after the connection was lost, until
+	// it is up again.
+	StateReconnecting
+	// StateStopped is the state once the supervisor gave up or was closed.
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+type EventType int
+
+const (
+	// EventConnected is emitted once connected and the callbacks have run.
+	EventConnected EventType = iota
+	// EventDisconnected is emitted when the broker closes the connection.
+	EventDisconnected
+	// EventConnectFailed is emitted when dialing or a callback fails.
+	EventConnectFailed
+	// EventStopped is emitted when the supervisor stops for good.
+	EventStopped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventConnectFailed:
+		return "connect_failed"
+	case EventStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is a lifecycle event of a supervisor.
+type Event struct {
+	Type EventType
+	// Attempt is the connection attempt, for EventConnectFailed.
+	Attempt int
+	Err     error
+}
+
+// Status is a snapshot of the state of a supervisor.
+type Status struct {
+	State State
+	// Since is when the supervisor entered State.
+	Since time.Time
+	// Reconnects is how many times the connection was reestablished.
+	Reconnects int
+	// LastError is the last error the supervisor ran into.
+	LastError error
+}
+
+// CallbackError is returned when a callback fails on a new connection.
+type CallbackError struct {
+	Name string
+	Err  error
+}
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("error running callback %s: %v", e.Name, e.Err)
+}
+
+func (e *CallbackError) Unwrap() error {
+	return e.Err
+}
+
+type SupervisorOpts struct {
+	ConnOpts
+	// OnEvent is called on every lifecycle event. It is called
+	// synchronously and must not block.
+	OnEvent func(Event)
+}
+
+type callback struct {
+	name string
+	fn   func(*amqp.Connection) error
+}
+
+// Supervisor owns a connection, keeps it up, backing off between failed
+// attempts, and reinitializes what depends on it through callbacks run on
+// every new connection:
+//
+//	supervisor := rmq.NewSupervisor(&rmq.SupervisorOpts{ConnOpts: rmq.ConnOpts{URL: url}})
+//	supervisor.Register("topology", func(conn *amqp.Connection) error {
+//		ch, err := conn.Channel()
+//		...
+//		return topology.Declare(ch)
+//	})
+//	supervisor.Start(ctx)
+//
+// Consumers and publishers recover by themselves on the supervised
+// connection returned by Conn.
+type Supervisor struct {
+	conn    *Conn
+	opts    SupervisorOpts
+	started bool
+
+	mu        sync.Mutex
+	callbacks []callback
+	status    Status
+}
+
+func NewSupervisor(opts *SupervisorOpts) *Supervisor {
+	s := &Supervisor{
+		opts:   *opts,
+		status: Status{State: StateIdle, Since: time.Now()},
+	}
+	dial := opts.Dial
+	if dial == nil {
+		dial = amqp.Dial
+	}
+	s.conn = newConn(&s.opts.ConnOpts, func() (connection, error) {
+		conn, err := dial(opts.URL)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+	s.conn.hooks = hooks{
+		connect: s.connect,
+		failed:  s.failed,
+		lost:    s.lost,
+		closed:  s.closed,
+	}
+	return s
+}
+
+// Register adds a callback run, in registration order, on every new
+// connection before it is used. A failing callback closes the connection,
+// which is then redialed. Callbacks must be registered before Start.
+func (s *Supervisor) Register(name string, fn func(*amqp.Connection) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callbacks = append(s.callbacks, callback{name: name, fn: fn})
+}
+
+// Start connects in the background and keeps the connection up until ctx
+// is done or Close is called. Use Conn().Wait to block until connected.
+func (s *Supervisor) Start(ctx context.Context) {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return
+	}
+	s.started = true
+	s.mu.Unlock()
+
+	s.setState(StateConnecting, nil)
+	go s.conn.run(ctx)
+}
+
+// Conn returns the supervised connection, to be shared with the consumers
+// and publishers of the service.
+func (s *Supervisor) Conn() *Conn {
+	return s.conn
+}
+
+// Status returns the current status of the supervisor.
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Healthy reports whether the connection is up.
+func (s *Supervisor) Healthy() bool {
+	return s.Status().State == StateConnected && s.conn.IsConnected()
+}
+
+// Close closes the connection for good.
+func (s *Supervisor) Close() error {
+	s.mu.Lock()
+	started := s.started
+	s.started = true
+	s.mu.Unlock()
+
+	if !started {
+		s.conn.shutdown(ErrClosed)
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *Supervisor) connect(conn connection) error {
+	raw, _ := conn.(*amqp.Connection)
+
+	s.mu.Lock()
+	callbacks := append([]callback(nil), s.callbacks...)
+	s.mu.Unlock()
+
+	for _, cb := range callbacks {
+		if err := cb.fn(raw); err != nil {
+			return &CallbackError{Name: cb.name, Err: err}
+		}
+	}
+
+	s.mu.Lock()
+	if s.status.State == StateReconnecting {
+		s.status.Reconnects++
+	}
+	s.mu.Unlock()
+	s.setState(StateConnected, nil)
+	s.emit(Event{Type: EventConnected})
+	return nil
+}
+
+func (s *Supervisor) failed(attempt int, err error) {
+	var callbackErr *CallbackError
+	if errors.As(err, &callbackErr) {
+		log.Println(err)
+		sentry.CaptureException(err)
+	}
+	s.mu.Lock()
+	s.status.LastError = err
+	s.mu.Unlock()
+	s.emit(Event{Type: EventConnectFailed, Attempt: attempt, Err: err})
+}
+
+func (s *Supervisor) lost(err error) {
+	s.setState(StateReconnecting, err)
+	s.emit(Event{Type: EventDisconnected, Err: err})
+}
+
+func (s *Supervisor) closed(err error) {
+	s.setState(StateStopped, err)
+	s.emit(Event{Type: EventStopped, Err: err})
+}
+
+func (s *Supervisor) setState(state State, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = state
+	s.status.Since = time.Now()
+	if err != nil {
+		s.status.LastError = err
+	}
+}
+
+func (s *Supervisor) emit(event Event) {
+	if s.opts.OnEvent != nil {
+		s.opts.OnEvent(event)
+	}
+}
@@ -0,0 +1,136 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []EventType
+	ch     chan Event
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{ch: make(chan Event, 32)}
+}
+
+func (r *eventRecorder) record(event Event) {
+	r.mu.Lock()
+	r.events = append(r.events, event.Type)
+	r.mu.Unlock()
+	r.ch <- event
+}
+
+func (r *eventRecorder) waitFor(t *testing.T, eventType EventType) Event {
+	t.Helper()
+	for {
+		select {
+		case event := <-r.ch:
+			if event.Type == eventType {
+				return event
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s event", eventType)
+		}
+	}
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]EventType(nil), r.events...)
+}
+
+func newTestSupervisor(dialer *MockDialer, recorder *eventRecorder) *Supervisor {
+	s := NewSupervisor(&SupervisorOpts{
+		ConnOpts: ConnOpts{
+			ReconnectDelay:    time.Millisecond,
+			MaxReconnectDelay: 4 * time.Millisecond,
+		},
+		OnEvent: recorder.record,
+	})
+	s.conn.dial = dialer.dial
+	return s
+}
+
+func TestSupervisor(t *testing.T) {
+	dialer := newMockDialer(0)
+	recorder := newEventRecorder()
+	s := newTestSupervisor(dialer, recorder)
+
+	if s.Status().State != StateIdle {
+		t.Errorf("Supervisor.Status() = %v before Start, want %v", s.Status().State, StateIdle)
+	}
+
+	// The callback fails on the first connection and succeeds afterwards.
+	var calls int
+	s.Register("consumers", func(*amqp.Connection) error {
+		if calls++; calls == 1 {
+			return errors.New("test-error")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	event := recorder.waitFor(t, EventConnectFailed)
+	var callbackErr *CallbackError
+	if !errors.As(event.Err, &callbackErr) || callbackErr.Name != "consumers" {
+		t.Errorf("connect failed event error = %v, want a *CallbackError for consumers", event.Err)
+	}
+	if first := dialer.waitForDial(t); !first.IsClosed() {
+		t.Error("Supervisor did not close the connection its callback failed on")
+	}
+
+	recorder.waitFor(t, EventConnected)
+	second := dialer.waitForDial(t)
+	if err := s.Conn().Wait(ctx); err != nil {
+		t.Fatalf("Conn.Wait() error = %v", err)
+	}
+	if !s.Healthy() {
+		t.Errorf("Supervisor.Healthy() = false with status %+v", s.Status())
+	}
+
+	second.closeByBroker()
+	recorder.waitFor(t, EventDisconnected)
+	recorder.waitFor(t, EventConnected)
+	if status := s.Status(); status.State != StateConnected || status.Reconnects != 1 || status.LastError == nil {
+		t.Errorf("Supervisor.Status() = %+v after reconnecting, want connected with 1 reconnect", status)
+	}
+	if calls != 3 {
+		t.Errorf("Supervisor ran the callback %d times, want 3", calls)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Supervisor.Close() error = %v", err)
+	}
+	if s.Healthy() || s.Status().State != StateStopped {
+		t.Errorf("Supervisor.Status() = %+v after Close, want stopped", s.Status())
+	}
+
+	want := []EventType{EventConnectFailed, EventConnected, EventDisconnected, EventConnected, EventStopped}
+	if got := recorder.types(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Supervisor events = %v, want %v", got, want)
+	}
+}
+
+func TestSupervisor_CloseBeforeStart(t *testing.T) {
+	recorder := newEventRecorder()
+	s := newTestSupervisor(newMockDialer(0), recorder)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Supervisor.Close() error = %v", err)
+	}
+	s.Start(context.Background())
+	if err := s.Conn().Wait(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Conn.Wait() error = %v, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,322 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/spf13/viper"
+)
+
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+// Declarer is the subset of *amqp.Channel used to declare a topology.
+type Declarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+type Exchange struct {
+	Name       string     `mapstructure:"name"`
+	Kind       string     `mapstructure:"kind"`
+	Durable    bool       `mapstructure:"durable"`
+	AutoDelete bool       `mapstructure:"auto_delete"`
+	Internal   bool       `mapstructure:"internal"`
+	Args       amqp.Table `mapstructure:"args"`
+}
+
+// Declare declares the exchange. Declaring an exchange that already exists
+// with the same flags is a no-op.
+func (e *Exchange) Declare(ch Declarer) error {
+	if err := ch.ExchangeDeclare(
+		e.Name,       // name of the exchange
+		e.Kind,       // type
+		e.Durable,    // durable
+		e.AutoDelete, // delete when complete
+		e.Internal,   // internal
+		false,        // noWait
+		e.Args,       // arguments
+	); err != nil {
+		return fmt.Errorf("error declaring exchange: %s %w", e.Name, err)
+	}
+	return nil
+}
+
+type Queue struct {
+	Name       string     `mapstructure:"name"`
+	Durable    bool       `mapstructure:"durable"`
+	AutoDelete bool       `mapstructure:"auto_delete"`
+	Exclusive  bool       `mapstructure:"exclusive"`
+	Args       amqp.Table `mapstructure:"args"`
+
+	// Type is the queue type, one of the QueueType constants. Empty leaves it
+	// to the broker, which declares classic queues.
+	Type string `mapstructure:"type"`
+	// DeadLetterExchange is where rejected and expired messages are
+	// republished.
+	DeadLetterExchange string `mapstructure:"dead_letter_exchange"`
+	// DeadLetterRoutingKey replaces the routing key of dead-lettered
+	// messages.
+	DeadLetterRoutingKey string `mapstructure:"dead_letter_routing_key"`
+	// MessageTTL expires the messages left in the queue for longer.
+	MessageTTL time.Duration `mapstructure:"message_ttl"`
+}
+
+// Arguments returns the arguments the queue is declared with: Args along
+// with the ones set by the typed fields.
+func (q *Queue) Arguments() amqp.Table {
+	args := amqp.Table{}
+	for k, v := range q.Args {
+		args[k] = v
+	}
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = q.MessageTTL.Milliseconds()
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// Declare declares the queue. Declaring a queue that already exists with the
+// same flags and arguments is a no-op.
+func (q *Queue) Declare(ch Declarer) (amqp.Queue, error) {
+	queue, err := ch.QueueDeclare(
+		q.Name,        // Queue name
+		q.Durable,     // Durable
+		q.AutoDelete,  // Delete when used
+		q.Exclusive,   // Exclusive
+		false,         // No wait
+		q.Arguments(), // Arguments
+	)
+	if err != nil {
+		return queue, fmt.Errorf("error declaring queue: %s %w", q.Name, err)
+	}
+	return queue, nil
+}
+
+type Binding struct {
+	Queue      string     `mapstructure:"queue"`
+	Exchange   string     `mapstructure:"exchange"`
+	RoutingKey string     `mapstructure:"routing_key"`
+	Args       amqp.Table `mapstructure:"args"`
+}
+
+// Declare binds the queue to the exchange.
+func (b *Binding) Declare(ch Declarer) error {
+	if err := ch.QueueBind(
+		b.Queue,      // Queue name
+		b.RoutingKey, // Routing key
+		b.Exchange,   // Exchange name
+		false,        // No wait
+		b.Args,       // Arguments
+	); err != nil {
+		return fmt.Errorf("error binding queue: %s to exchange: %s with routing key: %s %w", b.Queue, b.Exchange, b.RoutingKey, err)
+	}
+	return nil
+}
+
+// Policy is a RabbitMQ policy, applied through the management API since
+// policies cannot be set over AMQP.
+type Policy struct {
+	Name    string `mapstructure:"name" json:"-"`
+	Pattern string `mapstructure:"pattern" json:"pattern"`
+	// ApplyTo is one of "queues", "exchanges" or "all". Defaults to "all".
+	ApplyTo    string                 `mapstructure:"apply_to" json:"apply-to,omitempty"`
+	Priority   int                    `mapstructure:"priority" json:"priority"`
+	Definition map[string]interface{} `mapstructure:"definition" json:"definition"`
+}
+
+// Topology is a set of exchanges, queues, bindings between them and
+// policies. It can be loaded from a file with LoadTopology:
+//
+//	exchanges:
+//	  - name: atlas-jobs
+//	    kind: direct
+//	    durable: true
+//	queues:
+//	  - name: analysis-run
+//	    durable: true
+//	    type: quorum
+//	    dead_letter_exchange: analysis-run.dlx
+//	bindings:
+//	  - queue: analysis-run
+//	    exchange: atlas-jobs
+//	    routing_key: analysis-run
+//	policies:
+//	  - name: analysis-limits
+//	    pattern: ^analysis-
+//	    apply_to: queues
+//	    definition:
+//	      max-length: 10000
+type Topology struct {
+	Exchanges []Exchange `mapstructure:"exchanges"`
+	Queues    []Queue    `mapstructure:"queues"`
+	Bindings  []Binding  `mapstructure:"bindings"`
+	Policies  []Policy   `mapstructure:"policies"`
+}
+
+// LoadTopology reads a topology from a YAML, TOML or JSON file, depending on
+// its extension, and validates it.
+func LoadTopology(path string) (*Topology, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading topology from %s: %w", path, err)
+	}
+
+	t := &Topology{}
+	if err := v.Unmarshal(t); err != nil {
+		return nil, fmt.Errorf("error reading topology from %s: %w", path, err)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TopologyError is a validation error of a single topology field.
+type TopologyError struct {
+	Field string
+	Msg   string
+}
+
+func (e *TopologyError) Error() string {
+	return fmt.Sprintf("invalid topology: %s: %s", e.Field, e.Msg)
+}
+
+// Validate checks the topology and returns every problem found, joined. Each
+// of them is a *TopologyError.
+func (t *Topology) Validate() error {
+	var errs []error
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, &TopologyError{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	exchanges := map[string]bool{}
+	for i, e := range t.Exchanges {
+		field := fmt.Sprintf("exchanges[%d]", i)
+		if e.Name == "" {
+			invalid(field+".name", "is required")
+		} else if exchanges[e.Name] {
+			invalid(field+".name", "duplicate exchange %q", e.Name)
+		}
+		exchanges[e.Name] = true
+		if e.Kind == "" {
+			invalid(field+".kind", "is required")
+		}
+	}
+
+	queues := map[string]bool{}
+	for i, q := range t.Queues {
+		field := fmt.Sprintf("queues[%d]", i)
+		if q.Name == "" {
+			invalid(field+".name", "is required")
+		} else if queues[q.Name] {
+			invalid(field+".name", "duplicate queue %q", q.Name)
+		}
+		queues[q.Name] = true
+		switch q.Type {
+		case "", QueueTypeClassic:
+		case QueueTypeQuorum, QueueTypeStream:
+			if !q.Durable || q.AutoDelete || q.Exclusive {
+				invalid(field+".type", "%s queues must be durable and neither exclusive nor auto-delete", q.Type)
+			}
+		default:
+			invalid(field+".type", "must be one of %q, %q or %q, got %q",
+				QueueTypeClassic, QueueTypeQuorum, QueueTypeStream, q.Type)
+		}
+		if q.MessageTTL < 0 {
+			invalid(field+".message_ttl", "must not be negative")
+		}
+	}
+
+	for i, b := range t.Bindings {
+		field := fmt.Sprintf("bindings[%d]", i)
+		if b.Queue == "" {
+			invalid(field+".queue", "is required")
+		}
+		if b.Exchange == "" {
+			invalid(field+".exchange", "is required")
+		}
+	}
+
+	policies := map[string]bool{}
+	for i, p := range t.Policies {
+		field := fmt.Sprintf("policies[%d]", i)
+		if p.Name == "" {
+			invalid(field+".name", "is required")
+		} else if policies[p.Name] {
+			invalid(field+".name", "duplicate policy %q", p.Name)
+		}
+		policies[p.Name] = true
+		if p.Pattern == "" {
+			invalid(field+".pattern", "is required")
+		}
+		switch p.ApplyTo {
+		case "", "all", "queues", "exchanges":
+		default:
+			invalid(field+".apply_to", "must be one of \"all\", \"queues\" or \"exchanges\", got %q", p.ApplyTo)
+		}
+		if len(p.Definition) == 0 {
+			invalid(field+".definition", "is required")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Declare declares the exchanges, then the queues and then the bindings. It
+// stops at the first error. Policies are not declared, see Apply.
+func (t *Topology) Declare(ch Declarer) error {
+	for i := range t.Exchanges {
+		if err := t.Exchanges[i].Declare(ch); err != nil {
+			return err
+		}
+	}
+	for i := range t.Queues {
+		if _, err := t.Queues[i].Declare(ch); err != nil {
+			return err
+		}
+	}
+	for i := range t.Bindings {
+		if err := t.Bindings[i].Declare(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply declares the topology and puts its policies through admin, which can
+// be nil when there are none. Declaring is idempotent, but the broker closes
+// the channel when an exchange or a queue already exists with other flags or
+// arguments: use Diff beforehand to report such drift.
+func (t *Topology) Apply(ctx context.Context, ch Declarer, admin Admin) error {
+	if len(t.Policies) > 0 && admin == nil {
+		return errors.New("error applying topology: policies require the management API")
+	}
+	if err := t.Declare(ch); err != nil {
+		return err
+	}
+	for i := range t.Policies {
+		if err := admin.PutPolicy(ctx, &t.Policies[i]); err != nil {
+			return fmt.Errorf("error applying policy: %s %w", t.Policies[i].Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MockDeclarer records the declarations, in order.
+type MockDeclarer struct {
+	err          error
+	failOn       string
+	declarations []string
+}
+
+func (d *MockDeclarer) declare(declaration string) error {
+	d.declarations = append(d.declarations, declaration)
+	if declaration == d.failOn {
+		return d.err
+	}
+	return nil
+}
+
+func (d *MockDeclarer) ExchangeDeclare(name, kind string, _, _, _, _ bool, _ amqp.Table) error {
+	return d.declare("exchange " + name + " " + kind)
+}
+
+func (d *MockDeclarer) QueueDeclare(name string, _, _, _, _ bool, _ amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, d.declare("queue " + name)
+}
+
+func (d *MockDeclarer) QueueBind(name, key, exchange string, _ bool, _ amqp.Table) error {
+	return d.declare("binding " + exchange + "/" + key + "->" + name)
+}
+
+func testTopology() *Topology {
+	return &Topology{
+		Bindings:  []Binding{{Queue: "analysis-run", Exchange: "atlas-jobs", RoutingKey: "analysis-run"}},
+		Queues:    []Queue{{Name: "analysis-run", Durable: true}},
+		Exchanges: []Exchange{{Name: "atlas-jobs", Kind: "direct", Durable: true}},
+	}
+}
+
+func TestTopology_Declare(t *testing.T) {
+	d := &MockDeclarer{}
+	if err := testTopology().Declare(d); err != nil {
+		t.Fatalf("Topology.Declare() error = %v", err)
+	}
+	want := []string{
+		"exchange atlas-jobs direct",
+		"queue analysis-run",
+		"binding atlas-jobs/analysis-run->analysis-run",
+	}
+	if !reflect.DeepEqual(d.declarations, want) {
+		t.Errorf("Topology.Declare() declared %v, want %v", d.declarations, want)
+	}
+}
+
+func TestTopology_DeclareError(t *testing.T) {
+	testErr := errors.New("test-error")
+	d := &MockDeclarer{err: testErr, failOn: "queue analysis-run"}
+	if err := testTopology().Declare(d); !errors.Is(err, testErr) {
+		t.Fatalf("Topology.Declare() error = %v, want %v", err, testErr)
+	}
+	if len(d.declarations) != 2 {
+		t.Errorf("Topology.Declare() went on after an error: %v", d.declarations)
+	}
+}
+
+const testTopologyYAML = `
+exchanges:
+  - name: atlas-jobs
+    kind: direct
+    durable: true
+queues:
+  - name: analysis-run
+    durable: true
+    type: quorum
+    dead_letter_exchange: analysis-run.dlx
+    message_ttl: 1h
+    args:
+      x-max-length: 10000
+bindings:
+  - queue: analysis-run
+    exchange: atlas-jobs
+    routing_key: analysis-run
+policies:
+  - name: analysis-limits
+    pattern: ^analysis-
+    apply_to: queues
+    definition:
+      max-length: 10000
+`
+
+const testTopologyTOML = `
+[[exchanges]]
+name = "atlas-jobs"
+kind = "direct"
+durable = true
+
+[[queues]]
+name = "analysis-run"
+durable = true
+type = "quorum"
+dead_letter_exchange = "analysis-run.dlx"
+message_ttl = "1h"
+
+[queues.args]
+x-max-length = 10000
+
+[[bindings]]
+queue = "analysis-run"
+exchange = "atlas-jobs"
+routing_key = "analysis-run"
+
+[[policies]]
+name = "analysis-limits"
+pattern = "^analysis-"
+apply_to = "queues"
+
+[policies.definition]
+max-length = 10000
+`
+
+func TestLoadTopology(t *testing.T) {
+	for _, tt := range []struct{ file, content string }{
+		{file: "topology.yaml", content: testTopologyYAML},
+		{file: "topology.toml", content: testTopologyTOML},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			topology, err := LoadTopology(path)
+			if err != nil {
+				t.Fatalf("LoadTopology() error = %v", err)
+			}
+			if len(topology.Exchanges) != 1 || len(topology.Queues) != 1 || len(topology.Bindings) != 1 || len(topology.Policies) != 1 {
+				t.Fatalf("LoadTopology() = %+v", topology)
+			}
+
+			args := topology.Queues[0].Arguments()
+			want := amqp.Table{
+				"x-queue-type":           QueueTypeQuorum,
+				"x-dead-letter-exchange": "analysis-run.dlx",
+				"x-message-ttl":          int64(3600000),
+				"x-max-length":           10000,
+			}
+			if !equal(args, want) {
+				t.Errorf("LoadTopology() queue arguments = %v, want %v", args, want)
+			}
+			if err := args.Validate(); err != nil {
+				t.Errorf("LoadTopology() queue arguments are not valid AMQP: %v", err)
+			}
+			if topology.Policies[0].ApplyTo != "queues" || !equal(topology.Policies[0].Definition["max-length"], 10000) {
+				t.Errorf("LoadTopology() policy = %+v", topology.Policies[0])
+			}
+		})
+	}
+}
+
+func TestTopology_Validate(t *testing.T) {
+	topology := &Topology{
+		Exchanges: []Exchange{{Name: "atlas-jobs"}, {Name: "atlas-jobs", Kind: "direct"}},
+		Queues:    []Queue{{Name: "analysis-run", Type: QueueTypeQuorum}, {Name: "autofix-run", Type: "lazy"}},
+		Bindings:  []Binding{{Queue: "analysis-run"}},
+		Policies:  []Policy{{Name: "analysis-limits", ApplyTo: "channels"}},
+	}
+	err := topology.Validate()
+
+	want := []string{
+		"exchanges[0].kind",
+		"exchanges[1].name",
+		"queues[0].type",
+		"queues[1].type",
+		"bindings[0].exchange",
+		"policies[0].pattern",
+		"policies[0].apply_to",
+		"policies[0].definition",
+	}
+	var fields []string
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var topologyErr *TopologyError
+		if !errors.As(err, &topologyErr) {
+			t.Fatalf("Topology.Validate() error %v is not a *TopologyError", err)
+		}
+		fields = append(fields, topologyErr.Field)
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("Topology.Validate() fields = %v, want %v", fields, want)
+	}
+
+	if err := testTopology().Validate(); err != nil {
+		t.Errorf("Topology.Validate() error = %v for a valid topology", err)
+	}
+}
+
+// MockAdmin is an in-memory Admin.
+type MockAdmin struct {
+	exchanges map[string]*Exchange
+	queues    map[string]*Queue
+	bindings  []Binding
+	policies  map[string]*Policy
+}
+
+func (a *MockAdmin) Exchange(_ context.Context, name string) (*Exchange, error) {
+	if e, ok := a.exchanges[name]; ok {
+		return e, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (a *MockAdmin) Queue(_ context.Context, name string) (*Queue, error) {
+	if q, ok := a.queues[name]; ok {
+		return q, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (a *MockAdmin) Bindings(_ context.Context, exchange, queue string) ([]Binding, error) {
+	var bindings []Binding
+	for _, b := range a.bindings {
+		if b.Exchange == exchange && b.Queue == queue {
+			bindings = append(bindings, b)
+		}
+	}
+	return bindings, nil
+}
+
+func (a *MockAdmin) Policy(_ context.Context, name string) (*Policy, error) {
+	if p, ok := a.policies[name]; ok {
+		return p, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (a *MockAdmin) PutPolicy(_ context.Context, policy *Policy) error {
+	if a.policies == nil {
+		a.policies = map[string]*Policy{}
+	}
+	a.policies[policy.Name] = policy
+	return nil
+}
+
+func TestTopology_Diff(t *testing.T) {
+	topology := testTopology()
+	topology.Queues[0].Type = QueueTypeQuorum
+	topology.Queues = append(topology.Queues, Queue{Name: "autofix-run", Durable: true})
+	topology.Policies = []Policy{{Name: "analysis-limits", Pattern: "^analysis-", Definition: map[string]interface{}{"max-length": 10000}}}
+
+	admin := &MockAdmin{
+		exchanges: map[string]*Exchange{"atlas-jobs": {Name: "atlas-jobs", Kind: "direct", Durable: true}},
+		queues: map[string]*Queue{"analysis-run": {
+			Name:    "analysis-run",
+			Type:    QueueTypeClassic,
+			Durable: true,
+			Args:    amqp.Table{"x-queue-type": QueueTypeClassic},
+		}},
+		policies: map[string]*Policy{"analysis-limits": {
+			Name:       "analysis-limits",
+			Pattern:    "^analysis-",
+			ApplyTo:    "all",
+			Definition: map[string]interface{}{"max-length": float64(10000)},
+		}},
+	}
+
+	drifts, err := topology.Diff(context.Background(), admin)
+	if err != nil {
+		t.Fatalf("Topology.Diff() error = %v", err)
+	}
+	var got []string
+	for _, d := range drifts {
+		got = append(got, d.String())
+	}
+	want := []string{
+		`queue "analysis-run": type is classic, want quorum`,
+		`queue "analysis-run": args is map[x-queue-type:classic], want map[x-queue-type:quorum]`,
+		`queue "autofix-run" is missing`,
+		`binding "atlas-jobs/analysis-run->analysis-run" is missing`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Topology.Diff() = %q, want %q", got, want)
+	}
+}
+
+func TestTopology_Apply(t *testing.T) {
+	topology := testTopology()
+	topology.Policies = []Policy{{Name: "analysis-limits", Pattern: "^analysis-", Definition: map[string]interface{}{"max-length": 10000}}}
+
+	if err := topology.Apply(context.Background(), &MockDeclarer{}, nil); err == nil {
+		t.Error("Topology.Apply() expected error applying policies without an Admin")
+	}
+
+	d, admin := &MockDeclarer{}, &MockAdmin{}
+	if err := topology.Apply(context.Background(), d, admin); err != nil {
+		t.Fatalf("Topology.Apply() error = %v", err)
+	}
+	if len(d.declarations) != 3 || admin.policies["analysis-limits"] == nil {
+		t.Errorf("Topology.Apply() declared %v and policies %v", d.declarations, admin.policies)
+	}
+}
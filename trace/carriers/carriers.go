@@ -0,0 +1,56 @@
+// Package carriers carries the span context of the trace package in the
+// headers of the messages of the brokers:
+//
+//	trace.Inject(ctx, carriers.AMQP(message.Headers))
+//	trace.Inject(ctx, (*carriers.Kafka)(&message.Headers))
+//
+// They are kept out of the trace package so that the packages that only log
+// do not depend on the broker clients.
+package carriers
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/segmentio/kafka-go"
+)
+
+// AMQP carries the span context in the headers of AMQP messages. The headers
+// must not be nil for Set.
+type AMQP amqp.Table
+
+func (c AMQP) Get(key string) string {
+	switch v := c[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+func (c AMQP) Set(key, value string) {
+	c[key] = value
+}
+
+// Kafka carries the span context in the headers of Kafka messages. Kafka
+// header keys are case sensitive.
+type Kafka []kafka.Header
+
+func (c *Kafka) Get(key string) string {
+	for _, h := range *c {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c *Kafka) Set(key, value string) {
+	for i := range *c {
+		if (*c)[i].Key == key {
+			(*c)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c = append(*c, kafka.Header{Key: key, Value: []byte(value)})
+}
@@ -0,0 +1,61 @@
+package carriers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/deepcode-ai/artifacts/trace"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestInjectExtract(t *testing.T) {
+	_, span := trace.NewTracer(nil).Start(context.Background(), "publish", trace.SpanKindProducer)
+	ctx := trace.ContextWithSpanContext(context.Background(), span.SpanContext())
+
+	carriers := map[string]trace.Carrier{
+		"amqp":  AMQP(amqp.Table{}),
+		"kafka": &Kafka{{Key: trace.TraceparentHeader, Value: []byte("stale")}},
+	}
+	for name, carrier := range carriers {
+		t.Run(name, func(t *testing.T) {
+			trace.Inject(ctx, carrier)
+			got := trace.SpanContextFromContext(trace.Extract(context.Background(), carrier))
+			want := span.SpanContext()
+			want.Remote = true
+			if got != want {
+				t.Errorf("Extract() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	headers := Kafka{{Key: "Content-Type", Value: []byte("application/json")}}
+	trace.Inject(ctx, &headers)
+	if len(headers) != 2 {
+		t.Errorf("Inject() headers = %v, want the content type and the traceparent", []kafka.Header(headers))
+	}
+}
+
+func TestAMQP_Get(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "string", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "bytes", value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), want: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "not a string", value: 42},
+		{name: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := amqp.Table{}
+			if tt.value != nil {
+				headers[trace.TraceparentHeader] = tt.value
+			}
+			if got := AMQP(headers).Get(trace.TraceparentHeader); got != tt.want {
+				t.Errorf("AMQP.Get() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package trace
+
+import "sync"
+
+// InMemoryExporter keeps the exported spans in memory, for tests:
+//
+//	exporter := &trace.InMemoryExporter{}
+//	trace.SetDefault(trace.NewTracer(exporter))
+//	...
+//	spans := exporter.Spans()
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *InMemoryExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the exported spans, in the order they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset forgets the exported spans.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
@@ -0,0 +1,128 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestTracer_Start(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	tracer := NewTracer(exporter)
+
+	ctx, root := tracer.Start(context.Background(), "publish", SpanKindProducer)
+	if !root.SpanContext().IsValid() {
+		t.Fatal("Tracer.Start() returned an invalid root span context")
+	}
+	if got := SpanContextFromContext(ctx); got != root.SpanContext() {
+		t.Errorf("context carries %+v, want %+v", got, root.SpanContext())
+	}
+
+	_, child := tracer.Start(ctx, "process", SpanKindConsumer)
+	errProcess := errors.New("process error")
+	child.SetAttribute("queue", "analysis-run")
+	child.RecordError(errProcess)
+	child.End()
+	root.End()
+	root.End()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	process, publish := spans[0], spans[1]
+	if process.SpanContext.TraceID != publish.SpanContext.TraceID {
+		t.Error("child span is not in the trace of its parent")
+	}
+	if process.SpanContext.SpanID == publish.SpanContext.SpanID {
+		t.Error("child span has the span id of its parent")
+	}
+	if process.Parent != publish.SpanContext {
+		t.Errorf("child span parent = %+v, want %+v", process.Parent, publish.SpanContext)
+	}
+	if publish.Parent.IsValid() {
+		t.Errorf("root span parent = %+v, want none", publish.Parent)
+	}
+	if process.Kind != SpanKindConsumer || process.Attributes["queue"] != "analysis-run" || process.Err != errProcess {
+		t.Errorf("exported child span %+v", process)
+	}
+	if process.End.Before(process.Start) {
+		t.Errorf("child span ends at %v, before it starts at %v", process.End, process.Start)
+	}
+
+	exporter.Reset()
+	if len(exporter.Spans()) != 0 {
+		t.Error("InMemoryExporter.Reset() kept the spans")
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	_, span := NewTracer(nil).Start(context.Background(), "publish", SpanKindProducer)
+	ctx := ContextWithSpanContext(context.Background(), span.SpanContext())
+
+	carrier := HeaderCarrier(http.Header{})
+	Inject(ctx, carrier)
+	got := SpanContextFromContext(Extract(context.Background(), carrier))
+	want := span.SpanContext()
+	want.Remote = true
+	if got != want {
+		t.Errorf("Extract() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		want        SpanContext
+	}{
+		{
+			name:        "sampled",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want: SpanContext{
+				TraceID: TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+				SpanID:  SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+				Sampled: true,
+				Remote:  true,
+			},
+		},
+		{
+			name:        "not sampled",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			want: SpanContext{
+				TraceID: TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+				SpanID:  SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+				Remote:  true,
+			},
+		},
+		{
+			name:        "future version",
+			traceparent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			want: SpanContext{
+				TraceID: TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+				SpanID:  SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+				Sampled: true,
+				Remote:  true,
+			},
+		},
+		{name: "missing"},
+		{name: "zero trace id", traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span id", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "invalid version", traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "extra field in version 00", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{name: "not hex", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+		{name: "short span id", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.traceparent != "" {
+				headers.Set(TraceparentHeader, tt.traceparent)
+			}
+			if got := SpanContextFromContext(Extract(context.Background(), HeaderCarrier(headers))); got != tt.want {
+				t.Errorf("Extract() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
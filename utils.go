@@ -1,23 +1,25 @@
 package artifacts
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"errors"
+	"encoding/csv"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"strconv"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/deepcode-ai/artifacts/configwatch"
+	"github.com/deepcode-ai/artifacts/events"
+	"github.com/deepcode-ai/artifacts/k8s"
+	"github.com/deepcode-ai/artifacts/retry"
 	"github.com/getsentry/sentry-go"
 )
 
-var analysisEventsLogFmt = "%s,%s,%s,%s,%s,%s,%s,%s,%s,%d\n"
-
 // Returns bearer token that is used to authenticate while
 // interacting with the k8s REST API
 // Utilized by janus and atlas.
@@ -30,21 +32,26 @@ func GetNewBearerToken(tokenFilePath string) (string, error) {
 	return bearer, nil
 }
 
-// Utility function to retry any routine
-func Retry(attempts int, sleep time.Duration, f func() error) (err error) {
-	for i := 0; ; i++ {
-		err = f()
-		if err == nil {
-			return
-		}
-		if i >= (attempts - 1) {
-			break
-		}
-		time.Sleep(sleep)
-		log.Println("Retrying job after error:", err)
+// Utility function to retry any routine, waiting sleep between attempts.
+// Failures are logged and the last one is reported to sentry. Use retry.Do
+// for context cancellation, backoff strategies and error classification.
+func Retry(attempts int, sleep time.Duration, f func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	err := retry.Do(context.Background(), &retry.Opts{
+		Attempts: attempts,
+		Strategy: retry.Constant(sleep),
+		OnRetry: func(_ int, _ time.Duration, err error) {
+			log.Println("Retrying after error:", err)
+		},
+	}, func(context.Context) error {
+		return f()
+	})
+	if err != nil {
+		sentry.CaptureException(err)
 	}
-	sentry.CaptureException(err)
-	return fmt.Errorf("Failed to trigger the job aftert %d attempts, last error: %s", attempts, err)
+	return err
 }
 
 // Get a HTTP client for interacting with k8s REST API
@@ -74,113 +81,88 @@ func GetNewHTTPClient(certFilePath string) (*http.Client, error) {
 	return httpClient, nil
 }
 
-// Fibonacci returns successive Fibonacci numbers starting from 1
-func fibonacci() func() int {
-	a, b := 0, 1
-	return func() int {
-		a, b = b, a+b
-		return a
-	}
-}
-
-// FibonacciNext returns next number in Fibonacci sequence greater than start
-func fibonacciNextNum(start int) int {
-	fib := fibonacci()
-	num := fib()
-	for num <= start {
-		num = fib()
-	}
-	return num
-}
-
 // Gets the duration interval of retries based on fibonacci series
 func GetRetryTimeout(currentTimeout int) (int, time.Duration) {
-	retryTimeout := fibonacciNextNum(currentTimeout)
+	retryTimeout := retry.FibonacciNext(currentTimeout)
 	durationString := fmt.Sprintf("%vs", retryTimeout)
 	duration, _ := time.ParseDuration(durationString)
 	return retryTimeout, duration
 }
 
-// Watches the broker config for any "WRITE" events
-// Exits with status code 1 after any changes to config
+// Watches the broker config for changes and calls reloadFunc after each of
+// them, including atomic renames such as Kubernetes ConfigMap updates.
+// Failed reloads are logged and reported to sentry, and watching goes on.
+// When the config cannot be watched, the error is logged and reported as
+// well and watching starts over, backing off exponentially up to a minute
+// between consecutive failures. Blocks forever, use WatchBrokerConfig to stop
+// watching.
 func WatchBrokerConfigForChanges(filePath string, reloadFunc func() error) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Println(err)
+	const maxDelay = time.Minute
+	backoff := retry.Exponential(time.Second)
+	failures := 0
+	for {
+		err := WatchBrokerConfig(context.Background(), filePath, reloadFunc)
+		if err == nil {
+			// The watch was set up and ran until the watcher stopped, the
+			// failures before it are history.
+			failures = 0
+			err = fmt.Errorf("watcher of %s stopped", filePath)
+		}
+		failures++
+		delay := backoff(failures)
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		log.Printf("Error watching broker config, retrying in %s: %v", delay, err)
 		sentry.CaptureException(err)
+		time.Sleep(delay)
 	}
-	defer watcher.Close()
-
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				log.Println(event)
-				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Remove == fsnotify.Remove {
-					log.Println("Received event:", event)
-					log.Println("modified file:", event.Name)
-
-					if strings.HasSuffix(event.Name, filePath) {
-						watcher.Close()
-						if reloadErr := reloadFunc(); reloadErr != nil {
-							log.Fatalln("Failed to reload janus. Exiting.") // skipcq
-						}
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Println("Watcher error:", err)
-			}
-		}
-	}()
+}
 
-	err = watcher.Add(filePath)
+// WatchBrokerConfig watches the broker config like
+// WatchBrokerConfigForChanges until ctx is done. See configwatch for a
+// watcher passing the parsed config.
+func WatchBrokerConfig(ctx context.Context, filePath string, reloadFunc func() error) error {
+	w, err := configwatch.New(&configwatch.Opts[[]byte]{
+		Path:  filePath,
+		Parse: func(data []byte) ([]byte, error) { return data, nil },
+	})
 	if err != nil {
-		log.Println(err)
-		sentry.CaptureException(err)
+		return err
 	}
-	<-done
+	w.Subscribe(func([]byte) {
+		if err := reloadFunc(); err != nil {
+			log.Println("Failed to reload config:", err)
+			sentry.CaptureException(err)
+		}
+	})
+	return w.Run(ctx)
 }
 
-// Utility to do a rolling restart deployment of a kubernetes pod
+// Utility to do a rolling restart deployment of a kubernetes pod, by applying
+// the strategic merge patch patchData to the deployment podName of the
+// default namespace. Transient failures are retried.
+// Use k8s.Client.RestartDeployment for other namespaces and to wait for the
+// rollout.
 func TriggerDeploymentRestart(auth bool, podName, patchData, baseURL, tokenPath string, httpClient *http.Client) error {
-	// Configuring the request
-	restartDeploymentRequest, _ := http.NewRequest("PATCH", baseURL+"/apis/apps/v1/namespaces/default/deployments/"+podName, bytes.NewBuffer([]byte(patchData)))
-	restartDeploymentRequest.Header.Set("Content-Type", "application/strategic-merge-patch+json")
-
-	// If auth is true, set Authorization header
+	opts := k8s.ClientOpts{
+		Host:       baseURL,
+		HTTPClient: httpClient,
+		Namespace:  k8s.DefaultNamespace,
+		Retry: &retry.Opts{
+			Attempts: 5,
+			Strategy: retry.Constant(2 * time.Second),
+		},
+	}
+	// If auth is true, send the Bearer Token in the Header
 	if auth {
-		bearer, err := GetNewBearerToken(tokenPath)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		restartDeploymentRequest.Header.Add("Authorization", bearer)
+		opts.Token = k8s.TokenFile(tokenPath)
 	}
 
-	// If not, try anyways without the Bearer Token in the Header
-	err := Retry(5, 2*time.Second, func() (err error) {
-		restartDeploymentResponse, err := httpClient.Do(restartDeploymentRequest)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		if restartDeploymentResponse.StatusCode != 200 && restartDeploymentResponse.StatusCode != 201 {
-			responseBody, _ := ioutil.ReadAll(restartDeploymentResponse.Body)
-			log.Println(string(responseBody))
-			return errors.New("Unable to create a kubernetes job")
-		}
-		defer restartDeploymentResponse.Body.Close()
-		return nil
-	})
-	if err != nil {
+	client := k8s.NewClient(&opts)
+	if _, err := client.PatchDeployment(context.Background(), "", podName, k8s.StrategicMergePatch, []byte(patchData)); err != nil {
 		log.Print(err.Error())
+		sentry.CaptureException(err)
 		return err
 	}
 	return nil
@@ -198,9 +180,14 @@ type AnalysisEventsLog struct {
 	IsFullRun     string
 }
 
-// logAnalysisEventTimestamp logs the timestamp at various analysis stages.
+// LogAnalysisEventTimestamp prints a CSV line with the timestamp, in seconds,
+// of an analysis stage. The columns are, in order, the run type, run id, run
+// serial, check sequence, shortcode, repository, commit SHA, full run flag,
+// stage and timestamp, and are escaped. Use an events.Tracker, with Event,
+// for millisecond timestamps, stage durations and other sinks.
 func (a *AnalysisEventsLog) LogAnalysisEventTimestamp(runType, stage string) {
-	fmt.Printf(analysisEventsLogFmt,
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{
 		runType,
 		a.RunID,
 		a.RunSerial,
@@ -210,6 +197,24 @@ func (a *AnalysisEventsLog) LogAnalysisEventTimestamp(runType, stage string) {
 		a.CommitSHA,
 		a.IsFullRun,
 		stage,
-		time.Now().Unix(),
-	)
+		strconv.FormatInt(time.Now().Unix(), 10),
+	})
+	w.Flush()
+}
+
+// Event returns the typed event of an analysis stage, to be tracked with an
+// events.Tracker.
+func (a *AnalysisEventsLog) Event(runType, stage string) events.Event {
+	isFullRun, _ := strconv.ParseBool(a.IsFullRun)
+	return events.Event{
+		RunType:       runType,
+		RunID:         a.RunID,
+		RunSerial:     a.RunSerial,
+		CheckSequence: a.CheckSequence,
+		Repository:    a.Repository,
+		Shortcode:     a.Shortcode,
+		CommitSHA:     a.CommitSHA,
+		IsFullRun:     isFullRun,
+		Stage:         stage,
+	}
 }